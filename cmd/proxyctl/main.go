@@ -0,0 +1,235 @@
+// proxyctl 代理服务的管理命令行工具，通过管理接口操作代理服务
+//
+// 用法：
+//
+//	proxyctl [-server <地址>] [-admin-token <令牌>] revoke -jti <jti>
+//	proxyctl [-server <地址>] [-admin-token <令牌>] revoke -token <token>
+//	proxyctl [-server <地址>] [-admin-token <令牌>] revoke -subject <用户名> [-before <RFC3339 时间>]
+//	proxyctl [-server <地址>] [-admin-token <令牌>] revocations
+//	proxyctl [-server <地址>] [-admin-token <令牌>] create-robot -name <名称> -expires <时长或 RFC3339 时间> -scope <仓库>:<操作> ...
+//	proxyctl [-server <地址>] [-admin-token <令牌>] create-token -owner <用户名> -name <描述> -expires <时长或 RFC3339 时间> -scope <仓库>:<操作> ...
+//	proxyctl [-server <地址>] [-admin-token <令牌>] credentials [-owner <用户名>]
+//	proxyctl [-server <地址>] [-admin-token <令牌>] delete-credential -id <凭据 ID>
+//
+// 服务地址默认读取环境变量 SELF_REGISTRY，管理令牌默认读取环境变量 ADMIN_TOKEN。
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+func main() {
+	server := flag.String("server", getEnv("SELF_REGISTRY", "http://localhost:8080"), "代理服务地址")
+	adminToken := flag.String("admin-token", os.Getenv("ADMIN_TOKEN"), "管理接口令牌")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	client := &adminClient{
+		server: strings.TrimRight(*server, "/"),
+		token:  *adminToken,
+	}
+	var err error
+	switch flag.Arg(0) {
+	case "revoke":
+		err = revoke(client, flag.Args()[1:])
+	case "revocations":
+		err = client.do("GET", "/admin/revocations", nil)
+	case "create-robot":
+		err = createCredential(client, "robot", flag.Args()[1:])
+	case "create-token":
+		err = createCredential(client, "token", flag.Args()[1:])
+	case "credentials":
+		err = listCredentials(client, flag.Args()[1:])
+	case "delete-credential":
+		err = deleteCredential(client, flag.Args()[1:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `Usage:
+  proxyctl [flags] revoke -jti <jti>
+  proxyctl [flags] revoke -token <token>
+  proxyctl [flags] revoke -subject <username> [-before <RFC3339 time>]
+  proxyctl [flags] revocations
+  proxyctl [flags] create-robot -name <name> -expires <duration|RFC3339 time> -scope <repository>:<actions> ...
+  proxyctl [flags] create-token -owner <username> -name <name> -expires <duration|RFC3339 time> -scope <repository>:<actions> ...
+  proxyctl [flags] credentials [-owner <username>]
+  proxyctl [flags] delete-credential -id <id>
+
+Flags:`)
+	flag.PrintDefaults()
+}
+
+// revoke 吊销 token 或用户的全部 token
+func revoke(client *adminClient, args []string) error {
+	flags := flag.NewFlagSet("revoke", flag.ExitOnError)
+	jti := flags.String("jti", "", "按 jti 吊销单个 token")
+	token := flags.String("token", "", "吊销指定的 token")
+	subject := flags.String("subject", "", "吊销用户的全部 token")
+	before := flags.String("before", "", "只吊销用户在此时间及之前签发的 token（RFC3339），默认为当前时间")
+	flags.Parse(args)
+	if *jti == "" && *token == "" && *subject == "" {
+		return fmt.Errorf("one of -jti, -token or -subject is required")
+	}
+
+	body := map[string]interface{}{
+		"jti":     *jti,
+		"token":   *token,
+		"subject": *subject,
+	}
+	if *before != "" {
+		t, err := time.Parse(time.RFC3339, *before)
+		if err != nil {
+			return fmt.Errorf("invalid -before: %v", err)
+		}
+		body["before"] = t
+	}
+	return client.do("POST", "/admin/revocations", body)
+}
+
+// scopeList 可以重复指定的 -scope 参数，格式为 <仓库名模式>:<以逗号分隔的操作>，例如 myorg/**:pull,push
+type scopeList []map[string][]string
+
+func (l *scopeList) String() string {
+	return fmt.Sprint(*l)
+}
+
+func (l *scopeList) Set(value string) error {
+	// 仓库名中可能包含端口号，按最后一个冒号分隔
+	i := strings.LastIndex(value, ":")
+	if i <= 0 || i == len(value)-1 {
+		return fmt.Errorf("invalid scope %q, expected <repository>:<actions>", value)
+	}
+	*l = append(*l, map[string][]string{
+		"repositories": {value[:i]},
+		"actions":      strings.Split(value[i+1:], ","),
+	})
+	return nil
+}
+
+// parseExpires 解析过期时间，支持时长（例如 720h）或 RFC3339 时间
+func parseExpires(value string) (time.Time, error) {
+	if duration, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(duration), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// createCredential 创建机器人账号或访问令牌
+func createCredential(client *adminClient, kind string, args []string) error {
+	flags := flag.NewFlagSet("create-"+kind, flag.ExitOnError)
+	name := flags.String("name", "", "机器人账号名称或访问令牌的描述")
+	owner := flags.String("owner", "", "访问令牌所属的用户")
+	expires := flags.String("expires", "", "过期时间，时长（例如 720h）或 RFC3339 时间")
+	scopes := scopeList{}
+	flags.Var(&scopes, "scope", "权限上限，格式为 <仓库名模式>:<操作>，例如 myorg/**:pull,push，可以指定多次")
+	flags.Parse(args)
+	if *expires == "" {
+		return fmt.Errorf("-expires is required")
+	}
+	expiresAt, err := parseExpires(*expires)
+	if err != nil {
+		return fmt.Errorf("invalid -expires: %v", err)
+	}
+	return client.do("POST", "/admin/credentials", map[string]interface{}{
+		"kind":      kind,
+		"name":      *name,
+		"owner":     *owner,
+		"scopes":    scopes,
+		"expiresAt": expiresAt,
+	})
+}
+
+// listCredentials 列出机器人账号和访问令牌
+func listCredentials(client *adminClient, args []string) error {
+	flags := flag.NewFlagSet("credentials", flag.ExitOnError)
+	owner := flags.String("owner", "", "只列出该用户的访问令牌")
+	flags.Parse(args)
+	path := "/admin/credentials"
+	if *owner != "" {
+		path += "?owner=" + url.QueryEscape(*owner)
+	}
+	return client.do("GET", path, nil)
+}
+
+// deleteCredential 删除机器人账号或访问令牌
+func deleteCredential(client *adminClient, args []string) error {
+	flags := flag.NewFlagSet("delete-credential", flag.ExitOnError)
+	id := flags.String("id", "", "凭据 ID")
+	flags.Parse(args)
+	if *id == "" {
+		return fmt.Errorf("-id is required")
+	}
+	return client.do("DELETE", "/admin/credentials/"+url.PathEscape(*id), nil)
+}
+
+// adminClient 管理接口客户端
+type adminClient struct {
+	server string
+	token  string
+}
+
+// do 发送请求并将响应输出到标准输出
+func (c *adminClient) do(method, path string, body interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.server+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	var out bytes.Buffer
+	if json.Indent(&out, data, "", "  ") == nil {
+		data = out.Bytes()
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+func getEnv(key, defaultValue string) string {
+	if value, exists := os.LookupEnv(key); exists {
+		return value
+	}
+	return defaultValue
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"net/http"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
@@ -20,19 +21,29 @@ func main() {
 
 	// 加载配置
 	cfg := config.NewConfig()
+	for _, warning := range cfg.Warnings {
+		log.Warn(warning)
+	}
 
 	// 初始化服务
-	// registryService := service.NewRegistryService(log, cfg)
+	registryService := service.NewRegistryService(log, cfg)
 	tokenService := service.NewTokenService(log, cfg)
 
 	// 初始化处理器
-	registryHandler := handler.NewRegistryHandler(log, cfg)
+	registryHandler := handler.NewRegistryHandler(log, cfg, registryService, tokenService)
+	adminHandler := handler.NewAdminHandler(log, cfg, tokenService)
 
 	// 初始化中间件
-	authMiddleware := middleware.NewAuthMiddleware(log, cfg, tokenService)
+	authMiddleware := middleware.NewAuthMiddleware(log, cfg, tokenService, registryService, registryHandler)
+	adminMiddleware := middleware.NewAdminMiddleware(log, cfg)
 
 	// 设置路由
 	r := gin.Default()
+	// gin 默认信任所有代理，未配置时不信任任何代理，否则认证失败次数按伪造的 X-Forwarded-For 统计；
+	// 反向代理之后部署时需要配置反向代理的地址
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatalf("Invalid trusted proxies: %v", err)
+	}
 
 	// 健康检查
 	r.GET("/health", func(c *gin.Context) {
@@ -41,27 +52,64 @@ func main() {
 		})
 	})
 
+	// token 校验公钥
+	r.GET("/.well-known/jwks.json", registryHandler.HandleJWKS)
+
+	// 管理接口
+	admin := r.Group("/admin")
+	admin.Use(adminMiddleware.AdminRequired())
+	{
+		admin.GET("/revocations", adminHandler.HandleListRevocations)
+		admin.POST("/revocations", adminHandler.HandleRevoke)
+		admin.GET("/credentials", adminHandler.HandleListCredentials)
+		admin.POST("/credentials", adminHandler.HandleCreateCredential)
+		admin.DELETE("/credentials/:id", adminHandler.HandleDeleteCredential)
+	}
+
 	// Docker Registry API v2 路由
 	v2 := r.Group("/v2")
 	{
 		// 认证相关路由（不需要认证）
 		v2.GET("/", registryHandler.HandleAuthChallenge)
 		v2.GET("/auth", registryHandler.HandleAuth)
+		v2.POST("/auth", registryHandler.HandleOAuthToken)
 		v2.POST("/users/login", registryHandler.HandleLogin)
 
+		// 个人访问令牌，使用账号密码认证
+		v2.GET("/users/tokens", registryHandler.HandleListTokens)
+		v2.POST("/users/tokens", registryHandler.HandleCreateToken)
+		v2.DELETE("/users/tokens/:id", registryHandler.HandleDeleteToken)
+
 		// 需要认证的路由
 		authorized := v2.Group("")
 		authorized.Use(authMiddleware.AuthRequired())
 		{
 			authorized.GET("/_catalog", registryHandler.HandleCatalog)
-			authorized.GET("/:name/tags/list", registryHandler.HandleTags)
-			authorized.GET("/:name/manifests/:reference", registryHandler.HandleManifest)
-			authorized.GET("/:name/blobs/:digest", registryHandler.HandleBlob)
 		}
 	}
 
+	// /v2/<name>/(manifests|blobs|tags)/... 路由，仓库名可包含多级路径
+	distributionRouter := handler.NewDistributionRouter(registryHandler)
+	r.NoRoute(
+		distributionRouter.Parse(),
+		authMiddleware.AuthRequired(),
+		distributionRouter.Dispatch(),
+	)
+
 	// 启动服务器
 	addr := ":" + strconv.Itoa(cfg.Port)
+	if cfg.TLSCertFile != "" {
+		tlsConfig, err := service.NewServerTLSConfig(cfg)
+		if err != nil {
+			log.Fatalf("Failed to load tls config: %v", err)
+		}
+		server := &http.Server{Addr: addr, Handler: r, TLSConfig: tlsConfig}
+		log.Infof("Starting Docker Registry Proxy on %s with TLS", addr)
+		if err := server.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile); err != nil {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+		return
+	}
 	log.Infof("Starting Docker Registry Proxy on %s", addr)
 	if err := r.Run(addr); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
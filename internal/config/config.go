@@ -2,13 +2,22 @@ package config
 
 import (
 	// "encoding/base64"
+	"fmt"
+	"math"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+// AuthModeBasic Basic 认证模式，客户端在每个请求中直接携带账号密码，不经过 token 交换
+const AuthModeBasic = "basic"
+
+// defaultCacheMaxSize CACHE_MAX_SIZE 的默认值
+const defaultCacheMaxSize = "10G"
+
 type Account struct {
 	Username string
 	Password string
@@ -17,41 +26,136 @@ type Account struct {
 type Config struct {
 	// 服务器配置
 	Port int
+	// HTTPS 证书和私钥，为空时使用 HTTP
+	TLSCertFile string
+	TLSKeyFile  string
+	// 校验客户端证书的 CA，为空时不请求客户端证书；客户端证书映射为用户的模板
+	TLSClientCAFile  string
+	TLSClientSubject string
 	// 上游Docker Registry配置
 	UpstreamRegistry string
 	UpstreamNoAuth   bool
+	// 多上游配置文件，按仓库名前缀选择上游
+	UpstreamsFile string
+	// 上游凭据文件，代理使用其中的账号向上游鉴权服务换取 token
+	UpstreamSecrets string
+	// containerd 镜像加速请求中 ns 参数允许访问的仓库
+	NamespaceAllowlist []string
 	// 认证配置
 	UpstreamAuthService string // 认证服务地址
+	// 校验默认上游签发的 token 使用的 JWKS 地址、JWKS 文件、x5c 根证书和 iss
+	UpstreamJWKSURL  string
+	UpstreamJWKSFile string
+	UpstreamRootCert string
+	UpstreamIssuer   string
 	// 当前镜像服务地址
 	SelfRegistry    string
 	SelfAuthService string // 当前镜像鉴权服务
-	// 账号配置
+	// 账号配置，base64 编码的 user:password，已废弃，建议使用 HtpasswdFile
 	Accounts []string
+	// htpasswd 账号文件（bcrypt），修改后自动重新加载
+	HtpasswdFile string
+	// 仓库权限策略文件
+	PolicyFile string
+	// OIDC 身份提供方和映射规则配置文件，CI 任务可以使用 ID token 作为密码登录
+	OIDCConfigFile string
+	// 认证模式，token（默认）为 Docker 的 token 认证，basic 为 Basic 认证
+	AuthMode string
+	// Basic 认证模式下通过校验的账号密码的缓存时长，0 表示不缓存
+	BasicAuthCacheTTL time.Duration
 	// 跳过认证代理
 	SkipAuthProxy bool
-	// 服务端加密密钥
+	// 服务端加密密钥，未配置签名私钥时用于 HS256 签名
 	ServerSecret string
+	// token 签名私钥文件（PEM），RSA 密钥使用 RS256 签名，EC 密钥使用 ES256 签名
+	TokenSigningKeyFile string
+	// 访问 token 和刷新 token 的有效期
+	TokenTTL        time.Duration
+	RefreshTokenTTL time.Duration
+	// token 吊销列表文件，为空时只保存在内存中
+	RevocationFile string
+	// 机器人账号和个人访问令牌的存储文件，为空时只保存在内存中
+	CredentialsFile string
+	// 连续认证失败的锁定阈值（用户名、来源 IP），0 表示不限制；失败后的退避时间和锁定时长
+	LoginMaxFailures   int
+	LoginIPMaxFailures int
+	LoginBackoff       time.Duration
+	LoginLockout       time.Duration
+	// 信任的反向代理地址，来自这些地址的请求使用 X-Forwarded-For 中的客户端 IP
+	TrustedProxies []string
+	// 管理接口的访问令牌，为空时不开启管理接口
+	AdminToken string
+	// token 校验公钥文件（PEM）列表，用于密钥轮换期间校验旧密钥签发的 token
+	TokenVerifyKeyFiles []string
+	// 镜像层缓存配置
+	CacheEnabled bool
+	CacheDir     string
+	CacheMaxSize int64 // 缓存最大字节数，0 表示不限制
+	// 标签引用的 manifest 缓存时长，0 表示不缓存标签
+	ManifestCacheTTL time.Duration
+	// 无效并已使用默认值替代的配置，启动时输出警告
+	Warnings []string
 }
 
 func NewConfig() *Config {
-	port, _ := strconv.Atoi(getEnv("PORT", "8080"))
 	accounts := []string{}
 	accountsStr := getEnv("ACCOUNTS", "")
 	if accountsStr != "" {
 		accountStrs := strings.Split(accountsStr, ",")
 		accounts = append(accounts, accountStrs...)
 	}
-	return &Config{
-		Port:                port,
+	warnings := []string{}
+	cacheMaxSize, err := parseSize(getEnv("CACHE_MAX_SIZE", defaultCacheMaxSize))
+	if err != nil {
+		warnings = append(warnings, fmt.Sprintf("Invalid CACHE_MAX_SIZE, using %s: %v", defaultCacheMaxSize, err))
+		cacheMaxSize, _ = parseSize(defaultCacheMaxSize)
+	}
+	cfg := &Config{
+		Port:                getInt("PORT", 8080, &warnings),
+		TLSCertFile:         getEnv("TLS_CERT_FILE", ""),
+		TLSKeyFile:          getEnv("TLS_KEY_FILE", ""),
+		TLSClientCAFile:     getEnv("TLS_CLIENT_CA_FILE", ""),
+		TLSClientSubject:    getEnv("TLS_CLIENT_SUBJECT", "{cn}"),
 		UpstreamRegistry:    getEnv("UPSTREAM_REGISTRY", "https://registry-1.docker.io"),
 		UpstreamNoAuth:      getEnv("UPSTREAM_NO_AUTH", "false") == "true",
+		UpstreamsFile:       getEnv("UPSTREAMS_FILE", ""),
+		UpstreamSecrets:     getEnv("UPSTREAM_SECRETS_FILE", ""),
+		NamespaceAllowlist:  getList("NS_ALLOWLIST"),
 		UpstreamAuthService: getEnv("AUTH_SERVICE", "https://auth.docker.io"),
+		UpstreamJWKSURL:     getEnv("UPSTREAM_TOKEN_JWKS_URL", ""),
+		UpstreamJWKSFile:    getEnv("UPSTREAM_TOKEN_JWKS_FILE", ""),
+		UpstreamRootCert:    getEnv("UPSTREAM_TOKEN_ROOT_CERT_FILE", ""),
+		UpstreamIssuer:      getEnv("UPSTREAM_TOKEN_ISSUER", ""),
 		SelfRegistry:        getEnv("SELF_REGISTRY", "http://localhost:8080"),
 		SelfAuthService:     "docker-image-proxy",
+		AuthMode:            getEnv("AUTH_MODE", "token"),
+		BasicAuthCacheTTL:   getDuration("BASIC_AUTH_CACHE_TTL", 30*time.Second, &warnings),
 		SkipAuthProxy:       getEnv("SKIP_AUTH_PROXY", "false") == "true",
 		Accounts:            accounts,
+		HtpasswdFile:        getEnv("HTPASSWD_FILE", ""),
+		PolicyFile:          getEnv("POLICY_FILE", ""),
+		OIDCConfigFile:      getEnv("OIDC_CONFIG_FILE", ""),
 		ServerSecret:        getEnv("SERVER_SECRET", uuid.New().String()),
+		TokenSigningKeyFile: getEnv("TOKEN_SIGNING_KEY_FILE", ""),
+		TokenVerifyKeyFiles: getList("TOKEN_VERIFY_KEY_FILES"),
+		TokenTTL:            getDuration("TOKEN_TTL", 24*time.Hour, &warnings),
+		RefreshTokenTTL:     getDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour, &warnings),
+		RevocationFile:      getEnv("REVOCATION_FILE", "data/revocations.json"),
+		CredentialsFile:     getEnv("CREDENTIALS_FILE", "data/credentials.json"),
+		LoginMaxFailures:    getInt("LOGIN_MAX_FAILURES", 5, &warnings),
+		LoginIPMaxFailures:  getInt("LOGIN_IP_MAX_FAILURES", 20, &warnings),
+		LoginBackoff:        getDuration("LOGIN_BACKOFF", time.Second, &warnings),
+		LoginLockout:        getDuration("LOGIN_LOCKOUT", 15*time.Minute, &warnings),
+		TrustedProxies:      getList("TRUSTED_PROXIES"),
+		AdminToken:          getEnv("ADMIN_TOKEN", ""),
+		CacheEnabled:        getEnv("CACHE_ENABLED", "false") == "true",
+		CacheDir:            getEnv("CACHE_DIR", "data/cache"),
+		CacheMaxSize:        cacheMaxSize,
+		ManifestCacheTTL:    getDuration("MANIFEST_CACHE_TTL", 5*time.Minute, &warnings),
 	}
+	// 读取配置时追加的警告在所有字段解析完成后写入
+	cfg.Warnings = warnings
+	return cfg
 }
 
 func getEnv(key, defaultValue string) string {
@@ -60,3 +164,71 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+// getList 读取逗号分隔的列表类型环境变量
+func getList(key string) []string {
+	list := []string{}
+	for _, item := range strings.Split(getEnv(key, ""), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// getInt 读取整数类型的环境变量，值无效时使用默认值并记录警告
+func getInt(key string, defaultValue int, warnings *[]string) int {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return defaultValue
+	}
+	number, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		*warnings = append(*warnings, fmt.Sprintf("Invalid %s %q, using %d", key, value, defaultValue))
+		return defaultValue
+	}
+	return number
+}
+
+// getDuration 读取时长类型的环境变量，格式同 time.ParseDuration，例如 30s、5m、1h，
+// 值无效时使用默认值并记录警告
+func getDuration(key string, defaultValue time.Duration, warnings *[]string) time.Duration {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return defaultValue
+	}
+	duration, err := time.ParseDuration(strings.TrimSpace(value))
+	if err != nil {
+		*warnings = append(*warnings, fmt.Sprintf("Invalid %s %q, using %s", key, value, defaultValue))
+		return defaultValue
+	}
+	return duration
+}
+
+// parseSize 解析带单位的容量字符串，支持 K、M、G、T 后缀，例如 512M、10G，0 表示不限制
+func parseSize(value string) (int64, error) {
+	raw := value
+	value = strings.ToUpper(strings.TrimSpace(value))
+	value = strings.TrimSuffix(value, "B")
+	multiplier := int64(1)
+	if value != "" {
+		switch value[len(value)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			value = value[:len(value)-1]
+		}
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 || size > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("invalid size %q", raw)
+	}
+	return size * multiplier, nil
+}
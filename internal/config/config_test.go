@@ -0,0 +1,58 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value string
+		size  int64
+		ok    bool
+	}{
+		{"0", 0, true},
+		{"1024", 1024, true},
+		{"512M", 512 << 20, true},
+		{"10G", 10 << 30, true},
+		{"10gb", 10 << 30, true},
+		{" 2T ", 2 << 40, true},
+		{"", 0, false},
+		{"10X", 0, false},
+		{"ten", 0, false},
+		{"-1G", 0, false},
+		{"99999999999T", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			size, err := parseSize(tt.value)
+			if (err == nil) != tt.ok || size != tt.size {
+				t.Fatalf("parseSize(%q) = %d, %v, want %d, ok=%v", tt.value, size, err, tt.size, tt.ok)
+			}
+		})
+	}
+}
+
+func TestInvalidCacheMaxSizeFallsBack(t *testing.T) {
+	t.Setenv("CACHE_MAX_SIZE", "10X")
+	cfg := NewConfig()
+	if cfg.CacheMaxSize != 10<<30 {
+		t.Fatalf("CacheMaxSize = %d, want 10G", cfg.CacheMaxSize)
+	}
+	if len(cfg.Warnings) != 1 {
+		t.Fatalf("Warnings = %v, want one warning", cfg.Warnings)
+	}
+}
+
+func TestInvalidNumbersFallBack(t *testing.T) {
+	t.Setenv("LOGIN_MAX_FAILURES", "five")
+	t.Setenv("LOGIN_LOCKOUT", "15")
+	t.Setenv("TOKEN_TTL", " 2h ")
+	cfg := NewConfig()
+	if cfg.LoginMaxFailures != 5 || cfg.LoginLockout != 15*time.Minute || cfg.TokenTTL != 2*time.Hour {
+		t.Fatalf("LoginMaxFailures=%d LoginLockout=%s TokenTTL=%s", cfg.LoginMaxFailures, cfg.LoginLockout, cfg.TokenTTL)
+	}
+	if len(cfg.Warnings) != 2 {
+		t.Fatalf("Warnings = %v, want two warnings", cfg.Warnings)
+	}
+}
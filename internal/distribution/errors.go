@@ -0,0 +1,106 @@
+package distribution
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrorCode Distribution 规范定义的错误码
+type ErrorCode string
+
+const (
+	ErrorCodeBlobUnknown     ErrorCode = "BLOB_UNKNOWN"
+	ErrorCodeDigestInvalid   ErrorCode = "DIGEST_INVALID"
+	ErrorCodeManifestUnknown ErrorCode = "MANIFEST_UNKNOWN"
+	ErrorCodeManifestInvalid ErrorCode = "MANIFEST_INVALID"
+	ErrorCodeNameInvalid     ErrorCode = "NAME_INVALID"
+	ErrorCodeNameUnknown     ErrorCode = "NAME_UNKNOWN"
+	ErrorCodeUnauthorized    ErrorCode = "UNAUTHORIZED"
+	ErrorCodeDenied          ErrorCode = "DENIED"
+	ErrorCodeUnsupported     ErrorCode = "UNSUPPORTED"
+	ErrorCodeTooManyRequests ErrorCode = "TOOMANYREQUESTS"
+	ErrorCodeUnknown         ErrorCode = "UNKNOWN"
+)
+
+// errorCodeInfo 错误码对应的默认提示和状态码
+var errorCodeInfo = map[ErrorCode]struct {
+	message string
+	status  int
+}{
+	ErrorCodeBlobUnknown:     {"blob unknown to registry", http.StatusNotFound},
+	ErrorCodeDigestInvalid:   {"provided digest did not match uploaded content", http.StatusBadRequest},
+	ErrorCodeManifestUnknown: {"manifest unknown", http.StatusNotFound},
+	ErrorCodeManifestInvalid: {"manifest invalid", http.StatusBadRequest},
+	ErrorCodeNameInvalid:     {"invalid repository name", http.StatusBadRequest},
+	ErrorCodeNameUnknown:     {"repository name not known to registry", http.StatusNotFound},
+	ErrorCodeUnauthorized:    {"authentication required", http.StatusUnauthorized},
+	ErrorCodeDenied:          {"requested access to the resource is denied", http.StatusForbidden},
+	ErrorCodeUnsupported:     {"The operation is unsupported.", http.StatusMethodNotAllowed},
+	ErrorCodeTooManyRequests: {"too many requests", http.StatusTooManyRequests},
+	ErrorCodeUnknown:         {"unknown error", http.StatusInternalServerError},
+}
+
+// Message 错误码的默认提示
+func (code ErrorCode) Message() string {
+	return errorCodeInfo[code].message
+}
+
+// Status 错误码的默认状态码
+func (code ErrorCode) Status() int {
+	if info, ok := errorCodeInfo[code]; ok {
+		return info.status
+	}
+	return http.StatusInternalServerError
+}
+
+// Error Distribution 规范的错误信息
+type Error struct {
+	Code    ErrorCode   `json:"code"`
+	Message string      `json:"message"`
+	Detail  interface{} `json:"detail,omitempty"`
+}
+
+// Errors Distribution 规范的错误响应体
+type Errors struct {
+	Errors []Error `json:"errors"`
+}
+
+// NewError 使用默认提示创建错误信息
+func NewError(code ErrorCode, detail interface{}) Error {
+	return Error{
+		Code:    code,
+		Message: code.Message(),
+		Detail:  detail,
+	}
+}
+
+// CodeForStatus 根据状态码推断错误码，404 时使用 notFound 指定的错误码
+func CodeForStatus(status int, notFound ErrorCode) ErrorCode {
+	switch status {
+	case http.StatusUnauthorized:
+		return ErrorCodeUnauthorized
+	case http.StatusForbidden:
+		return ErrorCodeDenied
+	case http.StatusNotFound:
+		return notFound
+	case http.StatusTooManyRequests:
+		return ErrorCodeTooManyRequests
+	case http.StatusMethodNotAllowed:
+		return ErrorCodeUnsupported
+	default:
+		return ErrorCodeUnknown
+	}
+}
+
+// IsErrorsBody 判断响应体是否为 Distribution 规范的错误响应
+func IsErrorsBody(body []byte) bool {
+	var errs Errors
+	return json.Unmarshal(body, &errs) == nil && len(errs.Errors) > 0
+}
+
+// AbortWithError 以 Distribution 规范的格式返回错误并终止请求
+func AbortWithError(c *gin.Context, status int, errs ...Error) {
+	c.AbortWithStatusJSON(status, Errors{Errors: errs})
+}
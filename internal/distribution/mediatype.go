@@ -0,0 +1,129 @@
+package distribution
+
+import (
+	"encoding/json"
+	"mime"
+	"sort"
+	"strings"
+)
+
+// manifest 媒体类型
+const (
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeDockerSchema1      = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+	MediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+)
+
+// ManifestMediaTypes 客户端未指定 Accept 时向上游请求的 manifest 媒体类型
+var ManifestMediaTypes = []string{
+	MediaTypeOCIIndex,
+	MediaTypeOCIManifest,
+	MediaTypeDockerManifestList,
+	MediaTypeDockerManifest,
+}
+
+// Accepts 判断 Accept 请求头是否接受指定媒体类型，Accept 为空时视为全部接受
+func Accepts(accept []string, mediaType string) bool {
+	mediaType = baseMediaType(mediaType)
+	empty := true
+	for _, header := range accept {
+		for _, item := range strings.Split(header, ",") {
+			item = baseMediaType(item)
+			if item == "" {
+				continue
+			}
+			empty = false
+			if item == "*/*" || item == mediaType {
+				return true
+			}
+			if strings.HasSuffix(item, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(item, "*")) {
+				return true
+			}
+		}
+	}
+	return empty
+}
+
+// DetectManifestMediaType 根据 manifest 内容中的 mediaType 字段推断媒体类型
+func DetectManifestMediaType(data []byte) string {
+	var manifest struct {
+		SchemaVersion int    `json:"schemaVersion"`
+		MediaType     string `json:"mediaType"`
+		Manifests     []any  `json:"manifests"`
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return ""
+	}
+	switch {
+	case manifest.MediaType != "":
+		return manifest.MediaType
+	case manifest.SchemaVersion == 1:
+		return MediaTypeDockerSchema1
+	case manifest.Manifests != nil:
+		return MediaTypeOCIIndex
+	default:
+		return MediaTypeOCIManifest
+	}
+}
+
+// NormalizeAccept 将 Accept 请求头规范化为去重排序后的 manifest 媒体类型列表，上游按该列表协商 manifest 类型，
+// 只保留已知的 manifest 媒体类型（见 IsManifestMediaType），未知类型不影响上游返回的已知类型；
+// Accept 为空时为 ManifestMediaTypes
+func NormalizeAccept(accept []string) []string {
+	seen := map[string]bool{}
+	normalized := []string{}
+	empty := true
+	for _, header := range accept {
+		for _, item := range strings.Split(header, ",") {
+			item = baseMediaType(item)
+			if item == "" {
+				continue
+			}
+			empty = false
+			if IsManifestMediaType(item) && !seen[item] {
+				seen[item] = true
+				normalized = append(normalized, item)
+			}
+		}
+	}
+	if empty {
+		normalized = append(normalized, ManifestMediaTypes...)
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+// IsManifestMediaType 判断是否为已知的 manifest 媒体类型，包括 ManifestMediaTypes 和 schema1
+func IsManifestMediaType(mediaType string) bool {
+	mediaType = baseMediaType(mediaType)
+	for _, item := range ManifestMediaTypes {
+		if item == mediaType {
+			return true
+		}
+	}
+	return mediaType == MediaTypeDockerSchema1
+}
+
+// IsGenericMediaType 判断上游返回的 Content-Type 是否没有标明 manifest 类型，
+// 为空或者为 application/json、text/plain（可带参数，例如 charset）时需要根据内容推断
+func IsGenericMediaType(value string) bool {
+	switch baseMediaType(value) {
+	case "", "application/json", "text/plain":
+		return true
+	}
+	return false
+}
+
+// baseMediaType 去掉媒体类型中的参数，例如 q=0.5
+func baseMediaType(value string) string {
+	value = strings.TrimSpace(value)
+	if mediaType, _, err := mime.ParseMediaType(value); err == nil {
+		return mediaType
+	}
+	if i := strings.Index(value, ";"); i >= 0 {
+		value = value[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(value))
+}
@@ -0,0 +1,76 @@
+package distribution
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeAccept(t *testing.T) {
+	tests := []struct {
+		name   string
+		accept []string
+		want   []string
+	}{
+		{"empty", nil, []string{MediaTypeDockerManifestList, MediaTypeDockerManifest, MediaTypeOCIIndex, MediaTypeOCIManifest}},
+		{"sorted and deduplicated", []string{MediaTypeOCIManifest + ", " + MediaTypeDockerManifest, MediaTypeOCIManifest},
+			[]string{MediaTypeDockerManifest, MediaTypeOCIManifest}},
+		{"parameters removed", []string{MediaTypeDockerManifest + "; q=0.5"}, []string{MediaTypeDockerManifest}},
+		{"unknown types dropped", []string{"application/x-foo", MediaTypeDockerManifest, "*/*"}, []string{MediaTypeDockerManifest}},
+		{"only unknown types", []string{"application/json"}, []string{}},
+		{"schema1", []string{MediaTypeDockerSchema1}, []string{MediaTypeDockerSchema1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NormalizeAccept(tt.accept); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("NormalizeAccept(%q) = %q, want %q", tt.accept, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccepts(t *testing.T) {
+	tests := []struct {
+		name      string
+		accept    []string
+		mediaType string
+		accepts   bool
+	}{
+		{"empty accepts all", nil, MediaTypeOCIIndex, true},
+		{"exact", []string{MediaTypeDockerManifest}, MediaTypeDockerManifest, true},
+		{"not listed", []string{MediaTypeDockerManifest}, MediaTypeOCIIndex, false},
+		{"comma separated", []string{MediaTypeDockerManifest + ", " + MediaTypeOCIIndex}, MediaTypeOCIIndex, true},
+		{"multiple headers", []string{MediaTypeDockerManifest, MediaTypeOCIIndex}, MediaTypeOCIIndex, true},
+		{"parameters ignored", []string{MediaTypeOCIIndex + "; q=0.9"}, MediaTypeOCIIndex + "; charset=utf-8", true},
+		{"wildcard", []string{"*/*"}, MediaTypeOCIIndex, true},
+		{"type wildcard", []string{"application/*"}, MediaTypeOCIIndex, true},
+		{"other type wildcard", []string{"text/*"}, MediaTypeOCIIndex, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if accepts := Accepts(tt.accept, tt.mediaType); accepts != tt.accepts {
+				t.Fatalf("Accepts(%q, %q) = %v, want %v", tt.accept, tt.mediaType, accepts, tt.accepts)
+			}
+		})
+	}
+}
+
+func TestDetectManifestMediaType(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		mediaType string
+	}{
+		{"media type field", `{"schemaVersion": 2, "mediaType": "` + MediaTypeDockerManifestList + `"}`, MediaTypeDockerManifestList},
+		{"schema1", `{"schemaVersion": 1, "name": "library/nginx"}`, MediaTypeDockerSchema1},
+		{"oci index without media type", `{"schemaVersion": 2, "manifests": []}`, MediaTypeOCIIndex},
+		{"oci manifest without media type", `{"schemaVersion": 2, "layers": []}`, MediaTypeOCIManifest},
+		{"invalid json", `not json`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if mediaType := DetectManifestMediaType([]byte(tt.data)); mediaType != tt.mediaType {
+				t.Fatalf("DetectManifestMediaType() = %q, want %q", mediaType, tt.mediaType)
+			}
+		})
+	}
+}
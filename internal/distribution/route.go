@@ -0,0 +1,102 @@
+package distribution
+
+import (
+	"regexp"
+	"strings"
+)
+
+// RouteContextKey 上下文中保存解析后路由的键
+const RouteContextKey = "route"
+
+// 路由类型
+const (
+	RouteManifests = "manifests"
+	RouteBlobs     = "blobs"
+	RouteTags      = "tags"
+	RouteUploads   = "uploads"
+)
+
+var (
+	// nameRegexp 仓库名格式，见 Distribution 规范：
+	// [a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*(\/[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*)*
+	nameRegexp = regexp.MustCompile(`^[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*(/[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*)*$`)
+	// tagRegexp 标签格式
+	tagRegexp = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+	// digestRegexp 摘要格式
+	digestRegexp = regexp.MustCompile(`^[a-z0-9]+([+._-][a-z0-9]+)*:[a-zA-Z0-9=_-]+$`)
+)
+
+// Route 解析后的 /v2/<name>/... 路由
+type Route struct {
+	Kind      string // manifests、blobs、tags
+	Name      string // 仓库名，可包含多级路径，例如 library/nginx
+	Reference string // manifest 的标签或摘要，镜像层的摘要
+}
+
+// ValidName 判断仓库名是否合法
+func ValidName(name string) bool {
+	return len(name) <= 255 && nameRegexp.MatchString(name)
+}
+
+// ValidTag 判断标签是否合法
+func ValidTag(tag string) bool {
+	return tagRegexp.MatchString(tag)
+}
+
+// ValidDigest 判断摘要是否合法
+func ValidDigest(digest string) bool {
+	return digestRegexp.MatchString(digest)
+}
+
+// ParseRoute 解析请求路径，支持：
+//   - /v2/<name>/manifests/<reference>
+//   - /v2/<name>/blobs/<digest>
+//   - /v2/<name>/tags/list
+//   - /v2/<name>/blobs/uploads/ 和 /v2/<name>/blobs/uploads/<uuid>，上传接口，Reference 为上传 ID
+//
+// 仓库名中可能包含 manifests、blobs 等路径段，因此从路径末尾开始匹配。
+func ParseRoute(path string) (*Route, bool) {
+	if !strings.HasPrefix(path, "/v2/") {
+		return nil, false
+	}
+	parts := strings.Split(strings.TrimPrefix(path, "/v2/"), "/")
+	if len(parts) < 3 {
+		return nil, false
+	}
+	// 上传接口 /v2/<name>/blobs/uploads/[<uuid>]
+	if n := len(parts); n >= 4 && parts[n-3] == "blobs" && parts[n-2] == "uploads" {
+		route := &Route{
+			Kind:      RouteUploads,
+			Name:      strings.Join(parts[:n-3], "/"),
+			Reference: parts[n-1],
+		}
+		return route, ValidName(route.Name)
+	}
+	last := len(parts) - 1
+	route := &Route{
+		Kind:      parts[last-1],
+		Name:      strings.Join(parts[:last-1], "/"),
+		Reference: parts[last],
+	}
+	if !ValidName(route.Name) {
+		return nil, false
+	}
+	switch route.Kind {
+	case RouteManifests:
+		if !ValidTag(route.Reference) && !ValidDigest(route.Reference) {
+			return nil, false
+		}
+	case RouteBlobs:
+		if !ValidDigest(route.Reference) {
+			return nil, false
+		}
+	case RouteTags:
+		if route.Reference != "list" {
+			return nil, false
+		}
+		route.Reference = ""
+	default:
+		return nil, false
+	}
+	return route, true
+}
@@ -0,0 +1,70 @@
+package distribution
+
+import "testing"
+
+func TestParseRoute(t *testing.T) {
+	digest := "sha256:" + "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		path  string
+		ok    bool
+		route Route
+	}{
+		{"/v2/nginx/manifests/latest", true, Route{Kind: RouteManifests, Name: "nginx", Reference: "latest"}},
+		{"/v2/library/nginx/manifests/1.25", true, Route{Kind: RouteManifests, Name: "library/nginx", Reference: "1.25"}},
+		{"/v2/a/b/c/manifests/" + digest, true, Route{Kind: RouteManifests, Name: "a/b/c", Reference: digest}},
+		{"/v2/library/nginx/blobs/" + digest, true, Route{Kind: RouteBlobs, Name: "library/nginx", Reference: digest}},
+		{"/v2/myorg/app/tags/list", true, Route{Kind: RouteTags, Name: "myorg/app"}},
+		// 仓库名中包含 manifests、blobs 等路径段时从末尾匹配
+		{"/v2/myorg/manifests/app/manifests/v1", true, Route{Kind: RouteManifests, Name: "myorg/manifests/app", Reference: "v1"}},
+		{"/v2/blobs/tags/list", true, Route{Kind: RouteTags, Name: "blobs"}},
+		{"/v2/myorg/app/blobs/uploads/", true, Route{Kind: RouteUploads, Name: "myorg/app"}},
+		{"/v2/myorg/app/blobs/uploads/abc-123", true, Route{Kind: RouteUploads, Name: "myorg/app", Reference: "abc-123"}},
+		{"/v2/", false, Route{}},
+		{"/v2/nginx/manifests", false, Route{}},
+		{"/v1/nginx/manifests/latest", false, Route{}},
+		{"/v2/Nginx/manifests/latest", false, Route{}},
+		{"/v2/my--org_/app/manifests/latest", false, Route{}},
+		{"/v2/nginx/manifests/-latest", false, Route{}},
+		{"/v2/nginx/blobs/latest", false, Route{}},
+		{"/v2/nginx/tags/all", false, Route{}},
+		{"/v2/nginx/referrers/" + digest, false, Route{}},
+		{"/v2//nginx/manifests/latest", false, Route{}},
+		{"/v2/../nginx/manifests/latest", false, Route{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			route, ok := ParseRoute(tt.path)
+			if ok != tt.ok {
+				t.Fatalf("ParseRoute(%q) ok = %v, want %v", tt.path, ok, tt.ok)
+			}
+			if ok && *route != tt.route {
+				t.Fatalf("ParseRoute(%q) = %+v, want %+v", tt.path, *route, tt.route)
+			}
+		})
+	}
+}
+
+func TestValidName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"nginx", true},
+		{"library/nginx", true},
+		{"ghcr.io/org/app", true},
+		{"my-org/my__app", true},
+		{"a.b_c--d/e", true},
+		{"", false},
+		{"Nginx", false},
+		{"-nginx", false},
+		{"nginx/", false},
+		{"org//app", false},
+		{"host:5000/app", false},
+		{"org/*", false},
+	}
+	for _, tt := range tests {
+		if valid := ValidName(tt.name); valid != tt.valid {
+			t.Errorf("ValidName(%q) = %v, want %v", tt.name, valid, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/yunnysunny/docker-image-proxy/internal/config"
+	"github.com/yunnysunny/docker-image-proxy/internal/service"
+)
+
+// AdminHandler 管理接口
+type AdminHandler struct {
+	log          *logrus.Logger
+	config       *config.Config
+	tokenService *service.TokenService
+}
+
+// NewAdminHandler 创建管理接口处理器
+func NewAdminHandler(
+	log *logrus.Logger,
+	config *config.Config,
+	tokenService *service.TokenService,
+) *AdminHandler {
+	return &AdminHandler{
+		log:          log,
+		config:       config,
+		tokenService: tokenService,
+	}
+}
+
+// RevokeRequest 吊销请求，jti、token、subject 至少指定一个
+type RevokeRequest struct {
+	// 按 jti 吊销单个 token
+	Jti string `json:"jti"`
+	// 吊销指定的 token，从中读取 jti 和过期时间，不校验签名
+	Token string `json:"token"`
+	// 吊销用户在 before 及之前签发的全部 token，before 为空时使用当前时间
+	Subject string    `json:"subject"`
+	Before  time.Time `json:"before"`
+}
+
+// HandleListRevocations 返回吊销列表
+func (h *AdminHandler) HandleListRevocations(c *gin.Context) {
+	c.JSON(http.StatusOK, h.tokenService.Revocations().List())
+}
+
+// HandleRevoke 吊销 token
+func (h *AdminHandler) HandleRevoke(c *gin.Context) {
+	var req RevokeRequest
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Jti == "" && req.Token == "" && req.Subject == "") {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "One of jti, token or subject is required",
+		})
+		return
+	}
+	revocations := h.tokenService.Revocations()
+	logger := h.log.WithField("ip", c.ClientIP())
+
+	var expiresAt time.Time
+	if req.Token != "" {
+		claims, err := h.tokenService.GetUnverifiedToken(req.Token)
+		if err != nil || claims.Jti == "" {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "Invalid token",
+			})
+			return
+		}
+		req.Jti = claims.Jti
+		expiresAt = time.Unix(claims.Exp, 0)
+	}
+	if req.Jti != "" {
+		if err := revocations.RevokeToken(req.Jti, expiresAt); err != nil {
+			logger.WithError(err).Error("Failed to revoke token")
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Failed to revoke token",
+			})
+			return
+		}
+		logger.WithField("jti", req.Jti).Info("Token revoked")
+	}
+	if req.Subject != "" {
+		if err := revocations.RevokeSubject(req.Subject, req.Before); err != nil {
+			logger.WithError(err).Error("Failed to revoke subject")
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Failed to revoke subject",
+			})
+			return
+		}
+		logger.WithFields(logrus.Fields{
+			"subject": req.Subject,
+			"before":  req.Before,
+		}).Info("Subject tokens revoked")
+	}
+	c.JSON(http.StatusOK, revocations.List())
+}
+
+// CreateCredentialResponse 创建凭据的响应，密钥只在创建时返回一次
+type CreateCredentialResponse struct {
+	Credential *service.Credential `json:"credential"`
+	Username   string              `json:"username"` // 使用凭据认证时的用户名
+	Secret     string              `json:"secret"`   // 使用凭据认证时的密码
+}
+
+// HandleListCredentials 返回机器人账号和访问令牌列表，owner 参数不为空时只返回该用户的访问令牌
+func (h *AdminHandler) HandleListCredentials(c *gin.Context) {
+	c.JSON(http.StatusOK, h.tokenService.Credentials().List(c.Query("owner")))
+}
+
+// HandleCreateCredential 创建机器人账号或访问令牌
+func (h *AdminHandler) HandleCreateCredential(c *gin.Context) {
+	var req service.CreateCredentialRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return
+	}
+	createCredential(c, h.log, h.tokenService.Credentials(), req)
+}
+
+// HandleDeleteCredential 删除机器人账号或访问令牌
+func (h *AdminHandler) HandleDeleteCredential(c *gin.Context) {
+	deleteCredential(c, h.log, h.tokenService.Credentials(), c.Param("id"), "")
+}
+
+// createCredential 创建凭据并返回密钥，管理接口和个人访问令牌接口共用
+func createCredential(
+	c *gin.Context, log *logrus.Logger, store *service.CredentialStore, req service.CreateCredentialRequest,
+) {
+	credential, secret, err := store.Create(req)
+	if errors.Is(err, service.ErrInvalidCredentialRequest) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("Failed to create credential")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to create credential",
+		})
+		return
+	}
+	log.WithFields(logrus.Fields{
+		"id":      credential.ID,
+		"kind":    credential.Kind,
+		"subject": credential.Subject(),
+		"ip":      c.ClientIP(),
+	}).Info("Credential created")
+	c.JSON(http.StatusOK, CreateCredentialResponse{
+		Credential: credential,
+		Username:   credential.Subject(),
+		Secret:     secret,
+	})
+}
+
+// deleteCredential 删除凭据，owner 不为空时只能删除该用户的访问令牌
+func deleteCredential(c *gin.Context, log *logrus.Logger, store *service.CredentialStore, id, owner string) {
+	err := store.Delete(id, owner)
+	if errors.Is(err, service.ErrCredentialNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Credential not found",
+		})
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("Failed to delete credential")
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to delete credential",
+		})
+		return
+	}
+	log.WithFields(logrus.Fields{
+		"id": id,
+		"ip": c.ClientIP(),
+	}).Info("Credential deleted")
+	c.JSON(http.StatusOK, gin.H{
+		"id": id,
+	})
+}
@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yunnysunny/docker-image-proxy/internal/config"
+	"github.com/yunnysunny/docker-image-proxy/internal/middleware"
+	"github.com/yunnysunny/docker-image-proxy/internal/service"
+)
+
+// newTestAdminRouter 创建与 cmd/server 相同的 /admin 路由
+func newTestAdminRouter(cfg *config.Config, tokenService *service.TokenService) *gin.Engine {
+	log := newTestLogger()
+	h := NewAdminHandler(log, cfg, tokenService)
+	r := gin.New()
+	admin := r.Group("/admin")
+	admin.Use(middleware.NewAdminMiddleware(log, cfg).AdminRequired())
+	admin.GET("/revocations", h.HandleListRevocations)
+	admin.POST("/revocations", h.HandleRevoke)
+	return r
+}
+
+func adminRequest(r *gin.Engine, method, path, adminToken string, body interface{}) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(body)
+	req := httptest.NewRequest(method, path, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	if adminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminRevocations(t *testing.T) {
+	cfg := newTestConfig(t, nil)
+	cfg.AdminToken = "admin-secret"
+	cfg.RevocationFile = filepath.Join(t.TempDir(), "revocations.json")
+	tokenService := service.NewTokenService(newTestLogger(), cfg)
+	r := newTestAdminRouter(cfg, tokenService)
+	issue := func(subject string) string {
+		token, err := tokenService.GetDockerRegistryToken(subject, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token.Token
+	}
+	alice, bob := issue("alice"), issue("bob")
+
+	tests := []struct {
+		name       string
+		adminToken string
+		body       interface{}
+		status     int
+	}{
+		{"missing admin token", "", RevokeRequest{Token: alice}, http.StatusUnauthorized},
+		{"wrong admin token", "wrong", RevokeRequest{Token: alice}, http.StatusUnauthorized},
+		{"empty request", cfg.AdminToken, RevokeRequest{}, http.StatusBadRequest},
+		{"invalid token", cfg.AdminToken, RevokeRequest{Token: "invalid"}, http.StatusBadRequest},
+		{"revoke token", cfg.AdminToken, RevokeRequest{Token: alice}, http.StatusOK},
+		{"revoke subject", cfg.AdminToken, RevokeRequest{Subject: "bob"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := adminRequest(r, http.MethodPost, "/admin/revocations", tt.adminToken, tt.body); w.Code != tt.status {
+				t.Fatalf("status = %d, body = %s, want %d", w.Code, w.Body.String(), tt.status)
+			}
+		})
+	}
+
+	// 未授权的请求不修改吊销列表，授权的请求写入 REVOCATION_FILE，重新加载后仍然有效
+	reloaded := service.NewTokenService(newTestLogger(), cfg)
+	for _, token := range []string{alice, bob} {
+		if _, err := reloaded.GetToken(token); !errors.Is(err, service.ErrTokenRevoked) {
+			t.Fatalf("GetToken() after reload err = %v, want %v", err, service.ErrTokenRevoked)
+		}
+	}
+	w := adminRequest(newTestAdminRouter(cfg, reloaded), http.MethodGet, "/admin/revocations", cfg.AdminToken, nil)
+	var revocations service.Revocations
+	if err := json.Unmarshal(w.Body.Bytes(), &revocations); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || len(revocations.Tokens) != 1 || revocations.Subjects["bob"] == 0 {
+		t.Fatalf("list after reload: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if w := adminRequest(r, http.MethodGet, "/admin/revocations", "", nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("list without admin token: status = %d, want 401", w.Code)
+	}
+}
+
+func TestAdminDisabledWithoutToken(t *testing.T) {
+	cfg := newTestConfig(t, nil)
+	r := newTestAdminRouter(cfg, service.NewTokenService(newTestLogger(), cfg))
+	if w := adminRequest(r, http.MethodGet, "/admin/revocations", "anything", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want 404", w.Code)
+	}
+}
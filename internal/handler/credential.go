@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yunnysunny/docker-image-proxy/internal/service"
+)
+
+// CreateTokenRequest 创建个人访问令牌的参数
+type CreateTokenRequest struct {
+	Name      string                    `json:"name"`
+	Scopes    []service.CredentialScope `json:"scopes"`
+	ExpiresAt time.Time                 `json:"expiresAt"`
+}
+
+// accountOwner 使用账号密码认证个人访问令牌接口的调用方，返回用户名，失败时已写入响应。
+// 访问令牌接口只接受账号密码，不接受 OIDC ID token 或访问令牌，避免凭据自我延续
+func (h *RegistryHandler) accountOwner(c *gin.Context) (string, bool) {
+	username, password, provided := c.Request.BasicAuth()
+	err := errUnauthorizedAccount
+	if h.accounts.Enabled() && provided && !h.oidc.Accepts(password) && !service.IsCredential(password) {
+		err = h.throttle(c, username, func() bool {
+			return h.accounts.Verify(username, password)
+		})
+	}
+	if err != nil {
+		if errors.Is(err, errUnauthorizedAccount) {
+			c.Header("WWW-Authenticate", `Basic realm="docker-image-proxy"`)
+		}
+		h.writeLoginError(c, err, gin.H{
+			"error": "Unauthorized account",
+		})
+		return "", false
+	}
+	return username, true
+}
+
+// HandleListTokens 返回当前用户的个人访问令牌
+func (h *RegistryHandler) HandleListTokens(c *gin.Context) {
+	owner, ok := h.accountOwner(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, h.tokenService.Credentials().List(owner))
+}
+
+// HandleCreateToken 为当前用户创建个人访问令牌
+func (h *RegistryHandler) HandleCreateToken(c *gin.Context) {
+	owner, ok := h.accountOwner(c)
+	if !ok {
+		return
+	}
+	var req CreateTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid request body",
+		})
+		return
+	}
+	createCredential(c, h.log, h.tokenService.Credentials(), service.CreateCredentialRequest{
+		Kind:      service.CredentialToken,
+		Name:      req.Name,
+		Owner:     owner,
+		Scopes:    req.Scopes,
+		ExpiresAt: req.ExpiresAt,
+	})
+}
+
+// HandleDeleteToken 删除当前用户的个人访问令牌
+func (h *RegistryHandler) HandleDeleteToken(c *gin.Context) {
+	owner, ok := h.accountOwner(c)
+	if !ok {
+		return
+	}
+	deleteCredential(c, h.log, h.tokenService.Credentials(), c.Param("id"), owner)
+}
@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/yunnysunny/docker-image-proxy/internal/service"
+)
+
+// errUnauthorizedAccount 账号密码错误
+var errUnauthorizedAccount = errors.New("unauthorized account")
+
+// identity 客户端认证后的身份
+type identity struct {
+	subject string // 权限策略中的用户，匿名用户为空
+	// federated 为 true 表示身份来自 OIDC ID token、机器人账号、访问令牌或客户端证书：上游鉴权服务不认识该身份，
+	// 凭据也不能转发给上游，只能由当前服务签发 token，且不签发刷新 token
+	federated bool
+	// credential 机器人账号或访问令牌，签发 token 时授予的操作不超过其权限上限
+	credential *service.Credential
+}
+
+// verifyPassword 校验客户端提供的账号密码，provided 表示客户端是否提供了账号密码：
+//   - 密码为 OIDC ID token 时按映射规则确定用户
+//   - 密码为机器人账号或访问令牌的密钥时校验凭据，用户名为 robot$<name> 或访问令牌所属的用户
+//   - 否则校验账号，未配置账号时为匿名用户
+func (h *RegistryHandler) verifyPassword(username, password string, provided bool) (identity, bool) {
+	if provided && h.oidc.Accepts(password) {
+		subject, err := h.oidc.Identify(password)
+		if err != nil {
+			h.log.WithError(err).WithField("username", username).Warn("Invalid oidc id token")
+			return identity{}, false
+		}
+		h.log.WithField("subject", subject).Debug("OIDC id token accepted")
+		return identity{subject: subject, federated: true}, true
+	}
+	if provided && service.IsCredential(password) {
+		credential, ok := h.tokenService.Credentials().Verify(username, password)
+		if !ok {
+			h.log.WithField("username", username).Warn("Invalid credential")
+			return identity{}, false
+		}
+		// 访问令牌的所属用户被删除后令牌随即失效
+		if credential.Kind == service.CredentialToken && h.accounts.Enabled() && !h.accounts.Exists(credential.Owner) {
+			h.log.WithFields(logrus.Fields{
+				"owner": credential.Owner,
+				"id":    credential.ID,
+			}).Warn("Access token owner no longer exists")
+			return identity{}, false
+		}
+		return identity{subject: credential.Subject(), federated: true, credential: credential}, true
+	}
+	if !h.accounts.Enabled() {
+		return identity{}, true
+	}
+	if !provided || !h.accounts.Verify(username, password) {
+		return identity{}, false
+	}
+	return identity{subject: username}, true
+}
+
+// login 校验客户端提供的账号密码并统计失败次数，同 verifyPassword。
+// 连续失败次数过多时不再校验，返回 *service.LoginLockedError；未提供账号密码的请求不是猜测密码，不计入失败次数，
+// 客户端提供了通过校验的证书时使用证书映射的用户
+func (h *RegistryHandler) login(c *gin.Context, username, password string, provided bool) (identity, error) {
+	var id identity
+	verify := func() (ok bool) {
+		id, ok = h.verifyPassword(username, password, provided)
+		return ok
+	}
+	if !provided {
+		if id, ok := h.certIdentity(c); ok {
+			return id, nil
+		}
+		if !verify() {
+			return identity{}, errUnauthorizedAccount
+		}
+		return id, nil
+	}
+	if err := h.throttle(c, username, verify); err != nil {
+		return identity{}, err
+	}
+	return id, nil
+}
+
+// certIdentity 使用 mTLS 客户端证书认证，证书已在 TLS 握手时按 TLS_CLIENT_CA_FILE 校验
+func (h *RegistryHandler) certIdentity(c *gin.Context) (identity, bool) {
+	if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 {
+		return identity{}, false
+	}
+	subject, err := h.certs.Identify(c.Request.TLS.PeerCertificates[0])
+	if err != nil {
+		h.log.WithError(err).Warn("Invalid client certificate")
+		return identity{}, false
+	}
+	h.log.WithField("subject", subject).Debug("Client certificate accepted")
+	return identity{subject: subject, federated: true}, true
+}
+
+// throttle 调用 verify 校验账号密码，用户名或来源 IP 处于退避或锁定中时不调用 verify，
+// 返回 *service.LoginLockedError，校验失败时返回 errUnauthorizedAccount
+func (h *RegistryHandler) throttle(c *gin.Context, username string, verify func() bool) error {
+	ip := c.ClientIP()
+	if err := h.limiter.Check(username, ip); err != nil {
+		h.log.WithError(err).WithFields(logrus.Fields{
+			"username": username,
+			"ip":       ip,
+		}).Warn("Login attempt throttled")
+		return err
+	}
+	if !verify() {
+		h.limiter.Failure(username, ip)
+		return errUnauthorizedAccount
+	}
+	h.limiter.Success(username, ip)
+	return nil
+}
+
+// AuthenticateBasic 校验请求中 Basic 认证的账号密码，供 Basic 认证模式使用，校验规则和失败限制同 /v2/auth，
+// 返回权限策略中的用户和权限上限（机器人账号、访问令牌）；
+// 通过校验的账号密码缓存 BASIC_AUTH_CACHE_TTL，缓存命中时不再校验，也不计入失败限制
+func (h *RegistryHandler) AuthenticateBasic(c *gin.Context) (string, *service.Credential, error) {
+	username, password, provided := c.Request.BasicAuth()
+	if provided {
+		if subject, credential, ok := h.basicCache.Get(username, password); ok {
+			return subject, credential, nil
+		}
+	}
+	id, err := h.login(c, username, password, provided)
+	if err != nil {
+		return "", nil, err
+	}
+	if provided {
+		h.basicCache.Put(username, password, id.subject, id.credential)
+	}
+	return id.subject, id.credential, nil
+}
+
+// writeLoginError 返回认证失败，失败次数过多时返回 429 和 Retry-After，否则返回 401 和 body
+func (h *RegistryHandler) writeLoginError(c *gin.Context, err error, body gin.H) {
+	var locked *service.LoginLockedError
+	if errors.As(err, &locked) {
+		c.Header("Retry-After", locked.RetryAfterHeader())
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error": "Too many failed login attempts",
+		})
+		return
+	}
+	c.JSON(http.StatusUnauthorized, body)
+}
@@ -0,0 +1,159 @@
+package handler
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/yunnysunny/docker-image-proxy/internal/config"
+	"github.com/yunnysunny/docker-image-proxy/internal/service"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestLogger() *logrus.Logger {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	return log
+}
+
+// writeHtpasswd 写入 bcrypt 格式的 htpasswd 文件，accounts 为用户名到密码的映射
+func writeHtpasswd(t *testing.T, file string, accounts map[string]string) {
+	t.Helper()
+	data := ""
+	for username, password := range accounts {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data += username + ":" + string(hash) + "\n"
+	}
+	if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestConfig 创建使用临时目录中 htpasswd 和凭据文件的配置
+func newTestConfig(t *testing.T, accounts map[string]string) *config.Config {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := &config.Config{
+		UpstreamRegistry:   "http://127.0.0.1:1",
+		SelfAuthService:    "docker-image-proxy",
+		ServerSecret:       "secret",
+		TokenTTL:           time.Hour,
+		RefreshTokenTTL:    time.Hour,
+		HtpasswdFile:       filepath.Join(dir, "htpasswd"),
+		CredentialsFile:    filepath.Join(dir, "credentials.json"),
+		LoginMaxFailures:   5,
+		LoginIPMaxFailures: 20,
+		LoginBackoff:       time.Second,
+		LoginLockout:       time.Minute,
+	}
+	writeHtpasswd(t, cfg.HtpasswdFile, accounts)
+	return cfg
+}
+
+func newTestRegistryHandler(cfg *config.Config) *RegistryHandler {
+	log := newTestLogger()
+	return NewRegistryHandler(log, cfg, service.NewRegistryService(log, cfg), service.NewTokenService(log, cfg))
+}
+
+func TestVerifyPasswordRejectsTokensOfDeletedOwners(t *testing.T) {
+	cfg := newTestConfig(t, map[string]string{"alice": "alice-password", "bob": "bob-password"})
+	h := newTestRegistryHandler(cfg)
+	_, secret, err := h.tokenService.Credentials().Create(service.CreateCredentialRequest{
+		Kind:      service.CredentialToken,
+		Name:      "laptop",
+		Owner:     "alice",
+		Scopes:    []service.CredentialScope{{Repositories: []string{"myorg/**"}, Actions: []string{service.ActionPull}}},
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, ok := h.verifyPassword("alice", secret, true); !ok || id.subject != "alice" || id.credential == nil {
+		t.Fatalf("verifyPassword() = %+v, %v, want alice with credential", id, ok)
+	}
+
+	writeHtpasswd(t, cfg.HtpasswdFile, map[string]string{"bob": "bob-password"})
+	if _, ok := h.verifyPassword("alice", secret, true); ok {
+		t.Fatal("access token of a deleted owner accepted")
+	}
+}
+
+func TestAuthenticateBasicConcurrentRequests(t *testing.T) {
+	cfg := newTestConfig(t, map[string]string{"alice": "alice-password"})
+	cfg.AuthMode = config.AuthModeBasic
+	cfg.BasicAuthCacheTTL = time.Minute
+	h := newTestRegistryHandler(cfg)
+
+	authenticate := func(password string) error {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/v2/library/nginx/blobs/sha256:0", nil)
+		c.Request.SetBasicAuth("alice", password)
+		subject, _, err := h.AuthenticateBasic(c)
+		if err == nil && subject != "alice" {
+			t.Errorf("subject = %q, want alice", subject)
+		}
+		return err
+	}
+	// 并行拉取镜像层的请求超过失败阈值也不会被限制
+	var wg sync.WaitGroup
+	for i := 0; i < 3*cfg.LoginIPMaxFailures; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := authenticate("alice-password"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := authenticate("wrong"); !errors.Is(err, errUnauthorizedAccount) {
+		t.Fatalf("wrong password: err = %v", err)
+	}
+}
+
+func TestCertIdentity(t *testing.T) {
+	cfg := newTestConfig(t, map[string]string{"alice": "alice-password"})
+	cfg.TLSClientSubject = "agent:{cn}"
+	h := newTestRegistryHandler(cfg)
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "build-1"}}
+
+	tests := []struct {
+		name    string
+		state   *tls.ConnectionState
+		subject string
+		ok      bool
+	}{
+		{"plain http", nil, "", false},
+		{"no client certificate", &tls.ConnectionState{}, "", false},
+		// 未通过 TLS_CLIENT_CA_FILE 校验的证书没有 VerifiedChains
+		{"unverified certificate", &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}, "", false},
+		{"verified certificate", &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{cert},
+			VerifiedChains:   [][]*x509.Certificate{{cert}},
+		}, "agent:build-1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", "/v2/auth", nil)
+			c.Request.TLS = tt.state
+			id, ok := h.certIdentity(c)
+			if ok != tt.ok || id.subject != tt.subject || (ok && !id.federated) {
+				t.Fatalf("certIdentity() = %+v, %v, want %q, %v", id, ok, tt.subject, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package handler
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yunnysunny/docker-image-proxy/internal/distribution"
+	"github.com/yunnysunny/docker-image-proxy/internal/service"
+)
+
+// errRefreshTokenUnsupported 上游有认证服务时无法使用当前服务的刷新 token 换取上游 token
+var errRefreshTokenUnsupported = errors.New("refresh token is only supported for tokens issued by this service")
+
+// selfIssued 判断是否由当前服务签发 token：客户端请求当前服务的鉴权服务，
+// 或按鉴权范围选择的上游没有认证服务、由代理持有上游凭据
+func (h *RegistryHandler) selfIssued(serviceName string, scopes []service.Scope, ns string) bool {
+	if serviceName == h.config.SelfAuthService {
+		return true
+	}
+	upstream := h.service.ScopeUpstream(scopes, ns)
+	return upstream.NoAuth || upstream.ProxyAuth()
+}
+
+// issueToken 签发当前服务的 token，或使用客户端的认证头向上游鉴权服务换取 token，认证头为空时匿名换取，
+// offline 为 true 时当前服务签发的 token 附带刷新 token
+func (h *RegistryHandler) issueToken(
+	authHeader string, id identity, serviceName string, scopes []service.Scope, ns string, offline bool,
+) (*service.TokenResponse, error) {
+	var notAfter time.Time
+	if id.credential != nil {
+		scopes = id.credential.Limit(scopes)
+		notAfter = id.credential.ExpiresAt
+	}
+	if id.federated || h.selfIssued(serviceName, scopes, ns) {
+		token, err := h.tokenService.GetDockerRegistryTokenUntil(id.subject, scopes, notAfter)
+		if err != nil || !offline || id.federated {
+			return token, err
+		}
+		if token.RefreshToken, err = h.tokenService.GetRefreshToken(id.subject); err != nil {
+			return nil, err
+		}
+		return token, nil
+	}
+	// 源站有认证服务，只向上游申请权限策略允许的操作
+	granted := []service.Scope{}
+	for _, scope := range h.tokenService.GrantScopes(id.subject, scopes) {
+		if len(scope.Actions) > 0 {
+			granted = append(granted, scope)
+		}
+	}
+	token, err := h.service.Authenticate(authHeader, granted, serviceName, ns)
+	if err != nil || id.subject == "" {
+		return token, err
+	}
+	// 上游 token 不包含当前服务的用户，包装后校验时按该用户检查权限策略，否则只能按匿名用户检查
+	return h.tokenService.WrapUpstreamToken(id.subject, granted, token)
+}
+
+// writeTokenError 返回认证失败，上游鉴权服务的错误透传状态码，例如 401、429
+func (h *RegistryHandler) writeTokenError(c *gin.Context, err error) {
+	h.log.WithError(err).Error("Authentication failed")
+	var upstreamErr *service.UpstreamError
+	if errors.As(err, &upstreamErr) {
+		h.writeError(c, err, distribution.ErrorCodeUnauthorized, "Authentication failed")
+		return
+	}
+	c.JSON(http.StatusUnauthorized, gin.H{
+		"error": "Authentication failed",
+	})
+}
+
+// HandleOAuthToken 处理 OAuth2 方式的认证请求（POST /v2/auth），支持两种授权方式：
+//   - password：使用表单中的 username、password 认证，access_type 为 offline 时返回刷新 token
+//   - refresh_token：使用当前服务签发的刷新 token 换取访问 token
+//
+// scope 为以空格分隔的鉴权范围，错误按 OAuth2 规范返回 error 字段
+func (h *RegistryHandler) HandleOAuthToken(c *gin.Context) {
+	serviceName := c.PostForm("service")
+	ns := c.Query("ns")
+	scopes, err := service.ParseScopes(c.PostFormArray("scope"))
+	if err != nil {
+		h.log.WithError(err).Warn("Invalid scope")
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "invalid_scope",
+		})
+		return
+	}
+	scopes = h.service.CanonicalScopes(scopes, ns)
+
+	var token *service.TokenResponse
+	switch c.PostForm("grant_type") {
+	case "password":
+		username, password := c.PostForm("username"), c.PostForm("password")
+		// 权限策略中的用户，未配置账号时为匿名用户
+		id, loginErr := h.login(c, username, password, true)
+		if loginErr != nil {
+			h.writeLoginError(c, loginErr, gin.H{
+				"error": "invalid_grant",
+			})
+			return
+		}
+		authHeader := "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+		offline := c.PostForm("access_type") == "offline"
+		token, err = h.issueToken(authHeader, id, serviceName, scopes, ns, offline)
+	case "refresh_token":
+		refreshToken := c.PostForm("refresh_token")
+		claims, verifyErr := h.tokenService.GetRefreshTokenClaims(refreshToken)
+		if verifyErr != nil {
+			h.log.WithError(verifyErr).Warn("Invalid refresh token")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": "invalid_grant",
+			})
+			return
+		}
+		if !h.selfIssued(serviceName, scopes, ns) {
+			h.log.WithError(errRefreshTokenUnsupported).WithField("service", serviceName).Warn("Invalid refresh token")
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "unsupported_grant_type",
+			})
+			return
+		}
+		// 刷新 token 只签发给账号用户，账号删除后不能再换取 token
+		if !h.accounts.Exists(claims.Sub) {
+			h.log.WithField("subject", claims.Sub).Warn("Refresh token subject no longer exists")
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": "invalid_grant",
+			})
+			return
+		}
+		token, err = h.tokenService.GetDockerRegistryToken(claims.Sub, scopes)
+		if err == nil {
+			token.RefreshToken = refreshToken
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "unsupported_grant_type",
+		})
+		return
+	}
+	if err != nil {
+		h.writeTokenError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, token)
+}
@@ -0,0 +1,188 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yunnysunny/docker-image-proxy/internal/service"
+)
+
+// postToken 以表单方式请求 POST /v2/auth，返回状态码和响应内容
+func postToken(t *testing.T, h *RegistryHandler, form url.Values) (int, map[string]interface{}) {
+	t.Helper()
+	r := gin.New()
+	r.POST("/v2/auth", h.HandleOAuthToken)
+	req := httptest.NewRequest(http.MethodPost, "/v2/auth", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	body := map[string]interface{}{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("body = %q: %v", w.Body.String(), err)
+	}
+	return w.Code, body
+}
+
+func TestHandleOAuthToken(t *testing.T) {
+	cfg := newTestConfig(t, map[string]string{"alice": "alice-password", "bob": "bob-password"})
+	h := newTestRegistryHandler(cfg)
+	password := func(username, password, accessType string) url.Values {
+		return url.Values{
+			"grant_type":  {"password"},
+			"service":     {cfg.SelfAuthService},
+			"client_id":   {"docker"},
+			"username":    {username},
+			"password":    {password},
+			"access_type": {accessType},
+			"scope":       {"repository:library/nginx:pull"},
+		}
+	}
+	refresh := func(refreshToken string) url.Values {
+		return url.Values{
+			"grant_type":    {"refresh_token"},
+			"service":       {cfg.SelfAuthService},
+			"refresh_token": {refreshToken},
+			"scope":         {"repository:library/nginx:pull"},
+		}
+	}
+
+	status, body := postToken(t, h, password("alice", "alice-password", "offline"))
+	if status != http.StatusOK {
+		t.Fatalf("password grant: status = %d, body = %v", status, body)
+	}
+	if body["expires_in"] != float64(cfg.TokenTTL.Seconds()) || body["issued_at"] == "" {
+		t.Fatalf("password grant: body = %v, want expires_in and issued_at", body)
+	}
+	accessToken, _ := body["access_token"].(string)
+	refreshToken, _ := body["refresh_token"].(string)
+	if refreshToken == "" {
+		t.Fatal("offline password grant did not return a refresh token")
+	}
+	claims, err := h.tokenService.GetToken(accessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Sub != "alice" || claims.Iss != cfg.SelfAuthService || len(claims.Aud) != 1 || claims.Aud[0] != cfg.SelfAuthService {
+		t.Fatalf("claims = %+v, want sub alice and aud/iss %s", claims, cfg.SelfAuthService)
+	}
+	// 访问 token 和刷新 token 不能互换使用
+	if _, err := h.tokenService.GetToken(refreshToken); err == nil {
+		t.Fatal("refresh token accepted as an access token")
+	}
+	if status, _ := postToken(t, h, refresh(accessToken)); status != http.StatusUnauthorized {
+		t.Fatalf("access token as refresh token: status = %d, want 401", status)
+	}
+
+	status, body = postToken(t, h, refresh(refreshToken))
+	if status != http.StatusOK || body["refresh_token"] != refreshToken {
+		t.Fatalf("refresh grant: status = %d, body = %v", status, body)
+	}
+	claims, err = h.tokenService.GetToken(body["access_token"].(string))
+	if err != nil || claims.Sub != "alice" || len(claims.Access) != 1 {
+		t.Fatalf("refreshed token claims = %+v, %v", claims, err)
+	}
+
+	tests := []struct {
+		name   string
+		form   url.Values
+		status int
+		error  string
+	}{
+		{"online password grant", password("bob", "bob-password", ""), http.StatusOK, ""},
+		{"wrong password", password("alice", "wrong", "offline"), http.StatusUnauthorized, "invalid_grant"},
+		{"invalid refresh token", refresh("invalid"), http.StatusUnauthorized, "invalid_grant"},
+		{"unsupported grant", url.Values{"grant_type": {"client_credentials"}}, http.StatusBadRequest, "unsupported_grant_type"},
+		{"invalid scope", url.Values{"grant_type": {"password"}, "scope": {"repository:*:pull"}}, http.StatusBadRequest, "invalid_scope"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := postToken(t, h, tt.form)
+			if status != tt.status || (tt.error != "" && body["error"] != tt.error) {
+				t.Fatalf("status = %d, body = %v, want %d %s", status, body, tt.status, tt.error)
+			}
+			if tt.error == "" && body["refresh_token"] != nil {
+				t.Fatal("refresh token returned without access_type=offline")
+			}
+		})
+	}
+
+	// 账号删除后刷新 token 失效
+	writeHtpasswd(t, cfg.HtpasswdFile, map[string]string{"bob": "bob-password"})
+	if status, _ := postToken(t, h, refresh(refreshToken)); status != http.StatusUnauthorized {
+		t.Fatalf("refresh token of a deleted user: status = %d, want 401", status)
+	}
+}
+
+func TestGetTokenChecksAudience(t *testing.T) {
+	cfg := newTestConfig(t, nil)
+	other := *cfg
+	other.SelfAuthService = "other-registry"
+	log := newTestLogger()
+	token, err := service.NewTokenService(log, &other).GetDockerRegistryToken("alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 使用相同密钥签名，但 aud 和 iss 是其他服务
+	if _, err := service.NewTokenService(log, cfg).GetToken(token.Token); err == nil {
+		t.Fatal("token issued for another service accepted")
+	}
+}
+
+func TestHandleAuthWrapsUpstreamTokensOfNamedUsers(t *testing.T) {
+	var upstream *httptest.Server
+	upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/":
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+upstream.URL+`/token",service="registry.test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		case "/token":
+			w.Write([]byte(`{"token": "upstream-token", "expires_in": 300}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer upstream.Close()
+
+	cfg := newTestConfig(t, map[string]string{"alice": "alice-password"})
+	cfg.UpstreamRegistry = upstream.URL
+	cfg.PolicyFile = filepath.Join(t.TempDir(), "policy.json")
+	policy := `{"defaultDeny": true, "rules": [{"subjects": ["alice"], "repositories": ["myorg/app"], "actions": ["pull"]}]}`
+	if err := os.WriteFile(cfg.PolicyFile, []byte(policy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	h := newTestRegistryHandler(cfg)
+	r := gin.New()
+	r.GET("/v2/auth", h.HandleAuth)
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/auth?service=registry.test&scope=repository:myorg/app:pull", nil)
+	req.SetBasicAuth("alice", "alice-password")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var token service.TokenResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &token); err != nil {
+		t.Fatal(err)
+	}
+	// 上游 token 包装为当前服务的 token，校验时按 alice 检查权限策略
+	claims, err := h.tokenService.GetToken(token.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Sub != "alice" || claims.Upstream != "upstream-token" || !claims.Allows("repository", "myorg/app", "pull") {
+		t.Fatalf("claims = %+v, want alice's pull access wrapping the upstream token", claims)
+	}
+	if token.ExpiresIn != 300 {
+		t.Fatalf("expires_in = %d, want the upstream token lifetime 300", token.ExpiresIn)
+	}
+
+}
@@ -1,31 +1,49 @@
 package handler
 
 import (
-	"encoding/base64"
+	"errors"
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 	"github.com/yunnysunny/docker-image-proxy/internal/config"
+	"github.com/yunnysunny/docker-image-proxy/internal/distribution"
+	"github.com/yunnysunny/docker-image-proxy/internal/middleware"
 	"github.com/yunnysunny/docker-image-proxy/internal/service"
 )
 
 type RegistryHandler struct {
-	log     *logrus.Logger
-	config  *config.Config
-	service *service.RegistryService
+	log          *logrus.Logger
+	config       *config.Config
+	service      *service.RegistryService
 	tokenService *service.TokenService
+	accounts     service.AccountStore
+	oidc         *service.OIDCProvider
+	limiter      *service.LoginLimiter
+	certs        *service.ClientCertMapper
+	basicCache   *service.BasicAuthCache
 }
 
-func NewRegistryHandler(log *logrus.Logger, config *config.Config) *RegistryHandler {
+func NewRegistryHandler(
+	log *logrus.Logger,
+	config *config.Config,
+	registryService *service.RegistryService,
+	tokenService *service.TokenService,
+) *RegistryHandler {
 	return &RegistryHandler{
-		log:     log,
-		config:  config,
-		service: service.NewRegistryService(log, config),
-		tokenService: service.NewTokenService(log, config),
+		log:          log,
+		config:       config,
+		service:      registryService,
+		tokenService: tokenService,
+		accounts:     service.NewAccountStore(log, config),
+		oidc:         service.NewOIDCProvider(log, config),
+		limiter:      service.NewLoginLimiter(log, config),
+		certs:        service.NewClientCertMapper(log, config),
+		basicCache:   service.NewBasicAuthCache(log, config),
 	}
 }
 
@@ -34,9 +52,7 @@ func (h *RegistryHandler) HandleCatalog(c *gin.Context) {
 	repositories, err := h.service.GetCatalog(c)
 	if err != nil {
 		h.log.WithError(err).Error("Failed to get catalog")
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to get catalog",
-		})
+		h.writeError(c, err, distribution.ErrorCodeUnsupported, "Failed to get catalog")
 		return
 	}
 
@@ -51,9 +67,7 @@ func (h *RegistryHandler) HandleTags(c *gin.Context) {
 	tags, err := h.service.GetTags(name, c)
 	if err != nil {
 		h.log.WithError(err).WithField("name", name).Error("Failed to get tags")
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to get tags",
-		})
+		h.writeError(c, err, distribution.ErrorCodeNameUnknown, "Failed to get tags")
 		return
 	}
 
@@ -63,6 +77,57 @@ func (h *RegistryHandler) HandleTags(c *gin.Context) {
 	})
 }
 
+// authRealm 当前服务的鉴权地址，请求带有 containerd 镜像加速的 ns 参数时一并带上，
+// 以便鉴权请求选择同一个上游
+func (h *RegistryHandler) authRealm(c *gin.Context) (string, error) {
+	proxyURL, err := url.Parse(h.config.SelfRegistry)
+	if err != nil {
+		return "", err
+	}
+	proxyURL.Path = "/v2/auth"
+	if ns := c.Query("ns"); ns != "" {
+		proxyURL.RawQuery = url.Values{"ns": {ns}}.Encode()
+	}
+	return proxyURL.String(), nil
+}
+
+// writeError 以 Distribution 规范的格式返回错误
+//
+// 上游返回的错误保留状态码，响应体符合规范时原样返回，否则根据状态码生成错误信息，
+// notFound 为上游返回 404 时使用的错误码；同时透传 Retry-After 和 WWW-Authenticate 响应头，
+// 其中 WWW-Authenticate 的 realm 改写为当前服务的鉴权地址。
+func (h *RegistryHandler) writeError(c *gin.Context, err error, notFound distribution.ErrorCode, message string) {
+	if errors.Is(err, service.ErrUpstreamNotFound) {
+		distribution.AbortWithError(c, http.StatusNotFound, distribution.NewError(distribution.ErrorCodeNameUnknown, nil))
+		return
+	}
+	var upstreamErr *service.UpstreamError
+	if !errors.As(err, &upstreamErr) {
+		distribution.AbortWithError(c, http.StatusInternalServerError, distribution.Error{
+			Code:    distribution.ErrorCodeUnknown,
+			Message: message,
+		})
+		return
+	}
+
+	if retryAfter := upstreamErr.Header.Get("Retry-After"); retryAfter != "" {
+		c.Header("Retry-After", retryAfter)
+	}
+	if authenticate := upstreamErr.Header.Get("WWW-Authenticate"); authenticate != "" {
+		if realm, err := h.authRealm(c); err == nil && !h.config.SkipAuthProxy {
+			authenticate = h.service.RewriteAuthenticateHeader(authenticate, realm, c.Param("name"))
+		}
+		c.Header("WWW-Authenticate", authenticate)
+	}
+	if c.Request.Method != http.MethodHead && distribution.IsErrorsBody(upstreamErr.Body) {
+		c.Data(upstreamErr.StatusCode, "application/json; charset=utf-8", upstreamErr.Body)
+		c.Abort()
+		return
+	}
+	code := distribution.CodeForStatus(upstreamErr.StatusCode, notFound)
+	distribution.AbortWithError(c, upstreamErr.StatusCode, distribution.NewError(code, nil))
+}
+
 // HandleManifest 处理镜像manifest请求
 func (h *RegistryHandler) HandleManifest(c *gin.Context) {
 	name := c.Param("name")
@@ -74,59 +139,136 @@ func (h *RegistryHandler) HandleManifest(c *gin.Context) {
 			"name":      name,
 			"reference": reference,
 		}).Error("Failed to get manifest")
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to get manifest",
-		})
+		h.writeError(c, err, distribution.ErrorCodeManifestUnknown, "Failed to get manifest")
+		return
+	}
+
+	// 设置响应头，媒体类型和摘要与上游保持一致
+	c.Header("Docker-Content-Digest", manifest.Digest)
+	c.Header("Content-Length", strconv.Itoa(len(manifest.Data)))
+	c.Data(http.StatusOK, manifest.ContentType, manifest.Data)
+}
+
+// HandleManifestHead 处理镜像manifest的HEAD请求，只返回摘要、大小和媒体类型
+func (h *RegistryHandler) HandleManifestHead(c *gin.Context) {
+	name := c.Param("name")
+	reference := c.Param("reference")
+
+	descriptor, err := h.service.HeadManifest(name, reference, c)
+	if err != nil {
+		h.log.WithError(err).WithFields(logrus.Fields{
+			"name":      name,
+			"reference": reference,
+		}).Error("Failed to head manifest")
+		h.writeError(c, err, distribution.ErrorCodeManifestUnknown, "Failed to head manifest")
 		return
 	}
 
-	// 设置响应头
-	c.Header("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
-	c.Data(http.StatusOK, "application/vnd.docker.distribution.manifest.v2+json", manifest)
+	setDescriptorHeaders(c, descriptor)
+	c.Status(http.StatusOK)
 }
 
 // HandleBlob 处理镜像层请求
 func (h *RegistryHandler) HandleBlob(c *gin.Context) {
 	name := c.Param("name")
 	digest := c.Param("digest")
+	if !checkBlobDigest(c, digest) {
+		return
+	}
 
-	blob, err := h.service.GetBlob(name, digest, c)
+	blob, size, err := h.service.GetBlob(name, digest, c)
 	if err != nil {
 		h.log.WithError(err).WithFields(logrus.Fields{
 			"name":   name,
 			"digest": digest,
 		}).Error("Failed to get blob")
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to get blob",
-		})
+		h.writeError(c, err, distribution.ErrorCodeBlobUnknown, "Failed to get blob")
 		return
 	}
 	defer blob.Close()
 
+	setDescriptorHeaders(c, &service.Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    digest,
+		Size:      size,
+	})
+	c.Status(http.StatusOK)
 	// 流式传输blob数据
 	io.Copy(c.Writer, blob)
 }
 
+// HandleBlobHead 处理镜像层的HEAD请求，只返回摘要和大小
+func (h *RegistryHandler) HandleBlobHead(c *gin.Context) {
+	name := c.Param("name")
+	digest := c.Param("digest")
+	if !checkBlobDigest(c, digest) {
+		return
+	}
+
+	descriptor, err := h.service.HeadBlob(name, digest, c)
+	if err != nil {
+		h.log.WithError(err).WithFields(logrus.Fields{
+			"name":   name,
+			"digest": digest,
+		}).Error("Failed to head blob")
+		h.writeError(c, err, distribution.ErrorCodeBlobUnknown, "Failed to head blob")
+		return
+	}
+
+	setDescriptorHeaders(c, descriptor)
+	c.Status(http.StatusOK)
+}
+
+// checkBlobDigest 检查镜像层摘要的算法是否受支持，不支持时返回 400 和 DIGEST_INVALID
+func checkBlobDigest(c *gin.Context, digest string) bool {
+	if service.SupportedDigest(digest) {
+		return true
+	}
+	distribution.AbortWithError(c, http.StatusBadRequest, distribution.NewError(distribution.ErrorCodeDigestInvalid, gin.H{
+		"digest": digest,
+	}))
+	return false
+}
+
+// setDescriptorHeaders 设置内容描述相关的响应头
+func setDescriptorHeaders(c *gin.Context, descriptor *service.Descriptor) {
+	if descriptor.MediaType != "" {
+		c.Header("Content-Type", descriptor.MediaType)
+	}
+	if descriptor.Digest != "" {
+		c.Header("Docker-Content-Digest", descriptor.Digest)
+	}
+	if descriptor.Size >= 0 {
+		c.Header("Content-Length", strconv.FormatInt(descriptor.Size, 10))
+	}
+}
+
 func (h *RegistryHandler) HandleLogin(c *gin.Context) {
 	username := c.PostForm("username")
 	password := c.PostForm("password")
-	base64Auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
-	if len(h.config.Accounts) > 0 {// 如果配置了账号，则需要验证账号是否在配置中
-		accountAllowed := false
-		for _, acc := range h.config.Accounts {
-			if acc == base64Auth {
-				accountAllowed = true
-				break
-			}
-		}
-		if !accountAllowed {
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"error": "Unauthorized account",
+	// 如果配置了账号，则需要验证账号密码
+	id, err := h.login(c, username, password, true)
+	if err != nil {
+		h.writeLoginError(c, err, gin.H{
+			"error": "Unauthorized account",
+		})
+		return
+	}
+	if id.federated { // 访问令牌、OIDC 等凭据不能用于登录上游，由当前服务签发不含权限的 token
+		token, err := h.tokenService.GetDockerRegistryToken(id.subject, nil)
+		if err != nil {
+			h.log.WithError(err).Error("Failed to get docker registry token")
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": "Failed to get docker registry token",
 			})
 			return
 		}
+		c.JSON(http.StatusOK, gin.H{
+			"token": token.Token,
+		})
+		return
 	}
-	if h.config.UpstreamNoAuth {
+	if h.service.Upstreams().Default().NoAuth {
 		c.JSON(http.StatusOK, gin.H{
 			"token": "test",
 		})
@@ -135,47 +277,49 @@ func (h *RegistryHandler) HandleLogin(c *gin.Context) {
 	token, err := h.service.LoginUpstream(username, password)
 	if err != nil {
 		h.log.WithError(err).Error("Failed to get docker registry token")
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to get docker registry token",
-		})
+		h.writeError(c, err, distribution.ErrorCodeUnauthorized, "Failed to get docker registry token")
+		return
 	}
 	c.JSON(http.StatusOK, gin.H{
 		"token": token,
 	})
 }
 
+// HandleJWKS 返回校验当前服务 token 的公钥集合
+func (h *RegistryHandler) HandleJWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, h.tokenService.JWKS())
+}
 
 // HandleAuthChallenge 处理认证挑战请求
 func (h *RegistryHandler) HandleAuthChallenge(c *gin.Context) {
+	if h.config.AuthMode == config.AuthModeBasic {
+		h.handleBasicChallenge(c)
+		return
+	}
 	// 获取上游认证挑战信息
-	resp, err := h.service.GetAuthChallenge()
+	resp, err := h.service.GetAuthChallenge(c.Query("ns"))
 	if err != nil {
 		h.log.WithError(err).Error("Failed to get auth challenge")
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to get auth challenge",
-		})
+		h.writeError(c, err, distribution.ErrorCodeUnknown, "Failed to get auth challenge")
 		return
 	}
 	defer resp.Body.Close()
-	if h.config.SkipAuthProxy {// 不做改写
+	if h.config.SkipAuthProxy { // 不做改写
 		io.Copy(c.Writer, resp.Body)
 		return
 	}
 
 	// 修改认证挑战信息
-	selfRegistry := h.config.SelfRegistry
-	proxyURL, err := url.Parse(selfRegistry)
+	proxyURL, err := h.authRealm(c)
 	if err != nil {
 		io.Copy(c.Writer, resp.Body)
 		return
 	}
-	proxyURL.Path = "/v2/auth"
-	modifiedResp, err := h.service.ModifyAuthChallenge(resp, proxyURL.String())
+	modifiedResp, err := h.service.ModifyAuthChallenge(resp, proxyURL)
 	if err != nil {
 		h.log.WithError(err).Error("Failed to modify auth challenge")
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to modify auth challenge",
-		})
+		h.writeError(c, err, distribution.ErrorCodeUnknown, "Failed to modify auth challenge")
 		return
 	}
 
@@ -193,60 +337,58 @@ func (h *RegistryHandler) HandleAuthChallenge(c *gin.Context) {
 	}
 }
 
+// handleBasicChallenge Basic 认证模式下 /v2/ 不访问上游，直接校验账号密码，
+// 未通过时返回 Basic 认证挑战，docker login 据此校验账号密码
+func (h *RegistryHandler) handleBasicChallenge(c *gin.Context) {
+	if _, _, err := h.AuthenticateBasic(c); err != nil {
+		h.log.WithError(err).Warn("Basic authentication failed")
+		middleware.AbortBasicAuth(c, h.config.SelfAuthService, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{})
+}
+
 // HandleAuth 处理认证请求
 func (h *RegistryHandler) HandleAuth(c *gin.Context) {
-	// 获取认证头, 格式：Authorization: Bearer <token>
+	// 获取认证头, 格式：Authorization: Basic <credentials>，未配置账号时允许匿名请求
 	authHeader := c.GetHeader("Authorization")
-	if authHeader == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{
-			"error": "Authorization header is required",
-		})
-		return
-	}
 	authToken := strings.SplitN(authHeader, " ", 2)
-	if len(authToken) != 2 {
+	if authHeader != "" && len(authToken) != 2 {
 		c.JSON(http.StatusUnauthorized, gin.H{
 			"error": "Invalid authorization header format",
 		})
 		return
 	}
 
-	if len(h.config.Accounts) > 0 {// 如果配置了账号，则需要验证账号是否在配置中
-		accountAllowed := false
-		for _, acc := range h.config.Accounts {
-			if acc == authToken[1] {
-				accountAllowed = true
-				break
-			}
-		}
-		if !accountAllowed {
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"error": "Unauthorized account",
-			})
-			return
-		}
+	// 权限策略中的用户，未配置账号时为匿名用户
+	username, password, provided := c.Request.BasicAuth()
+	id, err := h.login(c, username, password, provided)
+	if err != nil {
+		h.writeLoginError(c, err, gin.H{
+			"error": "Unauthorized account",
+		})
+		return
 	}
 	// 处理认证
 	serviceName := c.Query("service")
-	scope := c.Query("scope")
-	var token string
-	var err error
-	if serviceName == h.config.SelfAuthService {// 源站没有认证服务
-		token, err = h.tokenService.GetDockerRegistryToken(scope)
-	} else {// 源站有认证服务
-		token, err = h.service.Authenticate(authHeader, scope, serviceName)
-	}
-
+	// 客户端可以传递零个或多个 scope 参数
+	scopes, err := service.ParseScopes(c.QueryArray("scope"))
 	if err != nil {
-		h.log.WithError(err).Error("Authentication failed")
-		c.JSON(http.StatusUnauthorized, gin.H{
-			"error": "Authentication failed",
+		h.log.WithError(err).Warn("Invalid scope")
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Invalid scope",
 		})
 		return
 	}
+	scopes = h.service.CanonicalScopes(scopes, c.Query("ns"))
+	// 客户端请求 offline_token 时同时返回刷新 token，docker login 会保存该 token 用于之后的认证
+	offline := c.Query("offline_token") == "true"
+	token, err := h.issueToken(authHeader, id, serviceName, scopes, c.Query("ns"), offline)
+	if err != nil {
+		h.writeTokenError(c, err)
+		return
+	}
 
 	// 返回token
-	c.JSON(http.StatusOK, gin.H{
-		"token": token,
-	})
+	c.JSON(http.StatusOK, token)
 }
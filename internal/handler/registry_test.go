@@ -0,0 +1,290 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yunnysunny/docker-image-proxy/internal/config"
+	"github.com/yunnysunny/docker-image-proxy/internal/distribution"
+	"github.com/yunnysunny/docker-image-proxy/internal/service"
+)
+
+func digestOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+var (
+	testManifest = []byte(`{"schemaVersion":2,"mediaType":"` + distribution.MediaTypeDockerManifest + `"}`)
+	testBlob     = []byte("layer")
+)
+
+// fakeUpstream 上游仓库，library/nginx 中有一个 manifest 和一个镜像层，统计 GET 请求次数
+type fakeUpstream struct {
+	*httptest.Server
+	gets atomic.Int32
+}
+
+func newFakeUpstream(t *testing.T, handler http.HandlerFunc) *fakeUpstream {
+	t.Helper()
+	upstream := &fakeUpstream{}
+	upstream.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			upstream.gets.Add(1)
+		}
+		var data []byte
+		switch r.URL.Path {
+		case "/v2/library/nginx/manifests/latest":
+			data = testManifest
+			w.Header().Set("Content-Type", distribution.MediaTypeDockerManifest)
+		case "/v2/library/nginx/blobs/" + digestOf(testBlob):
+			data = testBlob
+		default:
+			if handler != nil {
+				handler(w, r)
+				return
+			}
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", digestOf(data))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+// newTestRouter 创建不经过认证中间件的 /v2/<name>/... 路由
+func newTestRouter(h *RegistryHandler) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	router := NewDistributionRouter(h)
+	r.NoRoute(router.Parse(), router.Dispatch())
+	return r
+}
+
+func serve(r *gin.Engine, method, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+	return w
+}
+
+func newUpstreamTestConfig(upstream string) *config.Config {
+	return &config.Config{
+		UpstreamRegistry: upstream,
+		SelfRegistry:     "https://proxy.example.com",
+		SelfAuthService:  "docker-image-proxy",
+		ServerSecret:     "secret",
+	}
+}
+
+func TestHeadRequests(t *testing.T) {
+	upstream := newFakeUpstream(t, nil)
+	r := newTestRouter(newTestRegistryHandler(newUpstreamTestConfig(upstream.URL)))
+
+	tests := []struct {
+		path        string
+		contentType string
+		digest      string
+		length      int
+	}{
+		{"/v2/library/nginx/manifests/latest", distribution.MediaTypeDockerManifest, digestOf(testManifest), len(testManifest)},
+		{"/v2/library/nginx/blobs/" + digestOf(testBlob), "application/octet-stream", digestOf(testBlob), len(testBlob)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := serve(r, http.MethodHead, tt.path)
+			if w.Code != http.StatusOK || w.Body.Len() != 0 {
+				t.Fatalf("HEAD status=%d body=%q", w.Code, w.Body.String())
+			}
+			if w.Header().Get("Docker-Content-Digest") != tt.digest ||
+				w.Header().Get("Content-Length") != strconv.Itoa(tt.length) ||
+				(tt.contentType != "" && w.Header().Get("Content-Type") != tt.contentType) {
+				t.Fatalf("HEAD headers = %v", w.Header())
+			}
+		})
+	}
+	// HEAD 请求不下载内容
+	if gets := upstream.gets.Load(); gets != 0 {
+		t.Fatalf("upstream GETs = %d, want 0", gets)
+	}
+
+	if w := serve(r, http.MethodHead, "/v2/library/nginx/manifests/missing"); w.Code != http.StatusNotFound {
+		t.Fatalf("HEAD missing manifest: status=%d", w.Code)
+	}
+}
+
+func TestUpstreamErrors(t *testing.T) {
+	upstream := newFakeUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/private/app/manifests/latest":
+			w.Header().Set("WWW-Authenticate", `Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:private/app:pull"`)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"errors":[{"code":"UNAUTHORIZED","message":"authentication required","detail":[{"Type":"repository","Name":"private/app","Action":"pull"}]}]}`))
+		case "/v2/limited/app/manifests/latest":
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte("slow down"))
+		case "/v2/denied/app/tags/list":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	r := newTestRouter(newTestRegistryHandler(newUpstreamTestConfig(upstream.URL)))
+	missingBlob := "/v2/library/nginx/blobs/" + digestOf([]byte("missing"))
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		code   distribution.ErrorCode
+		header string // 需要透传的响应头
+		value  string
+	}{
+		{"upstream errors body kept", "/v2/private/app/manifests/latest", http.StatusUnauthorized, distribution.ErrorCodeUnauthorized,
+			"WWW-Authenticate", `Bearer realm="https://proxy.example.com/v2/auth",service="registry.example.com",scope="repository:private/app:pull"`},
+		{"retry after passed through", "/v2/limited/app/manifests/latest", http.StatusTooManyRequests, distribution.ErrorCodeTooManyRequests,
+			"Retry-After", "30"},
+		{"manifest unknown", "/v2/library/nginx/manifests/missing", http.StatusNotFound, distribution.ErrorCodeManifestUnknown, "", ""},
+		{"blob unknown", missingBlob, http.StatusNotFound, distribution.ErrorCodeBlobUnknown, "", ""},
+		{"tags denied", "/v2/denied/app/tags/list", http.StatusForbidden, distribution.ErrorCodeDenied, "", ""},
+		{"invalid route", "/v2/Invalid/manifests/latest", http.StatusNotFound, distribution.ErrorCodeUnsupported, "", ""},
+		{"unsupported digest algorithm", "/v2/library/nginx/blobs/sha384:" + strings.Repeat("a", 96), http.StatusBadRequest, distribution.ErrorCodeDigestInvalid, "", ""},
+		{"uppercase digest", "/v2/library/nginx/blobs/sha256:" + strings.ToUpper(strings.TrimPrefix(digestOf(testBlob), "sha256:")), http.StatusBadRequest, distribution.ErrorCodeDigestInvalid, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(r, http.MethodGet, tt.path)
+			var errs distribution.Errors
+			if err := json.Unmarshal(w.Body.Bytes(), &errs); err != nil || len(errs.Errors) == 0 {
+				t.Fatalf("body = %q, want Distribution errors", w.Body.String())
+			}
+			if w.Code != tt.status || errs.Errors[0].Code != tt.code {
+				t.Fatalf("status=%d code=%s, want %d %s", w.Code, errs.Errors[0].Code, tt.status, tt.code)
+			}
+			if tt.header != "" && w.Header().Get(tt.header) != tt.value {
+				t.Fatalf("%s = %q, want %q", tt.header, w.Header().Get(tt.header), tt.value)
+			}
+		})
+	}
+}
+
+func TestHandleAuthProxyHeldCredentials(t *testing.T) {
+	cfg := newUpstreamTestConfig("http://127.0.0.1:1")
+	cfg.TokenTTL = time.Hour
+	cfg.UpstreamSecrets = filepath.Join(t.TempDir(), "secrets.json")
+	if err := os.WriteFile(cfg.UpstreamSecrets, []byte(`{"default": {"username": "robot", "password": "robot-password"}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	h := newTestRegistryHandler(cfg)
+	r := gin.New()
+	r.GET("/v2/auth", h.HandleAuth)
+
+	// 未配置账号时匿名客户端得到当前服务签发的 token，不需要访问上游鉴权服务
+	w := serve(r, http.MethodGet, "/v2/auth?service=registry.docker.io&scope=repository:private/app:pull")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var token struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &token); err != nil {
+		t.Fatal(err)
+	}
+	claims, err := h.tokenService.GetToken(token.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Sub != "" || !claims.Allows("repository", "private/app", "pull") {
+		t.Fatalf("claims = %+v, want anonymous pull access to private/app", claims)
+	}
+}
+
+func TestHandleAuthScopes(t *testing.T) {
+	cfg := newTestConfig(t, map[string]string{"alice": "alice-password"})
+	cfg.PolicyFile = filepath.Join(t.TempDir(), "policy.json")
+	policy := `{"rules": [{"subjects": ["alice"], "repositories": ["myorg/**"], "actions": ["pull", "push"]}]}`
+	if err := os.WriteFile(cfg.PolicyFile, []byte(policy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	h := newTestRegistryHandler(cfg)
+	r := gin.New()
+	r.GET("/v2/auth", h.HandleAuth)
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		access []service.Access
+	}{
+		{"no scope", "", http.StatusOK, []service.Access{}},
+		{"single scope", "scope=repository:myorg/app:pull", http.StatusOK, []service.Access{
+			{Type: "repository", Name: "myorg/app", Actions: []string{"pull"}},
+		}},
+		{"comma separated actions", "scope=repository:myorg/app:pull,push", http.StatusOK, []service.Access{
+			{Type: "repository", Name: "myorg/app", Actions: []string{"pull", "push"}},
+		}},
+		{"multiple scope parameters", "scope=repository:myorg/app:pull&scope=repository:library/nginx:pull&scope=registry:catalog:*", http.StatusOK, []service.Access{
+			{Type: "repository", Name: "myorg/app", Actions: []string{"pull"}},
+			{Type: "repository", Name: "library/nginx", Actions: []string{"pull"}},
+			{Type: "registry", Name: "catalog", Actions: []string{"*"}},
+		}},
+		{"one entry per resource", "scope=repository:myorg/app:pull&scope=repository:myorg/app:push", http.StatusOK, []service.Access{
+			{Type: "repository", Name: "myorg/app", Actions: []string{"pull", "push"}},
+		}},
+		// 授予请求的操作与权限策略允许的操作的交集
+		{"requested and permitted intersection", "scope=repository:library/nginx:pull,push&scope=repository:myorg/app:push,delete", http.StatusOK, []service.Access{
+			{Type: "repository", Name: "library/nginx", Actions: []string{"pull"}},
+			{Type: "repository", Name: "myorg/app", Actions: []string{"push"}},
+		}},
+		{"nothing permitted", "scope=repository:library/nginx:delete", http.StatusOK, []service.Access{
+			{Type: "repository", Name: "library/nginx", Actions: []string{}},
+		}},
+		{"registry port in name", "scope=repository:host:5000/app:pull", http.StatusOK, []service.Access{
+			{Type: "repository", Name: "host:5000/app", Actions: []string{"pull"}},
+		}},
+		{"invalid scope", "scope=repository:myorg/app", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v2/auth?service="+cfg.SelfAuthService+"&"+tt.query, nil)
+			req.SetBasicAuth("alice", "alice-password")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, body = %s, want %d", w.Code, w.Body.String(), tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var token service.TokenResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &token); err != nil {
+				t.Fatal(err)
+			}
+			claims, err := h.tokenService.GetToken(token.Token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.Access == nil || !reflect.DeepEqual(claims.Access, tt.access) {
+				t.Fatalf("access = %+v, want %+v", claims.Access, tt.access)
+			}
+		})
+	}
+}
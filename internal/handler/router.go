@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/yunnysunny/docker-image-proxy/internal/distribution"
+)
+
+// DistributionRouter 按 Distribution 规范路由 /v2/<name>/... 请求
+//
+// gin 的 :name 参数只能匹配单个路径段，无法处理 library/nginx 这类多级仓库名，
+// 因此这类请求统一由 NoRoute 进入，在这里解析后分发给 RegistryHandler。
+type DistributionRouter struct {
+	handler *RegistryHandler
+}
+
+// NewDistributionRouter 创建路由
+func NewDistributionRouter(handler *RegistryHandler) *DistributionRouter {
+	return &DistributionRouter{
+		handler: handler,
+	}
+}
+
+// Parse 解析请求路径并写入 name、reference、digest 路径参数，无法解析时返回 404
+func (r *DistributionRouter) Parse() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route, ok := distribution.ParseRoute(c.Request.URL.Path)
+		if !ok {
+			distribution.AbortWithError(c, http.StatusNotFound, distribution.Error{
+				Code:    distribution.ErrorCodeUnsupported,
+				Message: "Not found",
+			})
+			return
+		}
+		c.Params = append(c.Params, gin.Param{Key: "name", Value: route.Name})
+		switch route.Kind {
+		case distribution.RouteManifests:
+			c.Params = append(c.Params, gin.Param{Key: "reference", Value: route.Reference})
+		case distribution.RouteBlobs:
+			c.Params = append(c.Params, gin.Param{Key: "digest", Value: route.Reference})
+		}
+		c.Set(distribution.RouteContextKey, route)
+		c.Next()
+	}
+}
+
+// Dispatch 将解析后的请求分发到对应的处理函数
+func (r *DistributionRouter) Dispatch() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		value, _ := c.Get(distribution.RouteContextKey)
+		route := value.(*distribution.Route)
+		switch {
+		case route.Kind == distribution.RouteManifests && c.Request.Method == http.MethodGet:
+			r.handler.HandleManifest(c)
+		case route.Kind == distribution.RouteManifests && c.Request.Method == http.MethodHead:
+			r.handler.HandleManifestHead(c)
+		case route.Kind == distribution.RouteBlobs && c.Request.Method == http.MethodGet:
+			r.handler.HandleBlob(c)
+		case route.Kind == distribution.RouteBlobs && c.Request.Method == http.MethodHead:
+			r.handler.HandleBlobHead(c)
+		case route.Kind == distribution.RouteTags && c.Request.Method == http.MethodGet:
+			r.handler.HandleTags(c)
+		default:
+			distribution.AbortWithError(c, http.StatusMethodNotAllowed, distribution.Error{
+				Code:    distribution.ErrorCodeUnsupported,
+				Message: "Method not allowed",
+			})
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/yunnysunny/docker-image-proxy/internal/config"
+)
+
+// AdminMiddleware 管理接口认证中间件
+type AdminMiddleware struct {
+	log    *logrus.Logger
+	config *config.Config
+}
+
+// NewAdminMiddleware 创建管理接口认证中间件
+func NewAdminMiddleware(log *logrus.Logger, config *config.Config) *AdminMiddleware {
+	return &AdminMiddleware{
+		log:    log,
+		config: config,
+	}
+}
+
+// AdminRequired 校验请求头 Authorization: Bearer <ADMIN_TOKEN>，未配置 ADMIN_TOKEN 时管理接口不可用
+func (m *AdminMiddleware) AdminRequired() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if m.config.AdminToken == "" {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{
+				"error": "Admin API is disabled",
+			})
+			return
+		}
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(m.config.AdminToken)) != 1 {
+			m.log.WithField("ip", c.ClientIP()).Warn("Invalid admin token")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "Invalid admin token",
+			})
+			return
+		}
+		c.Next()
+	}
+}
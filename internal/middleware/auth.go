@@ -1,21 +1,31 @@
 package middleware
 
 import (
-	// "fmt"
+	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 	"github.com/yunnysunny/docker-image-proxy/internal/config"
+	"github.com/yunnysunny/docker-image-proxy/internal/distribution"
 	"github.com/yunnysunny/docker-image-proxy/internal/service"
 )
 
+// BasicAuthenticator 校验请求中 Basic 认证的账号密码，返回权限策略中的用户和权限上限，
+// 权限上限为 nil 时不限制，失败次数过多时返回 *service.LoginLockedError
+type BasicAuthenticator interface {
+	AuthenticateBasic(c *gin.Context) (string, *service.Credential, error)
+}
+
 // AuthMiddleware 认证中间件
 type AuthMiddleware struct {
-	log     *logrus.Logger
-	config  *config.Config
-	service *service.TokenService
+	log             *logrus.Logger
+	config          *config.Config
+	service         *service.TokenService
+	registryService *service.RegistryService
+	basic           BasicAuthenticator // Basic 认证模式下校验账号密码
 }
 
 // NewAuthMiddleware 创建认证中间件
@@ -23,11 +33,15 @@ func NewAuthMiddleware(
 	log *logrus.Logger,
 	config *config.Config,
 	service *service.TokenService,
+	registryService *service.RegistryService,
+	basic BasicAuthenticator,
 ) *AuthMiddleware {
 	return &AuthMiddleware{
-		log:     log,
-		config:  config,
-		service: service,
+		log:             log,
+		config:          config,
+		service:         service,
+		registryService: registryService,
+		basic:           basic,
 	}
 }
 
@@ -39,19 +53,23 @@ func (m *AuthMiddleware) AuthRequired() gin.HandlerFunc {
 			c.Next()
 			return
 		}
-		if m.config.SkipAuthProxy {// 本服务没有改写过鉴权，跳过中间件
+		if m.config.SkipAuthProxy { // 本服务没有改写过鉴权，跳过中间件
 			c.Next()
 			return
 		}
 
 		// 获取认证头
 		authHeader := c.GetHeader("Authorization")
+		if m.config.AuthMode == config.AuthModeBasic && !strings.HasPrefix(authHeader, "Bearer ") {
+			m.basicAuth(c)
+			return
+		}
 		if authHeader == "" {
 			m.log.Warn("Missing authorization header")
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"error": "Missing authorization header",
+			distribution.AbortWithError(c, http.StatusUnauthorized, distribution.Error{
+				Code:    distribution.ErrorCodeUnauthorized,
+				Message: "Missing authorization header",
 			})
-			c.Abort()
 			return
 		}
 
@@ -59,10 +77,10 @@ func (m *AuthMiddleware) AuthRequired() gin.HandlerFunc {
 		parts := strings.SplitN(authHeader, " ", 2)
 		if len(parts) != 2 || parts[0] != "Bearer" {
 			m.log.Warn("Invalid authorization header format")
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"error": "Invalid authorization header format",
+			distribution.AbortWithError(c, http.StatusUnauthorized, distribution.Error{
+				Code:    distribution.ErrorCodeUnauthorized,
+				Message: "Invalid authorization header format",
 			})
-			c.Abort()
 			return
 		}
 
@@ -71,76 +89,176 @@ func (m *AuthMiddleware) AuthRequired() gin.HandlerFunc {
 		claims, err := m.service.GetUnverifiedToken(token)
 		if err != nil {
 			m.log.WithError(err).Warn("Invalid token")
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"error": "Invalid token",
+			distribution.AbortWithError(c, http.StatusUnauthorized, distribution.Error{
+				Code:    distribution.ErrorCodeUnauthorized,
+				Message: "Invalid token",
 			})
-			c.Abort()
 			return
 		}
-		if claims.Iss != m.config.SelfAuthService {//不是当前服务签名的TOKEN，跳过中间件
+		if claims.Iss != m.config.SelfAuthService { //不是当前服务签名的TOKEN，上游配置了校验时校验后转发给上游
+			typ, name, action, ok := requiredAccess(c)
+			if err := m.registryService.VerifyUpstreamToken(token, c, typ, name, action); err != nil {
+				m.log.WithError(err).Warn("Invalid upstream token")
+				distribution.AbortWithError(c, http.StatusUnauthorized, distribution.Error{
+					Code:    distribution.ErrorCodeUnauthorized,
+					Message: "Invalid token",
+				})
+				return
+			}
+			// 上游 token 同样受权限策略限制，token 中的用户由上游认证，不是当前服务的用户，按匿名用户处理
+			if !ok || !m.service.Permits("", typ, m.policyName(c, typ, name), action) {
+				m.log.WithFields(logrus.Fields{
+					"path":    c.Request.URL.Path,
+					"scope":   typ + ":" + name + ":" + action,
+					"subject": claims.Sub,
+				}).Warn("Insufficient permissions for upstream token")
+				abortDenied(c, typ, name, action)
+				return
+			}
 			c.Next()
 			return
 		}
 		claims, err = m.service.GetToken(token)
 		if err != nil {
 			m.log.WithError(err).Warn("Invalid token")
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"error": "Invalid token",
+			message := "Invalid token"
+			if errors.Is(err, service.ErrTokenRevoked) {
+				message = "Token revoked"
+			}
+			distribution.AbortWithError(c, http.StatusUnauthorized, distribution.Error{
+				Code:    distribution.ErrorCodeUnauthorized,
+				Message: message,
 			})
-			c.Abort()
 			return
 		}
 
 		// 检查权限
-		// if !m.checkScope(claims, c) {
-		// 	m.log.WithFields(logrus.Fields{
-		// 		"path":  c.Request.URL.Path,
-		// 		"scope": claims.Scope,
-		// 	}).Warn("Insufficient permissions")
-		// 	c.JSON(http.StatusForbidden, gin.H{
-		// 		"error": "Insufficient permissions",
-		// 	})
-		// 	c.Abort()
-		// 	return
-		// }
+		typ, name, action, ok := requiredAccess(c)
+		// token 中的权限和当前的权限策略都需要允许，token 中的权限按签发时请求的仓库名匹配
+		if !ok || !claims.Allows(typ, name, action) || !m.service.Permits(claims.Sub, typ, m.policyName(c, typ, name), action) {
+			m.log.WithFields(logrus.Fields{
+				"path":   c.Request.URL.Path,
+				"scope":  typ + ":" + name + ":" + action,
+				"access": claims.Access,
+			}).Warn("Insufficient permissions")
+			if ok {
+				c.Header("WWW-Authenticate", fmt.Sprintf(
+					`Bearer realm=%q,service=%q,scope=%q,error="insufficient_scope"`,
+					m.authRealm(), m.config.SelfAuthService, typ+":"+name+":"+action,
+				))
+			}
+			distribution.AbortWithError(c, http.StatusForbidden, distribution.Error{
+				Code:    distribution.ErrorCodeDenied,
+				Message: "Insufficient permissions",
+				Detail: []gin.H{{
+					"Type":   typ,
+					"Name":   name,
+					"Action": action,
+				}},
+			})
+			return
+		}
 
+		if claims.Upstream != "" { // 包装的上游 token，权限检查通过后转发给上游，由上游判断是否有权访问
+			c.Request.Header.Set("Authorization", "Bearer "+claims.Upstream)
+			c.Next()
+			return
+		}
 		// 将claims信息存储到上下文中
 		c.Set("token", claims)
 		c.Next()
 	}
 }
 
-// checkScope 检查请求的权限范围
-// func (m *AuthMiddleware) checkScope(claims *service.Token, c *gin.Context) bool {
-// 	// 解析请求路径
-// 	path := c.Request.URL.Path
-// 	parts := strings.Split(path, "/")
-// 	if len(parts) < 4 {
-// 		return false
-// 	}
-
-// 	// 获取请求的操作类型
-// 	var action string
-// 	switch {
-// 	case strings.HasSuffix(path, "/tags/list"):
-// 		action = "pull"
-// 	case strings.HasSuffix(path, "/manifests/"):
-// 		action = "pull"
-// 	case strings.HasSuffix(path, "/blobs/"):
-// 		action = "pull"
-// 	default:
-// 		return false
-// 	}
-
-// 	// 构建请求的scope
-// 	requestScope := fmt.Sprintf("repository:%s:%s", parts[2], action)
-
-// 	// 检查scope是否匹配
-// 	for _, scope := range claims.Scope {
-// 		if scope == requestScope {
-// 			return true
-// 		}
-// 	}
-
-// 	return false
-// }
+// basicAuth Basic 认证模式下校验请求中的账号密码，按权限策略和权限上限检查权限，
+// 不带认证头的请求按匿名用户处理，未配置账号时允许匿名访问
+func (m *AuthMiddleware) basicAuth(c *gin.Context) {
+	subject, credential, err := m.basic.AuthenticateBasic(c)
+	if err != nil {
+		m.log.WithError(err).Warn("Basic authentication failed")
+		AbortBasicAuth(c, m.config.SelfAuthService, err)
+		return
+	}
+	typ, name, action, ok := requiredAccess(c)
+	policyName := m.policyName(c, typ, name)
+	if !ok || !m.service.Permits(subject, typ, policyName, action) ||
+		(credential != nil && !credential.Allows(typ, policyName, action)) {
+		m.log.WithFields(logrus.Fields{
+			"path":    c.Request.URL.Path,
+			"scope":   typ + ":" + name + ":" + action,
+			"subject": subject,
+		}).Warn("Insufficient permissions")
+		abortDenied(c, typ, name, action)
+		return
+	}
+	// 与 token 认证相同，上下文中存在 token 时不向上游转发客户端的认证头
+	c.Set("token", &service.Token{
+		Iss:    m.config.SelfAuthService,
+		Sub:    subject,
+		Access: []service.Access{{Type: typ, Name: name, Actions: []string{action}}},
+	})
+	c.Next()
+}
+
+// AbortBasicAuth 返回 Basic 认证失败，失败次数过多时返回 429 和 Retry-After，否则返回 401 和 Basic 认证挑战
+func AbortBasicAuth(c *gin.Context, realm string, err error) {
+	var locked *service.LoginLockedError
+	if errors.As(err, &locked) {
+		c.Header("Retry-After", locked.RetryAfterHeader())
+		distribution.AbortWithError(c, http.StatusTooManyRequests, distribution.NewError(distribution.ErrorCodeTooManyRequests, nil))
+		return
+	}
+	c.Header("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", realm))
+	distribution.AbortWithError(c, http.StatusUnauthorized, distribution.NewError(distribution.ErrorCodeUnauthorized, nil))
+}
+
+// abortDenied 返回权限不足
+func abortDenied(c *gin.Context, typ, name, action string) {
+	distribution.AbortWithError(c, http.StatusForbidden, distribution.NewError(distribution.ErrorCodeDenied, []gin.H{{
+		"Type":   typ,
+		"Name":   name,
+		"Action": action,
+	}}))
+}
+
+// policyName 权限策略中使用的资源名称，仓库使用按上游解析后的规范名称，
+// 避免同一仓库的不同写法（nginx 与 library/nginx、不同的前缀别名）绕过权限策略
+func (m *AuthMiddleware) policyName(c *gin.Context, typ, name string) string {
+	if typ != "repository" {
+		return name
+	}
+	canonical, err := m.registryService.CanonicalName(name, c.Query("ns"))
+	if err != nil { // 无法选择上游的请求不会转发，按原名检查
+		return name
+	}
+	return canonical
+}
+
+// authRealm 当前服务的鉴权地址
+func (m *AuthMiddleware) authRealm() string {
+	return strings.TrimRight(m.config.SelfRegistry, "/") + "/v2/auth"
+}
+
+// requiredAccess 根据请求推断需要的权限：
+//   - /v2/_catalog 需要 registry:catalog:*
+//   - /v2/<name>/... 的 GET、HEAD 请求需要 pull，上传相关的 POST、PUT、PATCH 请求需要 push，DELETE 请求需要 delete
+func requiredAccess(c *gin.Context) (string, string, string, bool) {
+	if c.Request.URL.Path == "/v2/_catalog" {
+		return "registry", "catalog", "*", true
+	}
+	value, exists := c.Get(distribution.RouteContextKey)
+	if !exists {
+		return "", "", "", false
+	}
+	route := value.(*distribution.Route)
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead:
+		return "repository", route.Name, "pull", true
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+		return "repository", route.Name, "push", true
+	case http.MethodDelete:
+		return "repository", route.Name, "delete", true
+	default:
+		return "", "", "", false
+	}
+}
@@ -0,0 +1,394 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sirupsen/logrus"
+	"github.com/yunnysunny/docker-image-proxy/internal/config"
+	"github.com/yunnysunny/docker-image-proxy/internal/distribution"
+	"github.com/yunnysunny/docker-image-proxy/internal/service"
+)
+
+// fakeBasic 固定的账号：alice 为普通用户，robot 的权限上限只有 myorg/app 的 pull，locked 已被锁定，
+// 不带认证头时为匿名用户
+type fakeBasic struct{}
+
+func (fakeBasic) AuthenticateBasic(c *gin.Context) (string, *service.Credential, error) {
+	username, password, ok := c.Request.BasicAuth()
+	switch {
+	case !ok:
+		return "", nil, nil
+	case username == "locked":
+		return "", nil, &service.LoginLockedError{RetryAfter: 30 * time.Second}
+	case username == "alice" && password == "alice-password":
+		return "alice", nil, nil
+	case username == "robot" && password == "robot-password":
+		return "alice", &service.Credential{Scopes: []service.CredentialScope{{
+			Repositories: []string{"myorg/app"},
+			Actions:      []string{service.ActionPull},
+		}}}, nil
+	}
+	return "", nil, errors.New("unauthorized account")
+}
+
+func newTestBasicRouter(t *testing.T) (*gin.Engine, *service.TokenService) {
+	t.Helper()
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	policy := filepath.Join(t.TempDir(), "policy.json")
+	data := `{"defaultDeny": true, "rules": [
+		{"subjects": ["alice"], "repositories": ["myorg/**"], "actions": ["pull", "push"]},
+		{"subjects": ["*"], "repositories": ["library/**"], "actions": ["pull"]}
+	]}`
+	if err := os.WriteFile(policy, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		AuthMode:         config.AuthModeBasic,
+		UpstreamRegistry: "https://registry-1.docker.io",
+		SelfRegistry:     "https://proxy.example.com",
+		SelfAuthService:  "docker-image-proxy",
+		ServerSecret:     "secret",
+		TokenTTL:         time.Hour,
+		PolicyFile:       policy,
+	}
+	tokenService := service.NewTokenService(log, cfg)
+	m := NewAuthMiddleware(log, cfg, tokenService, service.NewRegistryService(log, cfg), fakeBasic{})
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.NoRoute(func(c *gin.Context) {
+		route, ok := distribution.ParseRoute(c.Request.URL.Path)
+		if !ok {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		c.Set(distribution.RouteContextKey, route)
+	}, m.AuthRequired(), func(c *gin.Context) {
+		value, _ := c.Get("token")
+		c.String(http.StatusOK, value.(*service.Token).Sub)
+	})
+	return r, tokenService
+}
+
+func TestBasicAuthMode(t *testing.T) {
+	r, tokenService := newTestBasicRouter(t)
+	token, err := tokenService.GetDockerRegistryToken("alice", []service.Scope{{
+		Type: "repository", Name: "myorg/app", Actions: []string{"pull"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		username  string
+		password  string
+		bearer    string
+		status    int
+		subject   string
+		challenge string
+	}{
+		{"anonymous pull of public image", http.MethodGet, "/v2/nginx/manifests/latest", "", "", "", http.StatusOK, "", ""},
+		{"anonymous pull of private image", http.MethodGet, "/v2/myorg/app/manifests/latest", "", "", "", http.StatusForbidden, "", ""},
+		{"user pull", http.MethodGet, "/v2/myorg/app/manifests/latest", "alice", "alice-password", "", http.StatusOK, "alice", ""},
+		{"user head", http.MethodHead, "/v2/myorg/app/blobs/sha256:0", "alice", "alice-password", "", http.StatusOK, "alice", ""},
+		{"user denied by policy", http.MethodGet, "/v2/other/app/manifests/latest", "alice", "alice-password", "", http.StatusForbidden, "", ""},
+		{"wrong password", http.MethodGet, "/v2/myorg/app/manifests/latest", "alice", "wrong", "", http.StatusUnauthorized, "", `Basic realm="docker-image-proxy"`},
+		{"credential ceiling allows pull", http.MethodGet, "/v2/myorg/app/manifests/latest", "robot", "robot-password", "", http.StatusOK, "alice", ""},
+		{"credential ceiling denies push", http.MethodPut, "/v2/myorg/app/manifests/latest", "robot", "robot-password", "", http.StatusForbidden, "", ""},
+		{"locked account", http.MethodGet, "/v2/myorg/app/manifests/latest", "locked", "any", "", http.StatusTooManyRequests, "", ""},
+		{"bearer token still accepted", http.MethodGet, "/v2/myorg/app/manifests/latest", "", "", token.Token, http.StatusOK, "alice", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.username != "" {
+				req.SetBasicAuth(tt.username, tt.password)
+			}
+			if tt.bearer != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, body = %s, want %d", w.Code, w.Body.String(), tt.status)
+			}
+			if tt.status == http.StatusOK && w.Body.String() != tt.subject {
+				t.Fatalf("subject = %q, want %q", w.Body.String(), tt.subject)
+			}
+			if got := w.Header().Get("WWW-Authenticate"); got != tt.challenge {
+				t.Fatalf("WWW-Authenticate = %q, want %q", got, tt.challenge)
+			}
+			if tt.status == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "30" {
+				t.Fatalf("Retry-After = %q, want 30", w.Header().Get("Retry-After"))
+			}
+		})
+	}
+}
+
+func newTestTokenRouter(t *testing.T) (*gin.Engine, *service.TokenService) {
+	t.Helper()
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	policy := filepath.Join(t.TempDir(), "policy.json")
+	data := `{"rules": [
+		{"subjects": ["alice"], "repositories": ["myorg/**"], "actions": ["pull", "push"]}
+	]}`
+	if err := os.WriteFile(policy, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		UpstreamRegistry: "https://registry-1.docker.io",
+		SelfRegistry:     "https://proxy.example.com",
+		SelfAuthService:  "docker-image-proxy",
+		ServerSecret:     "secret",
+		TokenTTL:         time.Hour,
+		PolicyFile:       policy,
+	}
+	tokenService := service.NewTokenService(log, cfg)
+	m := NewAuthMiddleware(log, cfg, tokenService, service.NewRegistryService(log, cfg), nil)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.NoRoute(func(c *gin.Context) {
+		if route, ok := distribution.ParseRoute(c.Request.URL.Path); ok {
+			c.Set(distribution.RouteContextKey, route)
+		}
+	}, m.AuthRequired(), func(c *gin.Context) {
+		value, _ := c.Get("token")
+		c.String(http.StatusOK, value.(*service.Token).Sub)
+	})
+	return r, tokenService
+}
+
+func TestAuthRequiredTokenScopes(t *testing.T) {
+	r, tokenService := newTestTokenRouter(t)
+	issue := func(scopes ...service.Scope) string {
+		token, err := tokenService.GetDockerRegistryToken("alice", scopes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token.Token
+	}
+	pull := issue(service.Scope{Type: "repository", Name: "myorg/app", Actions: []string{"pull"}})
+	push := issue(service.Scope{Type: "repository", Name: "myorg/app", Actions: []string{"pull", "push"}})
+	catalog := issue(service.Scope{Type: "registry", Name: "catalog", Actions: []string{"*"}})
+	wildcard := issue(service.Scope{Type: "repository", Name: "myorg/**", Actions: []string{"pull"}})
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		status int
+	}{
+		{"get needs pull", http.MethodGet, "/v2/myorg/app/manifests/latest", pull, http.StatusOK},
+		{"head needs pull", http.MethodHead, "/v2/myorg/app/blobs/sha256:0", pull, http.StatusOK},
+		{"upload with pull only", http.MethodPost, "/v2/myorg/app/blobs/uploads/", pull, http.StatusForbidden},
+		{"upload with push", http.MethodPost, "/v2/myorg/app/blobs/uploads/", push, http.StatusOK},
+		{"manifest put with push", http.MethodPut, "/v2/myorg/app/manifests/latest", push, http.StatusOK},
+		{"delete without delete", http.MethodDelete, "/v2/myorg/app/manifests/latest", push, http.StatusForbidden},
+		{"other repository", http.MethodGet, "/v2/myorg/web/manifests/latest", pull, http.StatusForbidden},
+		{"catalog without scope", http.MethodGet, "/v2/_catalog", pull, http.StatusForbidden},
+		{"catalog with scope", http.MethodGet, "/v2/_catalog", catalog, http.StatusOK},
+		{"wildcard grants multi-segment name", http.MethodGet, "/v2/myorg/team/app/manifests/latest", wildcard, http.StatusOK},
+		{"wildcard does not grant push", http.MethodPut, "/v2/myorg/team/app/manifests/latest", wildcard, http.StatusForbidden},
+		{"wildcard outside prefix", http.MethodGet, "/v2/other/app/manifests/latest", wildcard, http.StatusForbidden},
+		{"missing token", http.MethodGet, "/v2/myorg/app/manifests/latest", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, body = %s, want %d", w.Code, w.Body.String(), tt.status)
+			}
+			if tt.status == http.StatusOK && w.Body.String() != "alice" {
+				t.Fatalf("subject = %q, want alice", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestAuthRequiredInsufficientScope(t *testing.T) {
+	r, tokenService := newTestTokenRouter(t)
+	token, err := tokenService.GetDockerRegistryToken("alice", []service.Scope{{
+		Type: "repository", Name: "myorg/app", Actions: []string{"pull"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPut, "/v2/myorg/app/manifests/latest", nil)
+	req.Header.Set("Authorization", "Bearer "+token.Token)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+	want := `Bearer realm="https://proxy.example.com/v2/auth",service="docker-image-proxy",scope="repository:myorg/app:push",error="insufficient_scope"`
+	if got := w.Header().Get("WWW-Authenticate"); got != want {
+		t.Fatalf("WWW-Authenticate = %q, want %q", got, want)
+	}
+	var body distribution.Errors
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("body %s is not an error response: %v", w.Body.String(), err)
+	}
+	if len(body.Errors) != 1 || body.Errors[0].Code != distribution.ErrorCodeDenied {
+		t.Fatalf("errors = %+v, want one DENIED error", body.Errors)
+	}
+	detail, _ := json.Marshal(body.Errors[0].Detail)
+	if string(detail) != `[{"Action":"push","Name":"myorg/app","Type":"repository"}]` {
+		t.Fatalf("detail = %s", detail)
+	}
+}
+
+func TestAuthRequiredUpstreamTokenPolicy(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	policy := filepath.Join(t.TempDir(), "policy.json")
+	data := `{"defaultDeny": true, "rules": [
+		{"subjects": ["alice"], "repositories": ["myorg/app"], "actions": ["pull"]}
+	]}`
+	if err := os.WriteFile(policy, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		UpstreamRegistry: "https://registry-1.docker.io",
+		SelfRegistry:     "https://proxy.example.com",
+		SelfAuthService:  "docker-image-proxy",
+		ServerSecret:     "secret",
+		TokenTTL:         time.Hour,
+		PolicyFile:       policy,
+	}
+	tokenService := service.NewTokenService(log, cfg)
+	m := NewAuthMiddleware(log, cfg, tokenService, service.NewRegistryService(log, cfg), nil)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.NoRoute(func(c *gin.Context) {
+		if route, ok := distribution.ParseRoute(c.Request.URL.Path); ok {
+			c.Set(distribution.RouteContextKey, route)
+		}
+	}, m.AuthRequired(), func(c *gin.Context) {
+		// 包装的上游 token 按上游 token 转发，不视为当前服务认证过的请求
+		if _, exists := c.Get("token"); exists {
+			c.String(http.StatusInternalServerError, "wrapped upstream token stored as a proxy token")
+			return
+		}
+		c.String(http.StatusOK, c.GetHeader("Authorization"))
+	})
+
+	upstreamToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss": "auth.docker.io",
+		"sub": "alice",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte("upstream-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	scopes := []service.Scope{{Type: "repository", Name: "myorg/app", Actions: []string{"pull"}}}
+	wrap := func(subject string) string {
+		token, err := tokenService.WrapUpstreamToken(subject, scopes, &service.TokenResponse{Token: upstreamToken, ExpiresIn: 300})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.ExpiresIn != 300 {
+			t.Fatalf("expires_in = %d, want the upstream token lifetime 300", token.ExpiresIn)
+		}
+		return token.Token
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"wrapped token of granted user", wrap("alice"), http.StatusOK},
+		{"wrapped token of other user", wrap("bob"), http.StatusForbidden},
+		// 未包装的上游 token 不知道当前服务的用户，按匿名用户检查
+		{"raw upstream token", upstreamToken, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/v2/myorg/app/manifests/latest", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, body = %s, want %d", w.Code, w.Body.String(), tt.status)
+			}
+			if tt.status == http.StatusOK && w.Body.String() != "Bearer "+upstreamToken {
+				t.Fatalf("forwarded Authorization = %q, want the upstream token", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestAuthRequiredRevokedTokens(t *testing.T) {
+	r, tokenService := newTestTokenRouter(t)
+	scopes := []service.Scope{{Type: "repository", Name: "myorg/app", Actions: []string{"pull"}}}
+	issue := func(subject string) (string, *service.Token) {
+		token, err := tokenService.GetDockerRegistryToken(subject, scopes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, err := tokenService.GetToken(token.Token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token.Token, claims
+	}
+	pull := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/v2/myorg/app/manifests/latest", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	revoked, claims := issue("alice")
+	other, _ := issue("alice")
+	if err := tokenService.Revocations().RevokeToken(claims.Jti, time.Unix(claims.Exp, 0)); err != nil {
+		t.Fatal(err)
+	}
+	w := pull(revoked)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("revoked jti: status = %d, want 401", w.Code)
+	}
+	var body distribution.Errors
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || len(body.Errors) != 1 ||
+		body.Errors[0].Code != distribution.ErrorCodeUnauthorized || body.Errors[0].Message != "Token revoked" {
+		t.Fatalf("revoked jti: body = %s, want an UNAUTHORIZED Token revoked error", w.Body.String())
+	}
+	if w := pull(other); w.Code != http.StatusOK {
+		t.Fatalf("other token of the same user: status = %d, want 200", w.Code)
+	}
+
+	// 按用户吊销时该用户此前签发的 token 全部失效，其他用户不受影响
+	bob, _ := issue("bob")
+	if err := tokenService.Revocations().RevokeSubject("alice", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if w := pull(other); w.Code != http.StatusUnauthorized {
+		t.Fatalf("revoked subject: status = %d, want 401", w.Code)
+	}
+	if w := pull(bob); w.Code != http.StatusOK {
+		t.Fatalf("other subject: status = %d, want 200", w.Code)
+	}
+}
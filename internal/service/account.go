@@ -0,0 +1,199 @@
+package service
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/yunnysunny/docker-image-proxy/internal/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// AccountStore 账号存储，用于校验客户端登录和换取 token 时使用的账号密码
+type AccountStore interface {
+	// Enabled 是否配置了账号，未配置时不校验账号
+	Enabled() bool
+	// Verify 校验账号密码，账号不存在时也会执行同样耗时的校验，避免通过响应时间判断账号是否存在
+	Verify(username, password string) bool
+	// Exists 判断账号是否仍然存在，用于刷新 token 时确认用户没有被删除；未配置账号时只有匿名用户存在
+	Exists(username string) bool
+}
+
+// dummyHash 账号不存在时用于比较的 bcrypt 哈希，使校验耗时与账号存在时一致
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("docker-image-proxy"), bcrypt.DefaultCost)
+
+// NewAccountStore 创建账号存储，配置了 HTPASSWD_FILE 时使用 htpasswd 文件，
+// 否则使用 ACCOUNTS 中的账号，都未配置时返回不校验账号的存储
+func NewAccountStore(log *logrus.Logger, config *config.Config) AccountStore {
+	if config.HtpasswdFile != "" {
+		store := &htpasswdStore{log: log, path: config.HtpasswdFile}
+		if err := store.reload(); err != nil {
+			log.WithError(err).WithField("file", config.HtpasswdFile).Fatal("Failed to load htpasswd file")
+		}
+		return store
+	}
+	if len(config.Accounts) > 0 {
+		log.Warn("ACCOUNTS is deprecated, use HTPASSWD_FILE instead")
+		return newStaticStore(log, config.Accounts)
+	}
+	return noAccountStore{}
+}
+
+// noAccountStore 未配置账号
+type noAccountStore struct{}
+
+func (noAccountStore) Enabled() bool { return false }
+
+func (noAccountStore) Verify(username, password string) bool { return true }
+
+func (noAccountStore) Exists(username string) bool { return username == "" }
+
+// staticStore 使用 ACCOUNTS 环境变量中 base64 编码的 user:password 账号，
+// 启动时解码并保存密码的 SHA-256 摘要，校验时按固定耗时比较
+type staticStore struct {
+	passwords map[string][]byte
+}
+
+func newStaticStore(log *logrus.Logger, accounts []string) *staticStore {
+	store := &staticStore{passwords: map[string][]byte{}}
+	for _, account := range accounts {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(account))
+		if err != nil {
+			log.WithError(err).Warn("Invalid account in ACCOUNTS, skipped")
+			continue
+		}
+		username, password, ok := strings.Cut(string(decoded), ":")
+		if !ok {
+			log.Warn("Invalid account in ACCOUNTS, skipped")
+			continue
+		}
+		sum := sha256.Sum256([]byte(password))
+		store.passwords[username] = sum[:]
+	}
+	return store
+}
+
+func (s *staticStore) Enabled() bool { return true }
+
+func (s *staticStore) Verify(username, password string) bool {
+	sum := sha256.Sum256([]byte(password))
+	expected, exists := s.passwords[username]
+	if !exists {
+		expected = make([]byte, len(sum))
+	}
+	return subtle.ConstantTimeCompare(expected, sum[:]) == 1 && exists
+}
+
+func (s *staticStore) Exists(username string) bool {
+	_, exists := s.passwords[username]
+	return exists
+}
+
+// htpasswdStore 使用 htpasswd 文件中的账号，只支持 bcrypt 格式（htpasswd -B），
+// 文件修改后自动重新加载
+type htpasswdStore struct {
+	log  *logrus.Logger
+	path string
+
+	mu      sync.RWMutex
+	modTime time.Time
+	size    int64
+	hashes  map[string][]byte
+}
+
+func (s *htpasswdStore) Enabled() bool { return true }
+
+func (s *htpasswdStore) Verify(username, password string) bool {
+	if err := s.reloadIfChanged(); err != nil {
+		s.log.WithError(err).WithField("file", s.path).Error("Failed to reload htpasswd file, using previous accounts")
+	}
+	s.mu.RLock()
+	hash, exists := s.hashes[username]
+	s.mu.RUnlock()
+	if !exists {
+		hash = dummyHash
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil && exists
+}
+
+func (s *htpasswdStore) Exists(username string) bool {
+	if err := s.reloadIfChanged(); err != nil {
+		s.log.WithError(err).WithField("file", s.path).Error("Failed to reload htpasswd file, using previous accounts")
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, exists := s.hashes[username]
+	return exists
+}
+
+// reloadIfChanged 文件修改时间或大小变化时重新加载
+func (s *htpasswdStore) reloadIfChanged() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	s.mu.RLock()
+	changed := !info.ModTime().Equal(s.modTime) || info.Size() != s.size
+	s.mu.RUnlock()
+	if !changed {
+		return nil
+	}
+	return s.reload()
+}
+
+// reload 读取 htpasswd 文件，每行格式为 username:hash，# 开头的行为注释
+func (s *htpasswdStore) reload() error {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	hashes := map[string][]byte{}
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok || username == "" {
+			s.log.WithField("line", lineNo).Warn("Invalid htpasswd entry, skipped")
+			continue
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			s.log.WithFields(logrus.Fields{
+				"line":     lineNo,
+				"username": username,
+			}).Warn("Unsupported htpasswd hash, only bcrypt is supported, skipped")
+			continue
+		}
+		hashes[username] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.hashes = hashes
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+	s.mu.Unlock()
+	s.log.WithFields(logrus.Fields{
+		"file":     s.path,
+		"accounts": len(hashes),
+	}).Info("Htpasswd file loaded")
+	return nil
+}
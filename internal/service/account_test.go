@@ -0,0 +1,119 @@
+package service
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yunnysunny/docker-image-proxy/internal/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// writeTestHtpasswd 写入 htpasswd 文件，modTime 用于确保文件修改能被检测到
+func writeTestHtpasswd(t *testing.T, file string, accounts map[string]string, modTime time.Time) {
+	t.Helper()
+	data := "# accounts\n\ninvalid-line\nmd5user:$apr1$abc$def\n"
+	for username, password := range accounts {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data += username + ":" + string(hash) + "\n"
+	}
+	if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHtpasswdStore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	now := time.Now()
+	writeTestHtpasswd(t, file, map[string]string{"alice": "secret"}, now.Add(-time.Minute))
+	store := NewAccountStore(newTestLogger(), &config.Config{HtpasswdFile: file})
+
+	if !store.Enabled() {
+		t.Fatal("htpasswd store should be enabled")
+	}
+	tests := []struct {
+		username string
+		password string
+		want     bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"bob", "secret", false},
+		{"md5user", "anything", false}, // 只支持 bcrypt
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if got := store.Verify(tt.username, tt.password); got != tt.want {
+			t.Errorf("Verify(%q, %q) = %v, want %v", tt.username, tt.password, got, tt.want)
+		}
+	}
+	if !store.Exists("alice") || store.Exists("bob") || store.Exists("md5user") {
+		t.Fatal("Exists should report only valid bcrypt accounts")
+	}
+
+	// 文件修改后重新加载
+	writeTestHtpasswd(t, file, map[string]string{"bob": "hunter2"}, now)
+	if !store.Verify("bob", "hunter2") || store.Verify("alice", "secret") {
+		t.Fatal("htpasswd store should reload after the file changes")
+	}
+	if store.Exists("alice") || !store.Exists("bob") {
+		t.Fatal("Exists should use the reloaded accounts")
+	}
+
+	// 文件无法读取时继续使用已加载的账号
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	if !store.Verify("bob", "hunter2") {
+		t.Fatal("htpasswd store should keep previous accounts when the file cannot be read")
+	}
+}
+
+func TestStaticStore(t *testing.T) {
+	encode := func(account string) string {
+		return base64.StdEncoding.EncodeToString([]byte(account))
+	}
+	store := NewAccountStore(newTestLogger(), &config.Config{
+		Accounts: []string{encode("alice:se:cret"), "not-base64!", encode("no-colon")},
+	})
+
+	tests := []struct {
+		username string
+		password string
+		want     bool
+	}{
+		{"alice", "se:cret", true}, // 密码可以包含冒号
+		{"alice", "se", false},
+		{"no-colon", "", false},
+		{"bob", "", false},
+	}
+	for _, tt := range tests {
+		if got := store.Verify(tt.username, tt.password); got != tt.want {
+			t.Errorf("Verify(%q, %q) = %v, want %v", tt.username, tt.password, got, tt.want)
+		}
+	}
+	if !store.Exists("alice") || store.Exists("no-colon") {
+		t.Fatal("Exists should report only decoded accounts")
+	}
+}
+
+func TestNoAccountStore(t *testing.T) {
+	store := NewAccountStore(newTestLogger(), &config.Config{})
+	if store.Enabled() {
+		t.Fatal("store without accounts should be disabled")
+	}
+	if !store.Verify("anyone", "anything") {
+		t.Fatal("store without accounts should accept any password")
+	}
+	if !store.Exists("") || store.Exists("alice") {
+		t.Fatal("store without accounts should only contain the anonymous user")
+	}
+}
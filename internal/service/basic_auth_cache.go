@@ -0,0 +1,111 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/yunnysunny/docker-image-proxy/internal/config"
+)
+
+// basicAuthCacheMaxEntries 缓存的最大条目数，清理过期条目后仍然已满时不再缓存
+const basicAuthCacheMaxEntries = 10000
+
+// basicAuthEntry 通过校验的账号密码对应的身份
+type basicAuthEntry struct {
+	subject    string
+	credential *Credential
+	expires    time.Time
+}
+
+// BasicAuthCache 缓存 Basic 认证模式下通过校验的账号密码，有效期为 BASIC_AUTH_CACHE_TTL，
+// 避免每个请求都执行 bcrypt 校验。键为账号密码的 HMAC，内存中不保存密码；
+// 缓存有效期内删除账号或凭据、修改密码不影响已缓存的账号密码
+type BasicAuthCache struct {
+	log  *logrus.Logger
+	ttl  time.Duration
+	salt []byte // HMAC 密钥，每次启动随机生成
+
+	mu      sync.Mutex
+	entries map[string]*basicAuthEntry
+}
+
+// NewBasicAuthCache 创建 Basic 认证缓存，BASIC_AUTH_CACHE_TTL 为 0 时返回 nil
+func NewBasicAuthCache(log *logrus.Logger, config *config.Config) *BasicAuthCache {
+	if config.BasicAuthCacheTTL <= 0 {
+		return nil
+	}
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		log.WithError(err).Error("Failed to generate basic auth cache key, basic auth cache disabled")
+		return nil
+	}
+	return &BasicAuthCache{
+		log:     log,
+		ttl:     config.BasicAuthCacheTTL,
+		salt:    salt,
+		entries: make(map[string]*basicAuthEntry),
+	}
+}
+
+func (c *BasicAuthCache) key(username, password string) string {
+	mac := hmac.New(sha256.New, c.salt)
+	mac.Write([]byte(username))
+	mac.Write([]byte{0})
+	mac.Write([]byte(password))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Get 返回缓存的身份，未命中或已过期时 ok 为 false
+func (c *BasicAuthCache) Get(username, password string) (subject string, credential *Credential, ok bool) {
+	if c == nil {
+		return "", nil, false
+	}
+	key := c.key(username, password)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return "", nil, false
+	}
+	if !time.Now().Before(entry.expires) {
+		delete(c.entries, key)
+		return "", nil, false
+	}
+	return entry.subject, entry.credential, true
+}
+
+// Put 缓存通过校验的账号密码，凭据的过期时间早于缓存有效期时按凭据的过期时间失效
+func (c *BasicAuthCache) Put(username, password, subject string, credential *Credential) {
+	if c == nil {
+		return
+	}
+	now := time.Now()
+	expires := now.Add(c.ttl)
+	if credential != nil && credential.ExpiresAt.Before(expires) {
+		expires = credential.ExpiresAt
+	}
+	key := c.key(username, password)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.entries[key]; !exists && len(c.entries) >= basicAuthCacheMaxEntries {
+		c.pruneLocked(now)
+		if len(c.entries) >= basicAuthCacheMaxEntries {
+			return
+		}
+	}
+	c.entries[key] = &basicAuthEntry{subject: subject, credential: credential, expires: expires}
+}
+
+// pruneLocked 清除已过期的条目，调用方需持有锁
+func (c *BasicAuthCache) pruneLocked(now time.Time) {
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/yunnysunny/docker-image-proxy/internal/config"
+)
+
+func TestBasicAuthCache(t *testing.T) {
+	if NewBasicAuthCache(newTestLogger(), &config.Config{}) != nil {
+		t.Fatal("cache created with zero ttl")
+	}
+	cache := NewBasicAuthCache(newTestLogger(), &config.Config{BasicAuthCacheTTL: time.Minute})
+	expiring := &Credential{ExpiresAt: time.Now().Add(-time.Second)}
+	cache.Put("alice", "secret", "alice", nil)
+	cache.Put("robot$builder", "dip_expired", "robot$builder", expiring)
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		hit      bool
+	}{
+		{"cached", "alice", "secret", true},
+		{"wrong password", "alice", "guess", false},
+		{"other username", "bob", "secret", false},
+		{"credential expired", "robot$builder", "dip_expired", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subject, _, ok := cache.Get(tt.username, tt.password)
+			if ok != tt.hit || (ok && subject != tt.username) {
+				t.Fatalf("Get(%q) = %q, %v, want hit=%v", tt.username, subject, ok, tt.hit)
+			}
+		})
+	}
+
+	var disabled *BasicAuthCache
+	disabled.Put("alice", "secret", "alice", nil)
+	if _, _, ok := disabled.Get("alice", "secret"); ok {
+		t.Fatal("nil cache hit")
+	}
+}
@@ -0,0 +1,421 @@
+package service
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/yunnysunny/docker-image-proxy/internal/config"
+)
+
+// BlobCache 以摘要为键的镜像层磁盘缓存
+//
+// 目录结构：
+//   - <CacheDir>/blobs/<algorithm>/<hex前两位>/<hex> 已提交的镜像层
+//   - <CacheDir>/links/<algorithm>/<hex>/<转义后的 name> 仓库与镜像层的关联标记，表示已确认上游仓库中存在该镜像层，
+//     按镜像层存放，镜像层被淘汰时一起删除
+//   - <CacheDir>/tmp/ 下载中的临时文件
+//
+// 缓存容量同时统计 addDir 加入的目录（manifest 缓存），超出上限时一起按最近使用时间淘汰，
+// 淘汰时扫描和删除文件不持有锁，不阻塞其他请求读写缓存。
+// 镜像层在仓库之间共享，从缓存返回镜像层之前需要确认客户端有权从请求的仓库拉取该镜像层
+type BlobCache struct {
+	log     *logrus.Logger
+	dir     string
+	maxSize int64
+
+	mu       sync.Mutex
+	size     int64
+	dirs     []string // 统计容量和淘汰的目录
+	evicting bool     // 正在淘汰，其间触发的淘汰直接返回
+}
+
+// NewBlobCache 创建镜像层缓存，未开启缓存或缓存目录不可用时返回 nil
+func NewBlobCache(log *logrus.Logger, config *config.Config) *BlobCache {
+	if !config.CacheEnabled {
+		return nil
+	}
+	cache := &BlobCache{
+		log:     log,
+		dir:     config.CacheDir,
+		maxSize: config.CacheMaxSize,
+	}
+	cache.dirs = []string{cache.blobsDir()}
+	// 清理上次进程遗留的临时文件
+	if err := os.RemoveAll(cache.tmpDir()); err != nil {
+		log.WithError(err).Warn("Failed to clean blob cache temp dir")
+	}
+	for _, dir := range []string{cache.blobsDir(), cache.tmpDir()} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			log.WithError(err).WithField("dir", dir).Error("Failed to create blob cache dir, blob cache disabled")
+			return nil
+		}
+	}
+	size, err := scanSize(cache.blobsDir())
+	if err != nil {
+		log.WithError(err).Warn("Failed to scan blob cache size")
+	}
+	cache.size = size
+	log.WithFields(logrus.Fields{
+		"dir":     cache.dir,
+		"size":    size,
+		"maxSize": cache.maxSize,
+	}).Info("Blob cache enabled")
+	return cache
+}
+
+func (c *BlobCache) blobsDir() string {
+	return filepath.Join(c.dir, "blobs")
+}
+
+func (c *BlobCache) tmpDir() string {
+	return filepath.Join(c.dir, "tmp")
+}
+
+func (c *BlobCache) linksDir() string {
+	return filepath.Join(c.dir, "links")
+}
+
+// repositoryPath 将仓库名转换为相对路径，拒绝空路径段和 .、..
+func repositoryPath(name string) (string, error) {
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", fmt.Errorf("invalid repository name: %s", name)
+		}
+	}
+	return filepath.FromSlash(name), nil
+}
+
+// linkPath 获取仓库与镜像层关联标记的路径，仓库名转义为一个路径段
+func (c *BlobCache) linkPath(name, digest string) (string, error) {
+	algorithm, hexValue, err := parseDigest(digest)
+	if err != nil {
+		return "", err
+	}
+	if _, err := repositoryPath(name); err != nil {
+		return "", err
+	}
+	return filepath.Join(c.linksDir(), algorithm, hexValue, url.PathEscape(name)), nil
+}
+
+// Link 记录上游仓库 name 中存在镜像层 digest，name 为带上游名称的缓存仓库名
+func (c *BlobCache) Link(name, digest string) {
+	if c == nil {
+		return
+	}
+	linkPath, err := c.linkPath(name, digest)
+	if err != nil {
+		return
+	}
+	if _, err := os.Stat(linkPath); err == nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(linkPath), 0o755); err == nil {
+		err = os.WriteFile(linkPath, nil, 0o644)
+	}
+	if err != nil {
+		c.log.WithError(err).WithField("path", linkPath).Debug("Failed to link cached blob")
+	}
+}
+
+// Linked 判断是否已确认上游仓库 name 中存在镜像层 digest
+func (c *BlobCache) Linked(name, digest string) bool {
+	if c == nil {
+		return false
+	}
+	linkPath, err := c.linkPath(name, digest)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(linkPath)
+	return err == nil
+}
+
+// blobPath 获取摘要对应的缓存文件路径
+func (c *BlobCache) blobPath(digest string) (string, error) {
+	algorithm, hexValue, err := parseDigest(digest)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(c.blobsDir(), algorithm, hexValue[:2], hexValue), nil
+}
+
+// Open 打开已缓存的镜像层，未命中时返回 os.ErrNotExist
+func (c *BlobCache) Open(digest string) (*os.File, int64, error) {
+	if c == nil {
+		return nil, 0, os.ErrNotExist
+	}
+	blobPath, err := c.blobPath(digest)
+	if err != nil {
+		return nil, 0, err
+	}
+	file, err := os.Open(blobPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	// 更新修改时间，作为淘汰时的最近使用时间
+	now := time.Now()
+	if err := os.Chtimes(blobPath, now, now); err != nil {
+		c.log.WithError(err).WithField("digest", digest).Debug("Failed to touch cached blob")
+	}
+	return file, info.Size(), nil
+}
+
+// Create 创建镜像层缓存写入器，写入完成后需调用 Commit 或 Abort
+func (c *BlobCache) Create(digest string) (*BlobWriter, error) {
+	if c == nil {
+		return nil, fmt.Errorf("blob cache disabled")
+	}
+	writer, err := newBlobWriter(c.tmpDir(), digest)
+	if err != nil {
+		return nil, err
+	}
+	writer.cache = c
+	return writer, nil
+}
+
+// newBlobWriter 在 dir 中创建写入镜像层的临时文件，不属于缓存的写入器 Commit 时只校验摘要，不保留文件
+func newBlobWriter(dir, digest string) (*BlobWriter, error) {
+	algorithm, _, err := parseDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(dir, "blob-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %v", err)
+	}
+	return &BlobWriter{
+		digest: digest,
+		file:   file,
+		hash:   newDigestHash(algorithm),
+	}, nil
+}
+
+// Fits 判断指定大小的镜像层是否可以放入缓存
+func (c *BlobCache) Fits(size int64) bool {
+	return c != nil && (c.maxSize <= 0 || size <= c.maxSize)
+}
+
+// addDir 将目录加入缓存容量统计
+func (c *BlobCache) addDir(dir string) {
+	size, err := scanSize(dir)
+	if err != nil {
+		c.log.WithError(err).WithField("dir", dir).Warn("Failed to scan cache dir size")
+	}
+	c.mu.Lock()
+	c.dirs = append(c.dirs, dir)
+	c.size += size
+	c.mu.Unlock()
+	c.evict()
+}
+
+// added 统计目录中新写入的文件，超出上限时淘汰
+func (c *BlobCache) added(size int64) {
+	c.mu.Lock()
+	c.size += size
+	c.mu.Unlock()
+	c.evict()
+}
+
+// commit 将校验通过的临时文件原子地移动到缓存目录
+func (c *BlobCache) commit(tmpPath, digest string, size int64) error {
+	blobPath, err := c.blobPath(digest)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0o755); err != nil {
+		return fmt.Errorf("failed to create blob dir: %v", err)
+	}
+
+	c.mu.Lock()
+	if _, err := os.Stat(blobPath); err == nil { // 已被其他请求缓存
+		c.mu.Unlock()
+		os.Remove(tmpPath)
+		return nil
+	}
+	if err := os.Rename(tmpPath, blobPath); err != nil {
+		c.mu.Unlock()
+		return fmt.Errorf("failed to commit blob: %v", err)
+	}
+	c.size += size
+	c.mu.Unlock()
+	c.evict()
+	return nil
+}
+
+// evictLowWater 淘汰时将缓存减少到上限的该比例（百分比），留出余量，避免之后每次写入都扫描缓存目录
+const evictLowWater = 90
+
+type cachedBlob struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// evict 缓存超过上限时按最近使用时间淘汰最旧的镜像层和 manifest，直到不超过上限的 evictLowWater%，
+// 同时删除被淘汰镜像层的关联标记。扫描和删除文件时不持有锁，同一时间只有一个淘汰在进行
+func (c *BlobCache) evict() {
+	c.mu.Lock()
+	if c.evicting || c.maxSize <= 0 || c.size <= c.maxSize {
+		c.mu.Unlock()
+		return
+	}
+	c.evicting = true
+	start := c.size
+	dirs := append([]string(nil), c.dirs...)
+	c.mu.Unlock()
+
+	total, err := c.evictFiles(dirs, c.maxSize/100*evictLowWater)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evicting = false
+	if err != nil {
+		c.log.WithError(err).Warn("Failed to scan blob cache for eviction")
+		return
+	}
+	// 以扫描结果校正统计的大小，保留淘汰期间新写入的文件
+	c.size = total + c.size - start
+}
+
+// evictFiles 扫描 dirs 中的文件，按最近使用时间删除最旧的文件直到总大小不超过 target，返回剩余的总大小
+func (c *BlobCache) evictFiles(dirs []string, target int64) (int64, error) {
+	blobs := []cachedBlob{}
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || isTempFile(d) {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			blobs = append(blobs, cachedBlob{path: p, size: info.Size(), modTime: info.ModTime()})
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].modTime.Before(blobs[j].modTime)
+	})
+	var total int64
+	for _, blob := range blobs {
+		total += blob.size
+	}
+	for _, blob := range blobs {
+		if total <= target {
+			break
+		}
+		if err := os.Remove(blob.path); err != nil {
+			c.log.WithError(err).WithField("path", blob.path).Warn("Failed to evict cached blob")
+			continue
+		}
+		total -= blob.size
+		c.removeLinks(blob.path)
+		c.log.WithField("path", blob.path).Debug("Evicted cached blob")
+	}
+	return total, nil
+}
+
+// removeLinks 删除被淘汰的镜像层的关联标记，path 不是镜像层文件时忽略
+func (c *BlobCache) removeLinks(path string) {
+	rel, err := filepath.Rel(c.blobsDir(), path)
+	if err != nil {
+		return
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if len(parts) != 3 || parts[0] == ".." {
+		return
+	}
+	algorithm, hexValue := parts[0], parts[2]
+	if err := os.RemoveAll(filepath.Join(c.linksDir(), algorithm, hexValue)); err != nil {
+		c.log.WithError(err).WithField("digest", algorithm+":"+hexValue).Warn("Failed to remove blob links")
+	}
+}
+
+// isTempFile 判断是否为 writeFileAtomic 写入中的临时文件，临时文件重命名前不计入缓存，也不会被淘汰
+func isTempFile(d fs.DirEntry) bool {
+	return strings.HasPrefix(d.Name(), ".")
+}
+
+// scanSize 统计目录中已有文件的总大小
+func scanSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || isTempFile(d) {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// BlobWriter 镜像层缓存写入器，写入的同时计算摘要
+type BlobWriter struct {
+	cache  *BlobCache
+	digest string
+	file   *os.File
+	hash   hash.Hash
+	size   int64
+	done   bool
+}
+
+// Write 写入数据
+func (w *BlobWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.hash.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+// Commit 校验摘要并提交到缓存，未开启缓存时删除临时文件
+func (w *BlobWriter) Commit() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.file.Name())
+		return fmt.Errorf("failed to close temp file: %v", err)
+	}
+	_, expected, _ := parseDigest(w.digest)
+	if actual := hex.EncodeToString(w.hash.Sum(nil)); actual != expected {
+		os.Remove(w.file.Name())
+		return fmt.Errorf("digest mismatch: expected %s, got %s", expected, actual)
+	}
+	if !w.cache.Fits(w.size) { // 未开启缓存或超出缓存容量，不保留文件
+		return os.Remove(w.file.Name())
+	}
+	return w.cache.commit(w.file.Name(), w.digest, w.size)
+}
+
+// Abort 放弃写入并删除临时文件
+func (w *BlobWriter) Abort() {
+	if w.done {
+		return
+	}
+	w.done = true
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
@@ -0,0 +1,107 @@
+package service
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/yunnysunny/docker-image-proxy/internal/config"
+)
+
+// putTestBlob 写入镜像层并把最近使用时间设为 used，返回摘要
+func putTestBlob(t *testing.T, cache *BlobCache, data []byte, used time.Time) string {
+	t.Helper()
+	digest := digestOf(data)
+	writer, err := cache.Create(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write(data)
+	if err := writer.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	blobPath, _ := cache.blobPath(digest)
+	if err := os.Chtimes(blobPath, used, used); err != nil {
+		t.Fatal(err)
+	}
+	return digest
+}
+
+func cached(cache *BlobCache, digest string) bool {
+	blobPath, _ := cache.blobPath(digest)
+	_, err := os.Stat(blobPath)
+	return err == nil
+}
+
+func TestBlobCacheEvictsToLowWater(t *testing.T) {
+	cache := NewBlobCache(newTestLogger(), &config.Config{CacheEnabled: true, CacheDir: t.TempDir(), CacheMaxSize: 1000})
+	start := time.Now().Add(-time.Hour)
+	digests := []string{}
+	for i := 0; i < 11; i++ {
+		data := bytes.Repeat([]byte(strconv.Itoa(i%10)), 100)
+		data[0] = byte('a' + i)
+		digest := putTestBlob(t, cache, data, start.Add(time.Duration(i)*time.Minute))
+		cache.Link("default/library/nginx", digest)
+		digests = append(digests, digest)
+	}
+	// 超出上限时淘汰最久未使用的镜像层，直到不超过上限的 90%
+	if cache.size != 900 {
+		t.Fatalf("size = %d, want 900", cache.size)
+	}
+	for i, digest := range digests {
+		if want := i >= 2; cached(cache, digest) != want {
+			t.Fatalf("blob %d cached = %v, want %v", i, !want, want)
+		}
+		// 关联标记随镜像层一起淘汰
+		if want := i >= 2; cache.Linked("default/library/nginx", digest) != want {
+			t.Fatalf("blob %d linked = %v, want %v", i, !want, want)
+		}
+	}
+	// 留出的余量内写入不再淘汰
+	putTestBlob(t, cache, bytes.Repeat([]byte("x"), 100), time.Now())
+	if cache.size != 1000 || !cached(cache, digests[2]) {
+		t.Fatalf("size = %d, blob 2 cached = %v", cache.size, cached(cache, digests[2]))
+	}
+}
+
+func TestBlobCacheSkipsTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	cache := NewBlobCache(newTestLogger(), &config.Config{CacheEnabled: true, CacheDir: dir, CacheMaxSize: 100})
+	manifests := filepath.Join(dir, "manifests")
+	old := filepath.Join(manifests, "old")
+	temp := filepath.Join(manifests, ".new-123")
+	if err := os.MkdirAll(manifests, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{old, temp} {
+		if err := os.WriteFile(p, bytes.Repeat([]byte("m"), 80), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	used := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(temp, used, used); err != nil {
+		t.Fatal(err)
+	}
+	cache.addDir(manifests)
+	if cache.size != 80 {
+		t.Fatalf("size = %d, want 80", cache.size)
+	}
+
+	// 写入中的临时文件不计入容量，也不会在重命名之前被淘汰
+	if err := os.Chtimes(old, used.Add(time.Minute), used.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(manifests, "new"), bytes.Repeat([]byte("m"), 80), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cache.added(80)
+	if _, err := os.Stat(temp); err != nil {
+		t.Fatalf("temp file evicted: %v", err)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Fatalf("old manifest not evicted: %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// parseChallenge 解析 WWW-Authenticate 头，返回认证方式和参数，参数值可以是带引号的字符串
+//
+// 格式举例：Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/ubuntu:pull"
+func parseChallenge(header string) (string, map[string]string) {
+	header = strings.TrimSpace(header)
+	scheme, rest, _ := strings.Cut(header, " ")
+	params := make(map[string]string)
+	for rest = strings.TrimSpace(rest); rest != ""; {
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		if strings.HasPrefix(value, "\"") { // 带引号的值中可能包含逗号
+			end := 1
+			for end < len(value) && value[end] != '"' {
+				if value[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			params[key] = strings.ReplaceAll(value[1:min(end, len(value))], "\\\"", "\"")
+			rest = value[min(end+1, len(value)):]
+		} else {
+			value, rest, _ = strings.Cut(value, ",")
+			params[key] = strings.TrimSpace(value)
+		}
+		rest = strings.TrimLeft(strings.TrimSpace(rest), ",")
+		rest = strings.TrimSpace(rest)
+	}
+	return scheme, params
+}
+
+// formatChallenge 生成 WWW-Authenticate 头，realm、service、scope 按固定顺序排在最前
+func formatChallenge(scheme string, params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	order := map[string]int{"realm": 0, "service": 1, "scope": 2}
+	sort.Slice(keys, func(i, j int) bool {
+		oi, iok := order[keys[i]]
+		oj, jok := order[keys[j]]
+		switch {
+		case iok && jok:
+			return oi < oj
+		case iok != jok:
+			return iok
+		default:
+			return keys[i] < keys[j]
+		}
+	})
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%q", key, params[key]))
+	}
+	return scheme + " " + strings.Join(parts, ",")
+}
+
+// RewriteAuthenticateHeader 将上游的 WWW-Authenticate 头中的 realm 改写为当前服务的鉴权地址；
+// name 不为空时将 scope 中的上游仓库名（例如 library/nginx）改写为客户端请求的仓库名，
+// 使客户端换取 token 时使用的仓库名与请求路径一致，其余参数保持不变
+func (s *RegistryService) RewriteAuthenticateHeader(authHeader string, proxyURL string, name string) string {
+	scheme, params := parseChallenge(authHeader)
+	if !strings.EqualFold(scheme, "Bearer") {
+		return authHeader
+	}
+	params["realm"] = proxyURL
+	// scope 中可能包含以空格分隔的多个范围（例如跨仓库挂载），只有一个仓库时才能确定对应关系
+	if scopes, err := ParseScopes([]string{params["scope"]}); err == nil && name != "" &&
+		len(scopes) == 1 && scopes[0].Type == "repository" {
+		scopes[0].Name = name
+		params["scope"] = scopes[0].String()
+	}
+	return formatChallenge(scheme, params)
+}
@@ -0,0 +1,100 @@
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/sirupsen/logrus"
+	"github.com/yunnysunny/docker-image-proxy/internal/config"
+)
+
+// clientCertFieldRegexp 用户模板中引用的证书字段
+var clientCertFieldRegexp = regexp.MustCompile(`\{([a-z]+)\}`)
+
+// clientCertFields 用户模板支持的证书字段，多值字段取第一个值
+var clientCertFields = map[string]func(cert *x509.Certificate) string{
+	"cn":    func(cert *x509.Certificate) string { return cert.Subject.CommonName },
+	"o":     func(cert *x509.Certificate) string { return firstValue(cert.Subject.Organization) },
+	"ou":    func(cert *x509.Certificate) string { return firstValue(cert.Subject.OrganizationalUnit) },
+	"dns":   func(cert *x509.Certificate) string { return firstValue(cert.DNSNames) },
+	"email": func(cert *x509.Certificate) string { return firstValue(cert.EmailAddresses) },
+	"uri": func(cert *x509.Certificate) string {
+		if len(cert.URIs) == 0 {
+			return ""
+		}
+		return cert.URIs[0].String()
+	},
+}
+
+// firstValue 返回第一个值，没有值时为空
+func firstValue(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// ClientCertMapper 将通过校验的 mTLS 客户端证书映射为权限策略中的用户，
+// 映射规则由 TLS_CLIENT_SUBJECT 模板配置，例如 {cn}、agent:{dns}
+type ClientCertMapper struct {
+	log      *logrus.Logger
+	template string
+}
+
+// NewClientCertMapper 创建客户端证书映射，模板引用了不支持的字段时退出
+func NewClientCertMapper(log *logrus.Logger, config *config.Config) *ClientCertMapper {
+	for _, match := range clientCertFieldRegexp.FindAllStringSubmatch(config.TLSClientSubject, -1) {
+		if _, ok := clientCertFields[match[1]]; !ok {
+			log.WithField("field", match[1]).Fatal("Unknown client certificate field in TLS_CLIENT_SUBJECT")
+		}
+	}
+	return &ClientCertMapper{
+		log:      log,
+		template: config.TLSClientSubject,
+	}
+}
+
+// Identify 返回客户端证书映射的用户，模板引用的字段为空时映射失败
+func (m *ClientCertMapper) Identify(cert *x509.Certificate) (string, error) {
+	var missing string
+	subject := clientCertFieldRegexp.ReplaceAllStringFunc(m.template, func(ref string) string {
+		field := ref[1 : len(ref)-1]
+		value := clientCertFields[field](cert)
+		if value == "" {
+			missing = field
+		}
+		return value
+	})
+	if missing != "" {
+		return "", fmt.Errorf("client certificate %q has no %s", cert.Subject.String(), missing)
+	}
+	if subject == "" {
+		return "", fmt.Errorf("client certificate %q maps to empty subject", cert.Subject.String())
+	}
+	return subject, nil
+}
+
+// NewServerTLSConfig 创建服务端 TLS 配置，配置了 TLS_CLIENT_CA_FILE 时请求客户端证书，
+// 客户端提供证书时使用其中的 CA 校验，未提供证书的客户端仍然可以使用账号密码认证
+func NewServerTLSConfig(config *config.Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if config.TLSClientCAFile == "" {
+		return tlsConfig, nil
+	}
+	caData, err := os.ReadFile(config.TLSClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client ca file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caData) {
+		return nil, fmt.Errorf("no certificates found in client ca file: %s", config.TLSClientCAFile)
+	}
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	return tlsConfig, nil
+}
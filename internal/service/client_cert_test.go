@@ -0,0 +1,109 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yunnysunny/docker-image-proxy/internal/config"
+)
+
+func TestClientCertMapperIdentify(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://example.com/agent/build-1")
+	cert := &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:         "build-agent",
+			Organization:       []string{"myorg", "other"},
+			OrganizationalUnit: []string{"ci"},
+		},
+		DNSNames:       []string{"agent-1.ci.example.com", "agent.ci.example.com"},
+		EmailAddresses: []string{"ci@example.com"},
+		URIs:           []*url.URL{spiffe},
+	}
+	tests := []struct {
+		template string
+		subject  string // 为空表示映射失败
+	}{
+		{"{cn}", "build-agent"},
+		{"agent:{dns}", "agent:agent-1.ci.example.com"},
+		{"{o}/{ou}/{cn}", "myorg/ci/build-agent"},
+		{"{email}", "ci@example.com"},
+		{"{uri}", "spiffe://example.com/agent/build-1"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			mapper := NewClientCertMapper(newTestLogger(), &config.Config{TLSClientSubject: tt.template})
+			subject, err := mapper.Identify(cert)
+			if tt.subject == "" {
+				if err == nil {
+					t.Fatalf("Identify() = %q, want error", subject)
+				}
+				return
+			}
+			if err != nil || subject != tt.subject {
+				t.Fatalf("Identify() = %q, %v, want %q", subject, err, tt.subject)
+			}
+		})
+	}
+
+	// 模板引用的字段为空时映射失败，不会得到缺少字段的用户名
+	mapper := NewClientCertMapper(newTestLogger(), &config.Config{TLSClientSubject: "agent:{dns}"})
+	if subject, err := mapper.Identify(&x509.Certificate{Subject: pkix.Name{CommonName: "no-dns"}}); err == nil {
+		t.Fatalf("Identify() = %q, want error for missing field", subject)
+	}
+}
+
+func TestNewServerTLSConfig(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	invalidFile := filepath.Join(dir, "invalid.pem")
+	if err := os.WriteFile(invalidFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tlsConfig, err := NewServerTLSConfig(&config.Config{})
+	if err != nil || tlsConfig.ClientAuth != tls.NoClientCert || tlsConfig.MinVersion != tls.VersionTLS12 {
+		t.Fatalf("without client ca: %+v, %v", tlsConfig, err)
+	}
+	// 未提供证书的客户端仍然可以使用账号密码认证
+	tlsConfig, err = NewServerTLSConfig(&config.Config{TLSClientCAFile: caFile})
+	if err != nil || tlsConfig.ClientAuth != tls.VerifyClientCertIfGiven || tlsConfig.ClientCAs == nil {
+		t.Fatalf("with client ca: %+v, %v", tlsConfig, err)
+	}
+	for _, file := range []string{invalidFile, filepath.Join(dir, "missing.pem")} {
+		if _, err := NewServerTLSConfig(&config.Config{TLSClientCAFile: file}); err == nil {
+			t.Fatalf("NewServerTLSConfig(%s) should fail", file)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// flightCall 一次进行中的调用
+type flightCall struct {
+	wg  sync.WaitGroup
+	val interface{}
+	err error
+}
+
+// flightGroup 合并相同键的并发调用，只有第一个调用真正执行，其余调用等待并共享结果
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+// Do 执行 fn，相同键已有调用在进行时等待其结果
+func (g *flightGroup) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		call.wg.Wait()
+		return call.val, call.err
+	}
+	call := &flightCall{}
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	call.val, call.err = fn()
+	call.wg.Done()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	return call.val, call.err
+}
+
+// blobFetch 一次进行中的上游镜像层下载
+//
+// 下载在后台进行，数据先写入临时文件，所有等待的客户端各自打开该文件，
+// 跟随写入进度读取，下载中途加入的客户端同样从文件开头读取。
+type blobFetch struct {
+	key    string
+	path   string
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	ready   bool  // 已收到上游响应头
+	done    bool  // 下载结束
+	err     error // 下载失败原因
+	size    int64 // 上游声明的大小，未知时为 -1
+	written int64 // 已写入临时文件的字节数
+
+	readers int // 未关闭的读取数，由组锁保护
+}
+
+// blobFetchGroup 合并相同镜像层的并发下载，后加入的客户端从正在写入的临时文件读取；
+// 开启缓存时临时文件位于缓存目录，下载完成后提交到缓存，否则位于 spoolDir，下载完成后删除
+type blobFetchGroup struct {
+	log      *logrus.Logger
+	cache    *BlobCache
+	spoolDir string // 未开启缓存时临时文件所在的目录，为空时使用系统临时目录
+	mu       sync.Mutex
+	fetches  map[string]*blobFetch
+}
+
+func newBlobFetchGroup(log *logrus.Logger, cache *BlobCache) *blobFetchGroup {
+	return &blobFetchGroup{
+		log:     log,
+		cache:   cache,
+		fetches: make(map[string]*blobFetch),
+	}
+}
+
+// create 创建下载使用的临时文件
+func (g *blobFetchGroup) create(digest string) (*BlobWriter, error) {
+	if g.cache != nil {
+		return g.cache.Create(digest)
+	}
+	return newBlobWriter(g.spoolDir, digest)
+}
+
+// Fetch 获取镜像层数据流及大小（未知时为 -1），相同键已有下载在进行时加入该下载，否则使用 do 发送 req 发起新的下载。
+// 摘要在下载结束时校验，不一致时所有客户端读取到错误。
+// 已有的下载使用发起下载的客户端的认证，加入下载或命中刚完成的缓存之前先调用 authorize 确认当前客户端有权访问
+func (g *blobFetchGroup) Fetch(
+	key, digest string, req *http.Request, do func(*http.Request) (*http.Response, error), authorize func() error,
+) (io.ReadCloser, int64, error) {
+	g.mu.Lock()
+	// 加锁后再检查一次缓存，避免刚完成的下载被重复发起
+	if file, size, err := g.cache.Open(digest); err == nil {
+		g.mu.Unlock()
+		if err := authorize(); err != nil {
+			file.Close()
+			return nil, 0, err
+		}
+		return file, size, nil
+	}
+	fetch, ok := g.fetches[key]
+	if ok {
+		// 确认权限时不持有组锁，确认后重新检查，下载可能已经完成
+		g.mu.Unlock()
+		if err := authorize(); err != nil {
+			return nil, 0, err
+		}
+		g.mu.Lock()
+		if file, size, err := g.cache.Open(digest); err == nil {
+			g.mu.Unlock()
+			return file, size, nil
+		}
+		fetch, ok = g.fetches[key]
+	}
+	if !ok {
+		writer, err := g.create(digest)
+		if err != nil {
+			g.mu.Unlock()
+			return nil, 0, err
+		}
+		ctx, cancel := context.WithCancel(req.Context())
+		fetch = &blobFetch{
+			key:    key,
+			path:   writer.file.Name(),
+			cancel: cancel,
+			size:   -1,
+		}
+		fetch.cond = sync.NewCond(&fetch.mu)
+		g.fetches[key] = fetch
+		go g.run(fetch, writer, req.WithContext(ctx), do)
+	}
+	// 在组锁内打开临时文件，保证文件尚未被提交或删除
+	file, err := os.Open(fetch.path)
+	if err != nil {
+		g.mu.Unlock()
+		return nil, 0, fmt.Errorf("failed to open blob temp file: %v", err)
+	}
+	fetch.readers++
+	g.mu.Unlock()
+
+	reader := &blobFetchReader{group: g, fetch: fetch, file: file}
+	// 等待上游响应头，上游返回错误时所有客户端共享该错误
+	fetch.mu.Lock()
+	for !fetch.ready {
+		fetch.cond.Wait()
+	}
+	err, size := fetch.err, fetch.size
+	fetch.mu.Unlock()
+	if err != nil {
+		reader.Close()
+		return nil, 0, err
+	}
+	return reader, size, nil
+}
+
+// run 在后台执行上游下载并写入临时文件
+func (g *blobFetchGroup) run(
+	fetch *blobFetch, writer *BlobWriter, req *http.Request, do func(*http.Request) (*http.Response, error),
+) {
+	logger := g.log.WithField("digest", writer.digest)
+	err := g.download(fetch, writer, req, do)
+
+	// 提交和移出下载列表在组锁内完成，此后到达的请求直接命中缓存
+	g.mu.Lock()
+	if err == nil {
+		err = writer.Commit()
+	} else {
+		writer.Abort()
+	}
+	// 下载可能已因没有客户端读取而被取消并移出列表，此时同一个键可能已有新的下载
+	if g.fetches[fetch.key] == fetch {
+		delete(g.fetches, fetch.key)
+	}
+	g.mu.Unlock()
+	fetch.cancel()
+
+	if err != nil {
+		logger.WithError(err).Warn("Failed to fetch blob from upstream")
+	}
+	fetch.mu.Lock()
+	fetch.ready = true
+	fetch.done = true
+	if fetch.err == nil {
+		fetch.err = err
+	}
+	fetch.cond.Broadcast()
+	fetch.mu.Unlock()
+}
+
+// download 请求上游并将响应体写入临时文件，每写入一段数据通知等待的客户端
+func (g *blobFetchGroup) download(
+	fetch *blobFetch, writer *BlobWriter, req *http.Request, do func(*http.Request) (*http.Response, error),
+) error {
+	resp, err := do(req)
+	if err != nil {
+		err = fmt.Errorf("failed to get blob: %v", err)
+		fetch.fail(err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = newUpstreamError(resp)
+		fetch.fail(err)
+		return err
+	}
+
+	fetch.mu.Lock()
+	fetch.ready = true
+	fetch.size = resp.ContentLength
+	fetch.cond.Broadcast()
+	fetch.mu.Unlock()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := writer.Write(buf[:n]); werr != nil {
+				return fmt.Errorf("failed to write blob temp file: %v", werr)
+			}
+			fetch.mu.Lock()
+			fetch.written += int64(n)
+			fetch.cond.Broadcast()
+			fetch.mu.Unlock()
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return fmt.Errorf("failed to read blob: %v", rerr)
+		}
+	}
+	if fetch.size >= 0 && writer.size != fetch.size {
+		return fmt.Errorf("blob size mismatch: expected %d, got %d", fetch.size, writer.size)
+	}
+	return nil
+}
+
+// fail 在收到响应头之前失败
+func (f *blobFetch) fail(err error) {
+	f.mu.Lock()
+	f.ready = true
+	f.err = err
+	f.cond.Broadcast()
+	f.mu.Unlock()
+}
+
+// release 释放一个读取，未开启缓存时没有客户端继续读取的下载已经没有用处，取消下载并移出列表，
+// 之后到达的请求重新发起下载
+func (g *blobFetchGroup) release(fetch *blobFetch) {
+	g.mu.Lock()
+	fetch.readers--
+	abandoned := fetch.readers == 0 && g.cache == nil && g.fetches[fetch.key] == fetch
+	if abandoned {
+		delete(g.fetches, fetch.key)
+	}
+	g.mu.Unlock()
+	if abandoned {
+		fetch.cancel()
+	}
+}
+
+// blobFetchReader 跟随下载进度读取临时文件
+type blobFetchReader struct {
+	group  *blobFetchGroup
+	fetch  *blobFetch
+	file   *os.File
+	offset int64
+	closed bool
+}
+
+func (r *blobFetchReader) Read(p []byte) (int, error) {
+	fetch := r.fetch
+	fetch.mu.Lock()
+	for fetch.written <= r.offset && !fetch.done {
+		fetch.cond.Wait()
+	}
+	available := fetch.written - r.offset
+	done, err := fetch.done, fetch.err
+	fetch.mu.Unlock()
+
+	if available <= 0 {
+		if err != nil {
+			return 0, err
+		}
+		if done {
+			return 0, io.EOF
+		}
+	}
+	if int64(len(p)) > available {
+		p = p[:available]
+	}
+	n, rerr := r.file.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if rerr == io.EOF && n > 0 {
+		rerr = nil
+	}
+	return n, rerr
+}
+
+// Close 关闭读取，开启缓存时没有客户端继续读取的下载继续进行，完成后写入缓存，
+// 未开启缓存时取消下载
+func (r *blobFetchReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	err := r.file.Close()
+	r.group.release(r.fetch)
+	return err
+}
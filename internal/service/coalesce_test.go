@@ -0,0 +1,306 @@
+package service
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yunnysunny/docker-image-proxy/internal/config"
+)
+
+func newTestBlobFetchGroup(t *testing.T) *blobFetchGroup {
+	t.Helper()
+	cache := NewBlobCache(newTestLogger(), &config.Config{CacheEnabled: true, CacheDir: t.TempDir()})
+	if cache == nil {
+		t.Fatal("blob cache disabled")
+	}
+	return newBlobFetchGroup(newTestLogger(), cache)
+}
+
+// blockingUpstream 模拟上游镜像层下载，发送响应头后等待 release 再发送数据，用于让其他客户端在下载过程中加入
+type blockingUpstream struct {
+	status  int
+	data    []byte
+	calls   atomic.Int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func newBlockingUpstream(status int, data []byte) *blockingUpstream {
+	return &blockingUpstream{status: status, data: data, started: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (u *blockingUpstream) do(req *http.Request) (*http.Response, error) {
+	if u.calls.Add(1) == 1 {
+		close(u.started)
+	}
+	reader, writer := io.Pipe()
+	go func() {
+		select {
+		case <-u.release:
+			writer.Write(u.data)
+			writer.Close()
+		case <-req.Context().Done():
+			writer.CloseWithError(req.Context().Err())
+		}
+	}()
+	return &http.Response{
+		StatusCode:    u.status,
+		ContentLength: int64(len(u.data)),
+		Header:        http.Header{},
+		Body:          reader,
+	}, nil
+}
+
+func readAll(t *testing.T, blob io.ReadCloser) string {
+	t.Helper()
+	defer blob.Close()
+	data, err := io.ReadAll(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func allow() error { return nil }
+
+// readErr 读取完整的镜像层并返回错误，下载在客户端加入前已经结束时错误由 Fetch 直接返回
+func readErr(blob io.ReadCloser, fetchErr error) error {
+	if fetchErr != nil {
+		return fetchErr
+	}
+	defer blob.Close()
+	_, err := io.ReadAll(blob)
+	return err
+}
+
+func TestBlobFetchGroupCoalesces(t *testing.T) {
+	g := newTestBlobFetchGroup(t)
+	data := []byte(strings.Repeat("layer", 1000))
+	digest := digestOf(data)
+	upstream := newBlockingUpstream(http.StatusOK, data)
+
+	const clients = 5
+	var wg sync.WaitGroup
+	results := make([]string, clients)
+	var authorized atomic.Int32
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i > 0 {
+				<-upstream.started
+			}
+			blob, _, err := g.Fetch("app@"+digest, digest, httptest.NewRequest("GET", "/", nil), upstream.do, func() error {
+				authorized.Add(1)
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if i == clients-1 {
+				close(upstream.release)
+			}
+			results[i] = readAll(t, blob)
+		}(i)
+	}
+	wg.Wait()
+
+	if calls := upstream.calls.Load(); calls != 1 {
+		t.Fatalf("upstream calls = %d, want 1", calls)
+	}
+	// 发起下载的客户端由上游校验，其余客户端加入前各自确认权限
+	if n := authorized.Load(); n != clients-1 {
+		t.Fatalf("authorize calls = %d, want %d", n, clients-1)
+	}
+	for i, result := range results {
+		if result != string(data) {
+			t.Fatalf("client %d read %d bytes, want %d", i, len(result), len(data))
+		}
+	}
+	if _, _, err := g.cache.Open(digest); err != nil {
+		t.Fatalf("blob not cached: %v", err)
+	}
+}
+
+func TestBlobFetchGroupAuthorizesJoiners(t *testing.T) {
+	g := newTestBlobFetchGroup(t)
+	data := []byte("private layer")
+	digest := digestOf(data)
+	upstream := newBlockingUpstream(http.StatusOK, data)
+	denied := &UpstreamError{StatusCode: http.StatusUnauthorized}
+
+	first, _, err := g.Fetch("app@"+digest, digest, httptest.NewRequest("GET", "/", nil), upstream.do, func() error {
+		t.Error("authorize called for the client starting the download")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		authorize func() error
+		wantErr   error
+	}{
+		{"unauthorized joiner", func() error { return denied }, denied},
+		{"authorized joiner", allow, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blob, _, err := g.Fetch("app@"+digest, digest, httptest.NewRequest("GET", "/", nil), upstream.do, tt.authorize)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Fetch() err = %v, want %v", err, tt.wantErr)
+			}
+			if blob != nil {
+				blob.Close()
+			}
+		})
+	}
+	close(upstream.release)
+	if got := readAll(t, first); got != string(data) {
+		t.Fatalf("first client read %q", got)
+	}
+
+	// 下载完成后命中缓存同样需要确认权限
+	if _, _, err := g.Fetch("app@"+digest, digest, httptest.NewRequest("GET", "/", nil), upstream.do, func() error {
+		return denied
+	}); !errors.Is(err, denied) {
+		t.Fatalf("cached Fetch() err = %v, want %v", err, denied)
+	}
+	if calls := upstream.calls.Load(); calls != 1 {
+		t.Fatalf("upstream calls = %d, want 1", calls)
+	}
+}
+
+func TestBlobFetchGroupFailures(t *testing.T) {
+	data := []byte("layer")
+	tests := []struct {
+		name    string
+		status  int
+		digest  string
+		openErr bool // 错误在 Fetch 时返回，否则在 Fetch 或读取时返回
+	}{
+		{"upstream error", http.StatusNotFound, digestOf(data), true},
+		{"digest mismatch", http.StatusOK, digestOf([]byte("other")), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newTestBlobFetchGroup(t)
+			upstream := newBlockingUpstream(tt.status, data)
+			close(upstream.release)
+			blob, _, err := g.Fetch("app@"+tt.digest, tt.digest, httptest.NewRequest("GET", "/", nil), upstream.do, allow)
+			if tt.openErr {
+				if upstreamStatus(err) != tt.status {
+					t.Fatalf("Fetch() err = %v, want upstream status %d", err, tt.status)
+				}
+			} else if err = readErr(blob, err); err == nil {
+				t.Fatal("read succeeded, want digest mismatch")
+			}
+			if _, _, err := g.cache.Open(tt.digest); err == nil {
+				t.Fatal("failed download was cached")
+			}
+		})
+	}
+}
+
+func TestBlobFetchGroupWithoutCache(t *testing.T) {
+	g := newBlobFetchGroup(newTestLogger(), nil)
+	g.spoolDir = t.TempDir()
+	data := []byte(strings.Repeat("layer", 1000))
+	digest := digestOf(data)
+	upstream := newBlockingUpstream(http.StatusOK, data)
+
+	const clients = 5
+	var wg sync.WaitGroup
+	results := make([]string, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i > 0 {
+				<-upstream.started
+			}
+			blob, _, err := g.Fetch("app@"+digest, digest, httptest.NewRequest("GET", "/", nil), upstream.do, allow)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if i == clients-1 {
+				close(upstream.release)
+			}
+			results[i] = readAll(t, blob)
+		}(i)
+	}
+	wg.Wait()
+
+	if calls := upstream.calls.Load(); calls != 1 {
+		t.Fatalf("upstream calls = %d, want 1", calls)
+	}
+	for i, result := range results {
+		if result != string(data) {
+			t.Fatalf("client %d read %d bytes, want %d", i, len(result), len(data))
+		}
+	}
+	// 未开启缓存时下载完成后不保留临时文件，再次请求重新下载
+	if entries, err := os.ReadDir(g.spoolDir); err != nil || len(entries) != 0 {
+		t.Fatalf("spool dir entries = %v, err = %v, want empty", entries, err)
+	}
+
+	// 摘要不一致时读取失败
+	mismatch := newBlockingUpstream(http.StatusOK, data)
+	close(mismatch.release)
+	other := digestOf([]byte("other"))
+	blob, _, err := g.Fetch("app@"+other, other, httptest.NewRequest("GET", "/", nil), mismatch.do, allow)
+	if err = readErr(blob, err); err == nil {
+		t.Fatal("read succeeded, want digest mismatch")
+	}
+}
+
+func TestBlobFetchGroupWithoutCacheCancelsAbandoned(t *testing.T) {
+	g := newBlobFetchGroup(newTestLogger(), nil)
+	g.spoolDir = t.TempDir()
+	data := []byte("layer")
+	digest := digestOf(data)
+	upstream := newBlockingUpstream(http.StatusOK, data)
+
+	blob, _, err := g.Fetch("app@"+digest, digest, httptest.NewRequest("GET", "/", nil), upstream.do, allow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 唯一的客户端关闭后下载被取消，临时文件被删除
+	blob.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		entries, err := os.ReadDir(g.spoolDir)
+		if err == nil && len(entries) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("spool dir entries = %v, err = %v, want empty", entries, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// 再次请求重新发起下载
+	retry := newBlockingUpstream(http.StatusOK, data)
+	close(retry.release)
+	blob, _, err = g.Fetch("app@"+digest, digest, httptest.NewRequest("GET", "/", nil), retry.do, allow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, blob); got != string(data) {
+		t.Fatalf("retry read %q", got)
+	}
+	if calls := retry.calls.Load(); calls != 1 {
+		t.Fatalf("retry upstream calls = %d, want 1", calls)
+	}
+}
@@ -0,0 +1,381 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/yunnysunny/docker-image-proxy/internal/config"
+)
+
+// 凭据类型
+const (
+	CredentialRobot = "robot" // 机器人账号，使用 robot$<name> 作为用户名
+	CredentialToken = "token" // 个人访问令牌，使用所属用户的用户名
+)
+
+const (
+	// credentialPrefix 凭据密钥的前缀，便于识别密钥和在代码仓库中扫描泄露的密钥
+	credentialPrefix = "dip_"
+	// RobotUsernamePrefix 机器人账号的用户名前缀，机器人账号在权限策略中的用户名同样带有此前缀
+	RobotUsernamePrefix = "robot$"
+	// credentialTouchInterval 最近使用时间写入文件的最小间隔，避免每次认证都写文件
+	credentialTouchInterval = time.Minute
+)
+
+// robotNameRegexp 机器人账号名称格式
+var robotNameRegexp = regexp.MustCompile(`^[a-z0-9]+([._-][a-z0-9]+)*$`)
+
+var (
+	// ErrCredentialNotFound 凭据不存在
+	ErrCredentialNotFound = errors.New("credential not found")
+	// ErrInvalidCredentialRequest 创建凭据的参数错误
+	ErrInvalidCredentialRequest = errors.New("invalid credential request")
+)
+
+// CredentialScope 凭据的权限上限，格式同权限策略的规则，签发 token 时授予的操作不超过权限上限和权限策略的交集
+type CredentialScope struct {
+	Repositories []string `json:"repositories"`
+	Actions      []string `json:"actions"`
+}
+
+// Credential 机器人账号或个人访问令牌，只保存密钥的摘要
+type Credential struct {
+	ID         string            `json:"id"`
+	Kind       string            `json:"kind"`
+	Name       string            `json:"name"`            // 机器人账号名称或访问令牌的描述
+	Owner      string            `json:"owner,omitempty"` // 访问令牌所属的用户
+	Scopes     []CredentialScope `json:"scopes"`
+	Hash       string            `json:"hash,omitempty"` // 密钥的 SHA-256 摘要，密钥为高强度随机数，不需要慢哈希
+	CreatedAt  time.Time         `json:"createdAt"`
+	ExpiresAt  time.Time         `json:"expiresAt"`
+	LastUsedAt *time.Time        `json:"lastUsedAt,omitempty"`
+}
+
+// Subject 凭据在权限策略中对应的用户，机器人账号为 robot$<name>，访问令牌为所属用户
+func (c *Credential) Subject() string {
+	if c.Kind == CredentialRobot {
+		return RobotUsernamePrefix + c.Name
+	}
+	return c.Owner
+}
+
+// Limit 将鉴权范围中请求的操作限制在权限上限内
+func (c *Credential) Limit(scopes []Scope) []Scope {
+	rules := make([]PolicyRule, 0, len(c.Scopes))
+	for _, scope := range c.Scopes {
+		rules = append(rules, PolicyRule{Subjects: []string{"*"}, Repositories: scope.Repositories, Actions: scope.Actions})
+	}
+	ceiling := &Policy{config: &PolicyConfig{DefaultDeny: true, Rules: rules}}
+	limited := make([]Scope, 0, len(scopes))
+	for _, scope := range scopes {
+		scope.Actions = grantActions(scope.Actions, ceiling.Actions("", scope.Type, scope.policyName()))
+		limited = append(limited, scope)
+	}
+	return limited
+}
+
+// Allows 判断权限上限是否允许对指定资源执行指定操作
+func (c *Credential) Allows(typ, name, action string) bool {
+	limited := c.Limit([]Scope{{Type: typ, Name: name, Actions: []string{action}}})
+	return len(limited[0].Actions) > 0
+}
+
+// CreateCredentialRequest 创建凭据的参数
+type CreateCredentialRequest struct {
+	Kind      string            `json:"kind"`
+	Name      string            `json:"name"`
+	Owner     string            `json:"owner"`
+	Scopes    []CredentialScope `json:"scopes"`
+	ExpiresAt time.Time         `json:"expiresAt"`
+}
+
+// CredentialStore 机器人账号和个人访问令牌，保存在 CREDENTIALS_FILE 中，文件被其他进程修改后自动重新加载，
+// 修改时持有文件锁并在最新的文件内容上修改，同一主机上的多个代理副本可以共享同一个文件
+type CredentialStore struct {
+	log  *logrus.Logger
+	path string
+
+	mu          sync.RWMutex
+	modTime     time.Time
+	credentials map[string]*Credential // id -> 凭据
+}
+
+// NewCredentialStore 加载凭据文件，文件不存在时视为空；CREDENTIALS_FILE 默认为 data/credentials.json，
+// 设置为空时只保存在内存中，重启后丢失
+func NewCredentialStore(log *logrus.Logger, config *config.Config) *CredentialStore {
+	store := &CredentialStore{
+		log:         log,
+		path:        config.CredentialsFile,
+		credentials: map[string]*Credential{},
+	}
+	if err := store.reloadIfChanged(); err != nil {
+		log.WithError(err).WithField("file", store.path).Fatal("Failed to load credentials file")
+	}
+	return store
+}
+
+// Create 创建凭据，返回凭据和密钥，密钥只在创建时返回一次
+func (s *CredentialStore) Create(req CreateCredentialRequest) (*Credential, string, error) {
+	switch req.Kind {
+	case CredentialRobot:
+		if !robotNameRegexp.MatchString(req.Name) {
+			return nil, "", fmt.Errorf("%w: invalid robot name %q", ErrInvalidCredentialRequest, req.Name)
+		}
+		req.Owner = ""
+	case CredentialToken:
+		if req.Owner == "" {
+			return nil, "", fmt.Errorf("%w: owner is required", ErrInvalidCredentialRequest)
+		}
+		if req.Name == "" {
+			return nil, "", fmt.Errorf("%w: name is required", ErrInvalidCredentialRequest)
+		}
+	default:
+		return nil, "", fmt.Errorf("%w: unknown kind %q", ErrInvalidCredentialRequest, req.Kind)
+	}
+	if !req.ExpiresAt.After(time.Now()) {
+		return nil, "", fmt.Errorf("%w: expiresAt must be in the future", ErrInvalidCredentialRequest)
+	}
+	if len(req.Scopes) == 0 {
+		return nil, "", fmt.Errorf("%w: scopes is required", ErrInvalidCredentialRequest)
+	}
+	for i, scope := range req.Scopes {
+		for _, action := range scope.Actions {
+			switch action {
+			case ActionPull, ActionPush, ActionDelete, ActionCatalog, ActionAll:
+			default:
+				return nil, "", fmt.Errorf("%w: scope %d: unknown action %q", ErrInvalidCredentialRequest, i, action)
+			}
+		}
+	}
+
+	id, err := randomString(6, hex.EncodeToString)
+	if err != nil {
+		return nil, "", err
+	}
+	random, err := randomString(32, base64.RawURLEncoding.EncodeToString)
+	if err != nil {
+		return nil, "", err
+	}
+	secret := credentialPrefix + id + "_" + random
+	sum := sha256.Sum256([]byte(secret))
+	credential := &Credential{
+		ID:        id,
+		Kind:      req.Kind,
+		Name:      req.Name,
+		Owner:     req.Owner,
+		Scopes:    req.Scopes,
+		Hash:      hex.EncodeToString(sum[:]),
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: req.ExpiresAt.UTC(),
+	}
+	err = s.update(func(credentials map[string]*Credential) error {
+		for _, existing := range credentials {
+			if credential.Kind == CredentialRobot && existing.Kind == CredentialRobot && existing.Name == credential.Name {
+				return fmt.Errorf("%w: robot %s already exists", ErrInvalidCredentialRequest, credential.Name)
+			}
+		}
+		credentials[credential.ID] = credential
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return credential.public(), secret, nil
+}
+
+// List 返回凭据列表，owner 不为空时只返回该用户的访问令牌
+func (s *CredentialStore) List(owner string) []*Credential {
+	if err := s.reloadIfChanged(); err != nil {
+		s.log.WithError(err).WithField("file", s.path).Error("Failed to reload credentials file, using previous credentials")
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := []*Credential{}
+	for _, credential := range s.credentials {
+		if owner == "" || (credential.Kind == CredentialToken && credential.Owner == owner) {
+			list = append(list, credential.public())
+		}
+	}
+	return list
+}
+
+// Delete 删除凭据，owner 不为空时只能删除该用户的访问令牌
+func (s *CredentialStore) Delete(id, owner string) error {
+	return s.update(func(credentials map[string]*Credential) error {
+		credential, ok := credentials[id]
+		if !ok || (owner != "" && (credential.Kind != CredentialToken || credential.Owner != owner)) {
+			return ErrCredentialNotFound
+		}
+		delete(credentials, id)
+		return nil
+	})
+}
+
+// IsCredential 判断密码是否为凭据密钥
+func IsCredential(password string) bool {
+	return strings.HasPrefix(password, credentialPrefix)
+}
+
+// Verify 校验用户名和凭据密钥，成功时返回凭据并记录最近使用时间，凭据已过期时校验失败
+func (s *CredentialStore) Verify(username, secret string) (*Credential, bool) {
+	if err := s.reloadIfChanged(); err != nil {
+		s.log.WithError(err).WithField("file", s.path).Error("Failed to reload credentials file, using previous credentials")
+	}
+	id, _, _ := strings.Cut(strings.TrimPrefix(secret, credentialPrefix), "_")
+	sum := sha256.Sum256([]byte(secret))
+	s.mu.RLock()
+	credential, ok := s.credentials[id]
+	var expected []byte
+	if ok {
+		expected, _ = hex.DecodeString(credential.Hash)
+	}
+	s.mu.RUnlock()
+	// 凭据不存在时同样执行比较，使耗时一致
+	if !ok {
+		expected = make([]byte, sha256.Size)
+	}
+	if subtle.ConstantTimeCompare(sum[:], expected) != 1 || !ok {
+		return nil, false
+	}
+	if credential.Subject() != username {
+		return nil, false
+	}
+	if !time.Now().Before(credential.ExpiresAt) {
+		return nil, false
+	}
+	s.touch(credential)
+	return credential.public(), true
+}
+
+// touch 记录凭据的最近使用时间，距上次记录不足 credentialTouchInterval 时不写文件
+func (s *CredentialStore) touch(credential *Credential) {
+	now := time.Now().UTC()
+	if credential.LastUsedAt != nil && now.Sub(*credential.LastUsedAt) < credentialTouchInterval {
+		return
+	}
+	err := s.update(func(credentials map[string]*Credential) error {
+		if current, ok := credentials[credential.ID]; ok {
+			current.LastUsedAt = &now
+		}
+		return nil
+	})
+	if err != nil {
+		s.log.WithError(err).WithField("id", credential.ID).Warn("Failed to record credential last used time")
+	}
+}
+
+// public 返回不含密钥摘要的副本
+func (c *Credential) public() *Credential {
+	copied := *c
+	copied.Hash = ""
+	return &copied
+}
+
+// update 在最新的凭据上执行修改后写回文件，fn 返回错误时不修改
+func (s *CredentialStore) update(fn func(credentials map[string]*Credential) error) error {
+	if s.path != "" {
+		unlock, err := lockFile(s.path)
+		if err != nil {
+			return fmt.Errorf("failed to lock credentials file: %v", err)
+		}
+		defer unlock()
+		// 修改时间的精度有限，持有锁后总是重新读取，避免覆盖其他进程的修改
+		if err := s.load(); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	credentials := make(map[string]*Credential, len(s.credentials))
+	for id, credential := range s.credentials {
+		copied := *credential
+		credentials[id] = &copied
+	}
+	if err := fn(credentials); err != nil {
+		return err
+	}
+	if s.path != "" {
+		data, err := json.MarshalIndent(credentials, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(s.path, data, 0o600); err != nil {
+			return fmt.Errorf("failed to save credentials file: %v", err)
+		}
+		if info, err := os.Stat(s.path); err == nil {
+			s.modTime = info.ModTime()
+		}
+	}
+	s.credentials = credentials
+	return nil
+}
+
+// reloadIfChanged 文件修改时间变化时重新加载
+func (s *CredentialStore) reloadIfChanged() error {
+	if s.path == "" {
+		return nil
+	}
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.mu.RLock()
+	changed := !info.ModTime().Equal(s.modTime)
+	s.mu.RUnlock()
+	if !changed {
+		return nil
+	}
+	return s.load()
+}
+
+// load 读取凭据文件，文件不存在时保持当前凭据
+func (s *CredentialStore) load() error {
+	info, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	raw, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	credentials := map[string]*Credential{}
+	if err := json.Unmarshal(raw, &credentials); err != nil {
+		return fmt.Errorf("failed to parse credentials file: %v", err)
+	}
+	s.mu.Lock()
+	s.credentials = credentials
+	s.modTime = info.ModTime()
+	s.mu.Unlock()
+	s.log.WithFields(logrus.Fields{
+		"file":        s.path,
+		"credentials": len(credentials),
+	}).Info("Credentials file loaded")
+	return nil
+}
+
+// randomString 生成 n 字节的随机数并编码
+func randomString(n int, encode func([]byte) string) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate random bytes: %v", err)
+	}
+	return encode(buf), nil
+}
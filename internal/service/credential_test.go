@@ -0,0 +1,66 @@
+package service
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yunnysunny/docker-image-proxy/internal/config"
+)
+
+func TestCredentialStoreConcurrentWriters(t *testing.T) {
+	cfg := &config.Config{CredentialsFile: filepath.Join(t.TempDir(), "credentials.json")}
+	// 两个实例模拟共享同一个文件的两个进程
+	stores := []*CredentialStore{NewCredentialStore(newTestLogger(), cfg), NewCredentialStore(newTestLogger(), cfg)}
+
+	const perStore = 10
+	var wg sync.WaitGroup
+	for i, store := range stores {
+		wg.Add(1)
+		go func(i int, store *CredentialStore) {
+			defer wg.Done()
+			for j := 0; j < perStore; j++ {
+				_, _, err := store.Create(CreateCredentialRequest{
+					Kind:      CredentialRobot,
+					Name:      fmt.Sprintf("builder-%d-%d", i, j),
+					Scopes:    []CredentialScope{{Repositories: []string{"myorg/**"}, Actions: []string{ActionPull}}},
+					ExpiresAt: time.Now().Add(time.Hour),
+				})
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}(i, store)
+	}
+	wg.Wait()
+
+	reloaded := NewCredentialStore(newTestLogger(), cfg)
+	if credentials := reloaded.List(""); len(credentials) != len(stores)*perStore {
+		t.Fatalf("credentials = %d, want %d", len(credentials), len(stores)*perStore)
+	}
+}
+
+func TestCredentialLimit(t *testing.T) {
+	credential := &Credential{Scopes: []CredentialScope{
+		{Repositories: []string{"myorg/**"}, Actions: []string{"pull", "push"}},
+		{Repositories: []string{"library/*"}, Actions: []string{"pull"}},
+	}}
+	tests := []struct {
+		name   string
+		action string
+		allows bool
+	}{
+		{"myorg/team/app", "push", true},
+		{"myorg/app", "delete", false},
+		{"library/nginx", "pull", true},
+		{"library/nginx", "push", false},
+		{"other/app", "pull", false},
+	}
+	for _, tt := range tests {
+		if allows := credential.Allows("repository", tt.name, tt.action); allows != tt.allows {
+			t.Errorf("Allows(%s, %s) = %v, want %v", tt.name, tt.action, allows, tt.allows)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package service
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"regexp"
+)
+
+// digestRegexp 镜像内容摘要格式，例如 sha256:<64位十六进制>
+var digestRegexp = regexp.MustCompile(`^(sha256|sha512):([a-f0-9]+)$`)
+
+// parseDigest 解析摘要，返回算法和十六进制值
+func parseDigest(digest string) (string, string, error) {
+	matches := digestRegexp.FindStringSubmatch(digest)
+	if matches == nil {
+		return "", "", fmt.Errorf("invalid digest: %s", digest)
+	}
+	algorithm, hexValue := matches[1], matches[2]
+	if len(hexValue) != newDigestHash(algorithm).Size()*2 {
+		return "", "", fmt.Errorf("invalid digest length: %s", digest)
+	}
+	return algorithm, hexValue, nil
+}
+
+// newDigestHash 根据摘要算法创建哈希对象
+func newDigestHash(algorithm string) hash.Hash {
+	if algorithm == "sha512" {
+		return sha512.New()
+	}
+	return sha256.New()
+}
+
+// SupportedDigest 判断摘要是否使用支持的算法（sha256、sha512）且格式正确，
+// 路由只检查 Distribution 规范的摘要格式，不支持的算法无法校验内容
+func SupportedDigest(digest string) bool {
+	_, _, err := parseDigest(digest)
+	return err == nil
+}
+
+// isDigest 判断镜像引用是否为摘要形式
+func isDigest(reference string) bool {
+	return SupportedDigest(reference)
+}
+
+// digestOf 计算数据的 sha256 摘要
+func digestOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// verifyDigest 校验数据与摘要是否一致
+func verifyDigest(digest string, data []byte) error {
+	algorithm, expected, err := parseDigest(digest)
+	if err != nil {
+		return err
+	}
+	hash := newDigestHash(algorithm)
+	hash.Write(data)
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != expected {
+		return fmt.Errorf("digest mismatch: expected %s, got %s:%s", digest, algorithm, actual)
+	}
+	return nil
+}
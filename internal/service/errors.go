@@ -0,0 +1,31 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// maxErrorBodySize 读取上游错误响应体的最大字节数
+const maxErrorBodySize = 64 * 1024
+
+// UpstreamError 上游仓库返回的非成功响应，保留状态码、响应头和响应体以便原样返回给客户端
+type UpstreamError struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// newUpstreamError 根据上游响应创建错误，调用方负责关闭响应体
+func newUpstreamError(resp *http.Response) *UpstreamError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+	return &UpstreamError{
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header.Clone(),
+		Body:       body,
+	}
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("unexpected status code: %d", e.StatusCode)
+}
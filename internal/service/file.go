@@ -0,0 +1,38 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic 写入临时文件后重命名，保证其他进程不会读到不完整的文件，目录不存在时自动创建
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create dir: %v", err)
+	}
+	file, err := os.CreateTemp(dir, "."+filepath.Base(path)+"-")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %v", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return fmt.Errorf("failed to write file: %v", err)
+	}
+	if err := file.Chmod(perm); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return fmt.Errorf("failed to write file: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("failed to write file: %v", err)
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("failed to save file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package service
+
+// lockFile 当前平台不支持 flock，只能由单个进程修改共享文件
+func lockFile(path string) (func(), error) {
+	return func() {}, nil
+}
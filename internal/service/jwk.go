@@ -0,0 +1,240 @@
+package service
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWK JSON Web Key（RFC 7517），只包含公钥参数
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	// RSA 公钥
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC 公钥
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKSet JWK 集合，即 /.well-known/jwks.json 的响应内容
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+var b64 = base64.RawURLEncoding
+
+// newJWK 根据公钥生成 JWK，kid 使用 RFC 7638 的 JWK Thumbprint
+func newJWK(public crypto.PublicKey, alg string) (JWK, error) {
+	var jwk JWK
+	switch key := public.(type) {
+	case *rsa.PublicKey:
+		jwk = JWK{
+			Kty: "RSA",
+			N:   b64.EncodeToString(key.N.Bytes()),
+			E:   b64.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		jwk = JWK{
+			Kty: "EC",
+			Crv: key.Curve.Params().Name,
+			X:   b64.EncodeToString(key.X.FillBytes(make([]byte, size))),
+			Y:   b64.EncodeToString(key.Y.FillBytes(make([]byte, size))),
+		}
+	default:
+		return JWK{}, fmt.Errorf("unsupported public key type %T", public)
+	}
+	jwk.Use = "sig"
+	jwk.Alg = alg
+	jwk.Kid = jwk.Thumbprint()
+	return jwk, nil
+}
+
+// Thumbprint 计算 RFC 7638 JWK Thumbprint（SHA-256），只使用必需的参数并按字典序排列
+func (k JWK) Thumbprint() string {
+	var data []byte
+	switch k.Kty {
+	case "RSA":
+		data, _ = json.Marshal(struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{k.E, k.Kty, k.N})
+	case "EC":
+		data, _ = json.Marshal(struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{k.Crv, k.Kty, k.X, k.Y})
+	}
+	sum := sha256.Sum256(data)
+	return b64.EncodeToString(sum[:])
+}
+
+// PublicKey 将 JWK 转换为公钥
+func (k JWK) PublicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := b64.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwk n: %v", err)
+		}
+		e, err := b64.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwk e: %v", err)
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		curve, err := curveByName(k.Crv)
+		if err != nil {
+			return nil, err
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwk x: %v", err)
+		}
+		y, err := b64.DecodeString(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwk y: %v", err)
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("invalid jwk: point is not on curve")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported jwk kty %q", k.Kty)
+}
+
+func curveByName(name string) (elliptic.Curve, error) {
+	switch name {
+	case "P-256":
+		return elliptic.P256(), nil
+	case "P-384":
+		return elliptic.P384(), nil
+	case "P-521":
+		return elliptic.P521(), nil
+	}
+	return nil, fmt.Errorf("unsupported curve %q", name)
+}
+
+// signingMethodFor 根据密钥类型选择签名算法：RSA 使用 RS256，EC 按曲线使用 ES256、ES384、ES512
+func signingMethodFor(public crypto.PublicKey) (jwt.SigningMethod, error) {
+	switch key := public.(type) {
+	case *rsa.PublicKey:
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return jwt.SigningMethodES256, nil
+		case elliptic.P384():
+			return jwt.SigningMethodES384, nil
+		case elliptic.P521():
+			return jwt.SigningMethodES512, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported key type %T", public)
+}
+
+// parsePrivateKey 解析 PEM 块中的私钥，支持 PKCS#8、PKCS#1（RSA）和 SEC 1（EC），不是私钥时返回 nil
+func parsePrivateKey(block *pem.Block) (crypto.Signer, error) {
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+		return signer, nil
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	return nil, nil
+}
+
+// loadPrivateKey 读取 PEM 文件中的第一个私钥
+func loadPrivateKey(file string) (crypto.Signer, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		signer, err := parsePrivateKey(block)
+		if err != nil {
+			return nil, err
+		}
+		if signer != nil {
+			return signer, nil
+		}
+	}
+	return nil, errors.New("no private key found in pem file")
+}
+
+// loadPublicKeys 读取 PEM 文件中的全部公钥，支持公钥、证书和私钥（使用其公钥）
+func loadPublicKeys(file string) ([]crypto.PublicKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	keys := []crypto.PublicKey{}
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		case "RSA PUBLIC KEY":
+			key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, key)
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, cert.PublicKey)
+		default:
+			signer, err := parsePrivateKey(block)
+			if err != nil {
+				return nil, err
+			}
+			if signer != nil {
+				keys = append(keys, signer.Public())
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no public key found in pem file")
+	}
+	return keys, nil
+}
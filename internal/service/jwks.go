@@ -0,0 +1,169 @@
+package service
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// keySetRefreshInterval 远程 JWKS 的刷新间隔
+	keySetRefreshInterval = time.Hour
+	// keySetMinRefreshInterval 遇到未知 kid 时重新获取远程 JWKS 的最小间隔，避免伪造的 kid 导致频繁请求
+	keySetMinRefreshInterval = time.Minute
+)
+
+// KeySet 用于校验第三方签发的 JWT 的公钥集合，公钥来自本地 JWKS 文件或远程 JWKS 地址，
+// 远程地址的公钥定期刷新，遇到未知的 kid 时也会重新获取，以便对方轮换密钥
+type KeySet struct {
+	log    *logrus.Logger
+	url    string
+	client *http.Client
+
+	mu        sync.RWMutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+// NewKeySet 创建公钥集合，file 不为空时立即加载，url 不为空时在首次使用时获取
+func NewKeySet(log *logrus.Logger, url, file string, client *http.Client) (*KeySet, error) {
+	if url == "" && file == "" {
+		return nil, errors.New("jwks url or file is required")
+	}
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	keySet := &KeySet{
+		log:    log,
+		url:    url,
+		client: client,
+		keys:   map[string]crypto.PublicKey{},
+	}
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		keys, err := keySet.parse(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse jwks file %s: %v", file, err)
+		}
+		keySet.keys = keys
+	}
+	return keySet, nil
+}
+
+// Key 根据 kid 获取公钥，kid 为空且集合中只有一个公钥时返回该公钥
+func (k *KeySet) Key(kid string) (crypto.PublicKey, error) {
+	if key, ok := k.lookup(kid); ok {
+		return key, nil
+	}
+	if k.url == "" {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	k.mu.RLock()
+	fetchedAt := k.fetchedAt
+	k.mu.RUnlock()
+	if time.Since(fetchedAt) < keySetMinRefreshInterval {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	if err := k.refresh(); err != nil {
+		return nil, err
+	}
+	if key, ok := k.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+// lookup 在已加载的公钥中查找，远程公钥过期时先刷新
+func (k *KeySet) lookup(kid string) (crypto.PublicKey, bool) {
+	k.mu.RLock()
+	expired := k.url != "" && time.Since(k.fetchedAt) > keySetRefreshInterval
+	k.mu.RUnlock()
+	if expired {
+		if err := k.refresh(); err != nil {
+			k.log.WithError(err).WithField("url", k.url).Warn("Failed to refresh jwks, using cached keys")
+		}
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if kid == "" {
+		if len(k.keys) == 1 {
+			for _, key := range k.keys {
+				return key, true
+			}
+		}
+		return nil, false
+	}
+	key, ok := k.keys[kid]
+	return key, ok
+}
+
+// refresh 从远程地址获取 JWKS，获取失败时保留原有公钥
+func (k *KeySet) refresh() error {
+	k.mu.Lock()
+	// 无论成功与否都记录获取时间，避免上游不可用时每个请求都重新获取
+	k.fetchedAt = time.Now()
+	k.mu.Unlock()
+
+	resp, err := k.client.Get(k.url)
+	if err != nil {
+		return fmt.Errorf("failed to get jwks: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to get jwks: unexpected status code: %d", resp.StatusCode)
+	}
+	var raw json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return fmt.Errorf("failed to decode jwks: %v", err)
+	}
+	keys, err := k.parse(raw)
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	k.keys = keys
+	k.mu.Unlock()
+	k.log.WithFields(logrus.Fields{
+		"url":  k.url,
+		"keys": len(keys),
+	}).Debug("Jwks refreshed")
+	return nil
+}
+
+// parse 解析 JWKS，跳过不支持的公钥类型
+func (k *KeySet) parse(data []byte) (map[string]crypto.PublicKey, error) {
+	var set JWKSet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.PublicKey()
+		if err != nil {
+			k.log.WithError(err).WithField("kid", jwk.Kid).Debug("Unsupported jwk, skipped")
+			continue
+		}
+		kid := jwk.Kid
+		if kid == "" {
+			kid = jwk.Thumbprint()
+		}
+		keys[kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no supported keys in jwks")
+	}
+	return keys, nil
+}
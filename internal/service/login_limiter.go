@@ -0,0 +1,207 @@
+package service
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/yunnysunny/docker-image-proxy/internal/config"
+)
+
+// loginLimiterPruneInterval 清理过期失败记录的最小间隔
+const loginLimiterPruneInterval = time.Minute
+
+// LoginLockedError 客户端认证失败次数过多，需要等待 RetryAfter 后重试
+type LoginLockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LoginLockedError) Error() string {
+	return fmt.Sprintf("too many failed login attempts, retry after %s", e.RetryAfter)
+}
+
+// RetryAfterHeader Retry-After 响应头的值，秒数向上取整且至少为 1，客户端按该值等待后不会仍被拒绝
+func (e *LoginLockedError) RetryAfterHeader() string {
+	return strconv.Itoa(max(int(math.Ceil(e.RetryAfter.Seconds())), 1))
+}
+
+// loginFailures 用户名或来源 IP 的连续认证失败记录
+type loginFailures struct {
+	count       int
+	pending     int // 已通过 Check、尚未得到结果的认证次数
+	lastFailure time.Time
+	blockedTill time.Time // 退避或锁定结束时间
+}
+
+// LoginLimiter 按用户名和来源 IP 统计连续认证失败次数，防止暴力破解密码：
+//   - 每次失败后需要等待的时间按 LOGIN_BACKOFF 指数增长，不超过 LOGIN_LOCKOUT
+//   - 失败次数达到阈值后锁定 LOGIN_LOCKOUT，锁定期间即使密码正确也拒绝认证
+//   - 认证成功后清除用户名的失败记录，最后一次失败超过 LOGIN_LOCKOUT 后失败记录过期
+//   - 已有失败记录时，Check 通过时预占一次失败次数，直到 Failure 或 Success 返回结果，
+//     并发的认证请求合计不超过剩余的失败次数，不能同时绕过退避和锁定；
+//     没有失败记录时不限制并发，同一用户并行拉取镜像层不会被拒绝
+//
+// 失败记录只保存在内存中，多个副本分别统计
+type LoginLimiter struct {
+	log           *logrus.Logger
+	maxFailures   int // 用户名的锁定阈值，0 表示不限制
+	ipMaxFailures int // 来源 IP 的锁定阈值，0 表示不限制
+	backoff       time.Duration
+	lockout       time.Duration
+
+	mu        sync.Mutex
+	usernames map[string]*loginFailures
+	ips       map[string]*loginFailures
+	prunedAt  time.Time
+}
+
+// NewLoginLimiter 创建认证失败限制器
+func NewLoginLimiter(log *logrus.Logger, config *config.Config) *LoginLimiter {
+	return &LoginLimiter{
+		log:           log,
+		maxFailures:   config.LoginMaxFailures,
+		ipMaxFailures: config.LoginIPMaxFailures,
+		backoff:       config.LoginBackoff,
+		lockout:       config.LoginLockout,
+		usernames:     make(map[string]*loginFailures),
+		ips:           make(map[string]*loginFailures),
+	}
+}
+
+// Check 认证前检查用户名和来源 IP 是否处于退避或锁定中，是时返回 *LoginLockedError；
+// 通过时预占本次认证，调用方需在得到结果后调用 Failure 或 Success
+func (l *LoginLimiter) Check(username, ip string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	var wait time.Duration
+	for _, failures := range []*loginFailures{l.usernames[username], l.ips[ip]} {
+		if failures != nil && failures.blockedTill.Sub(now) > wait {
+			wait = failures.blockedTill.Sub(now)
+		}
+	}
+	// 进行中的认证已占满剩余的失败次数，等待其结果
+	if wait <= 0 && (l.exhausted(l.usernames[username], l.maxFailures, now) ||
+		l.exhausted(l.ips[ip], l.ipMaxFailures, now)) {
+		wait = l.backoff
+	}
+	if wait > 0 {
+		// Retry-After 以秒为单位，向上取整
+		return &LoginLockedError{RetryAfter: (wait + time.Second - 1).Truncate(time.Second)}
+	}
+	l.reserve(l.usernames, username, l.maxFailures)
+	l.reserve(l.ips, ip, l.ipMaxFailures)
+	return nil
+}
+
+// Failure 记录一次认证失败，失败次数达到阈值时锁定并记录审计日志
+func (l *LoginLimiter) Failure(username, ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.pruneLocked(now)
+	l.release(l.usernames, username)
+	l.release(l.ips, ip)
+	l.fail(l.usernames, username, l.maxFailures, now, logrus.Fields{"username": username, "ip": ip})
+	l.fail(l.ips, ip, l.ipMaxFailures, now, logrus.Fields{"ip": ip, "username": username})
+}
+
+// Success 认证成功后释放预占并清除用户名的失败记录，来源 IP 的失败记录保留到过期，
+// 避免攻击者使用自己的账号重置计数
+func (l *LoginLimiter) Success(username, ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.release(l.ips, ip)
+	if failures, ok := l.usernames[username]; ok {
+		failures.count = 0
+		failures.blockedTill = time.Time{}
+		l.release(l.usernames, username)
+	}
+}
+
+// exhausted 判断失败次数与进行中的认证次数之和是否已达到阈值，没有失败记录或 maxFailures 为 0 时不限制
+func (l *LoginLimiter) exhausted(failures *loginFailures, maxFailures int, now time.Time) bool {
+	if failures == nil || maxFailures <= 0 || failures.count == 0 {
+		return false
+	}
+	if now.Sub(failures.lastFailure) >= l.lockout { // 失败记录已过期
+		return false
+	}
+	return failures.count+failures.pending >= maxFailures
+}
+
+// reserve 预占一次认证，maxFailures 为 0 时不限制
+func (l *LoginLimiter) reserve(records map[string]*loginFailures, key string, maxFailures int) {
+	if maxFailures <= 0 {
+		return
+	}
+	failures, ok := records[key]
+	if !ok {
+		failures = &loginFailures{}
+		records[key] = failures
+	}
+	failures.pending++
+}
+
+// release 释放一次预占，没有失败记录和预占时删除记录
+func (l *LoginLimiter) release(records map[string]*loginFailures, key string) {
+	failures, ok := records[key]
+	if !ok {
+		return
+	}
+	if failures.pending > 0 {
+		failures.pending--
+	}
+	if failures.pending == 0 && failures.count == 0 {
+		delete(records, key)
+	}
+}
+
+// fail 增加失败次数并计算退避时间，maxFailures 为 0 时不限制
+func (l *LoginLimiter) fail(records map[string]*loginFailures, key string, maxFailures int, now time.Time, fields logrus.Fields) {
+	if maxFailures <= 0 {
+		return
+	}
+	failures, ok := records[key]
+	if !ok {
+		failures = &loginFailures{}
+		records[key] = failures
+	} else if now.Sub(failures.lastFailure) >= l.lockout { // 失败记录已过期，保留进行中的认证
+		failures.count = 0
+	}
+	failures.count++
+	failures.lastFailure = now
+	if failures.count >= maxFailures {
+		failures.blockedTill = now.Add(l.lockout)
+		fields["failures"] = failures.count
+		fields["lockout"] = l.lockout.String()
+		l.log.WithFields(fields).Warn("Login locked out after too many failed attempts")
+		return
+	}
+	wait := l.backoff
+	for i := 1; i < failures.count && wait < l.lockout; i++ {
+		wait *= 2
+	}
+	if wait > l.lockout {
+		wait = l.lockout
+	}
+	failures.blockedTill = now.Add(wait)
+}
+
+// pruneLocked 清除已过期的失败记录，调用方需持有锁
+func (l *LoginLimiter) pruneLocked(now time.Time) {
+	if now.Sub(l.prunedAt) < loginLimiterPruneInterval {
+		return
+	}
+	l.prunedAt = now
+	for _, records := range []map[string]*loginFailures{l.usernames, l.ips} {
+		for key, failures := range records {
+			if failures.pending == 0 && now.Sub(failures.lastFailure) >= l.lockout && !now.Before(failures.blockedTill) {
+				delete(records, key)
+			}
+		}
+	}
+}
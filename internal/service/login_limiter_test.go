@@ -0,0 +1,128 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/yunnysunny/docker-image-proxy/internal/config"
+)
+
+func newTestLoginLimiter(maxFailures, ipMaxFailures int) *LoginLimiter {
+	return NewLoginLimiter(newTestLogger(), &config.Config{
+		LoginMaxFailures:   maxFailures,
+		LoginIPMaxFailures: ipMaxFailures,
+		LoginBackoff:       time.Second,
+		LoginLockout:       time.Minute,
+	})
+}
+
+// retryAfter 返回 Check 要求等待的时间，未被限制时为 0
+func retryAfter(t *testing.T, l *LoginLimiter, username, ip string) time.Duration {
+	t.Helper()
+	err := l.Check(username, ip)
+	if err == nil {
+		return 0
+	}
+	var locked *LoginLockedError
+	if !errors.As(err, &locked) {
+		t.Fatalf("Check() err = %v, want *LoginLockedError", err)
+	}
+	return locked.RetryAfter
+}
+
+func TestLoginLimiter(t *testing.T) {
+	tests := []struct {
+		name     string
+		max      int
+		ipMax    int
+		failures []string // 依次失败的用户名，来源 IP 均为 1.1.1.1
+		success  string   // 失败之后认证成功的用户名
+		username string
+		ip       string
+		wait     time.Duration
+	}{
+		{"no failures", 3, 10, nil, "", "alice", "1.1.1.1", 0},
+		{"backoff after failure", 3, 10, []string{"alice"}, "", "alice", "1.1.1.1", time.Second},
+		{"backoff doubles", 5, 10, []string{"alice", "alice", "alice"}, "", "alice", "2.2.2.2", 4 * time.Second},
+		{"locked out", 3, 10, []string{"alice", "alice", "alice"}, "", "alice", "2.2.2.2", time.Minute},
+		{"other username from other ip", 3, 10, []string{"alice", "alice", "alice"}, "", "bob", "2.2.2.2", 0},
+		{"ip backoff", 3, 10, []string{"alice"}, "", "bob", "1.1.1.1", time.Second},
+		{"ip locked out", 10, 2, []string{"alice", "bob"}, "", "carol", "1.1.1.1", time.Minute},
+		{"success clears username", 3, 10, []string{"alice", "alice"}, "alice", "alice", "2.2.2.2", 0},
+		{"success keeps ip", 3, 10, []string{"alice"}, "alice", "alice", "1.1.1.1", time.Second},
+		{"unlimited", 0, 0, []string{"alice", "alice", "alice"}, "", "alice", "1.1.1.1", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLoginLimiter(tt.max, tt.ipMax)
+			for _, username := range tt.failures {
+				l.Failure(username, "1.1.1.1")
+			}
+			if tt.success != "" {
+				l.Success(tt.success, "1.1.1.1")
+			}
+			if wait := retryAfter(t, l, tt.username, tt.ip); wait != tt.wait {
+				t.Fatalf("Check(%q, %q) retry after %s, want %s", tt.username, tt.ip, wait, tt.wait)
+			}
+		})
+	}
+}
+
+func TestLoginLimiterReservesConcurrentAttempts(t *testing.T) {
+	l := newTestLoginLimiter(3, 10)
+	// 没有失败记录时不限制并发的认证
+	for i := 0; i < 10; i++ {
+		if wait := retryAfter(t, l, "alice", "1.1.1.1"); wait != 0 {
+			t.Fatalf("attempt %d without failures throttled: retry after %s", i, wait)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		l.Success("alice", "1.1.1.1")
+	}
+
+	// 有失败记录时，退避结束后尚未得到结果的认证合计不超过剩余的失败次数
+	l.Failure("bob", "2.2.2.2")
+	l.usernames["bob"].blockedTill = time.Time{}
+	l.ips["2.2.2.2"].blockedTill = time.Time{}
+	for i := 0; i < 2; i++ {
+		if wait := retryAfter(t, l, "bob", "2.2.2.2"); wait != 0 {
+			t.Fatalf("attempt %d throttled: retry after %s", i, wait)
+		}
+	}
+	if wait := retryAfter(t, l, "bob", "2.2.2.2"); wait != time.Second {
+		t.Fatalf("attempt beyond remaining failures: retry after %s, want 1s", wait)
+	}
+	// 其中一次成功后释放预占并清除失败记录
+	l.Success("bob", "2.2.2.2")
+	if wait := retryAfter(t, l, "bob", "3.3.3.3"); wait != 0 {
+		t.Fatalf("attempt after success throttled: retry after %s", wait)
+	}
+	// 其余的认证全部失败时锁定
+	for i := 0; i < 3; i++ {
+		l.Failure("bob", "2.2.2.2")
+	}
+	if wait := retryAfter(t, l, "bob", "4.4.4.4"); wait != time.Minute {
+		t.Fatalf("after failures: retry after %s, want 1m", wait)
+	}
+}
+
+func TestLoginLockedErrorRetryAfterHeader(t *testing.T) {
+	tests := []struct {
+		retryAfter time.Duration
+		want       string
+	}{
+		{30 * time.Second, "30"},
+		{1500 * time.Millisecond, "2"},
+		{200 * time.Millisecond, "1"},
+		{0, "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.retryAfter.String(), func(t *testing.T) {
+			err := &LoginLockedError{RetryAfter: tt.retryAfter}
+			if got := err.RetryAfterHeader(); got != tt.want {
+				t.Fatalf("RetryAfterHeader() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package service
+
+import (
+	"container/list"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/yunnysunny/docker-image-proxy/internal/config"
+	"github.com/yunnysunny/docker-image-proxy/internal/distribution"
+)
+
+const (
+	// maxTagEntries 标签缓存的最大条目数，超过时淘汰最早写入的条目
+	maxTagEntries = 10000
+	// maxDigestEntries 未开启磁盘缓存时内存中按摘要缓存的最大条目数，超过时淘汰最早写入的条目
+	maxDigestEntries = 10000
+)
+
+// Manifest 镜像 manifest 及其元信息
+type Manifest struct {
+	Data        []byte `json:"data"`
+	ContentType string `json:"contentType"`
+	Digest      string `json:"digest"`
+}
+
+type tagEntry struct {
+	key      string
+	manifest *Manifest
+	expires  time.Time
+}
+
+// ManifestCache manifest 缓存
+//
+// 摘要引用的 manifest 内容不可变，开启缓存时保存在 <CacheDir>/manifests/<name>/<algorithm>/<hex>，
+// 与镜像层一起计入 CACHE_MAX_SIZE，超出后按最近使用时间淘汰，未开启缓存时保存在内存中，
+// 按写入顺序淘汰，最多缓存 maxDigestEntries 个；
+// 标签引用的 manifest 可能被重新推送，只在内存中缓存 ManifestCacheTTL 时长，
+// 上游按 Accept 协商返回的 manifest 类型不同，按规范化后的 Accept 分别缓存，
+// 条目按写入顺序淘汰，最多缓存 maxTagEntries 个。
+type ManifestCache struct {
+	log   *logrus.Logger
+	dir   string // 为空时摘要引用的 manifest 保存在内存中
+	ttl   time.Duration
+	blobs *BlobCache // 统计缓存容量
+
+	mu    sync.RWMutex
+	tags  map[string]*list.Element // 值为 *tagEntry
+	order *list.List               // 按写入顺序排列，所有条目的有效期相同，最早写入的最先过期
+
+	digests     map[string]*list.Element // 未开启磁盘缓存时摘要引用的 manifest，值为 *tagEntry
+	digestOrder *list.List
+}
+
+// NewManifestCache 创建 manifest 缓存，开启缓存且镜像层缓存可用时摘要引用的 manifest 保存在磁盘上，否则保存在内存中
+func NewManifestCache(log *logrus.Logger, config *config.Config, blobs *BlobCache) *ManifestCache {
+	cache := &ManifestCache{
+		log:         log,
+		ttl:         config.ManifestCacheTTL,
+		tags:        make(map[string]*list.Element),
+		order:       list.New(),
+		digests:     make(map[string]*list.Element),
+		digestOrder: list.New(),
+	}
+	if !config.CacheEnabled || blobs == nil {
+		return cache
+	}
+	dir := filepath.Join(config.CacheDir, "manifests")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		log.WithError(err).WithField("dir", dir).Error("Failed to create manifest cache dir, caching manifests in memory")
+		return cache
+	}
+	blobs.addDir(dir)
+	cache.dir = dir
+	cache.blobs = blobs
+	return cache
+}
+
+// tagKey 标签缓存的键，包含规范化后的 Accept，只包含已知的 manifest 媒体类型，避免客户端构造任意多的键
+func tagKey(name, reference string, accept []string) string {
+	return name + ":" + reference + "|" + strings.Join(distribution.NormalizeAccept(accept), ",")
+}
+
+// manifestPath 获取摘要引用对应的缓存文件路径
+func (c *ManifestCache) manifestPath(name, digest string) (string, error) {
+	algorithm, hexValue, err := parseDigest(digest)
+	if err != nil {
+		return "", err
+	}
+	repoPath, err := repositoryPath(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(c.dir, repoPath, algorithm, hexValue), nil
+}
+
+// Get 获取缓存的 manifest，标签引用按 Accept 查找，未命中时返回 nil
+func (c *ManifestCache) Get(name, reference string, accept []string) *Manifest {
+	if c == nil {
+		return nil
+	}
+	if !isDigest(reference) {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		element, ok := c.tags[tagKey(name, reference, accept)]
+		if !ok {
+			return nil
+		}
+		entry := element.Value.(*tagEntry)
+		if time.Now().After(entry.expires) {
+			return nil
+		}
+		return entry.manifest
+	}
+	if c.dir == "" {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		element, ok := c.digests[name+"@"+reference]
+		if !ok {
+			return nil
+		}
+		return element.Value.(*tagEntry).manifest
+	}
+
+	manifestPath, err := c.manifestPath(name, reference)
+	if err != nil {
+		return nil
+	}
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil
+	}
+	manifest := &Manifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		c.log.WithError(err).WithField("path", manifestPath).Warn("Failed to decode cached manifest")
+		return nil
+	}
+	// 更新修改时间，作为淘汰时的最近使用时间
+	now := time.Now()
+	os.Chtimes(manifestPath, now, now)
+	return manifest
+}
+
+// Put 缓存 manifest，标签引用按 Accept 缓存，同时按摘要保存
+func (c *ManifestCache) Put(name, reference string, accept []string, manifest *Manifest) {
+	if c == nil {
+		return
+	}
+	// 上游返回未知类型时不按标签缓存，该类型不在键中，不能确定其他客户端是否接受
+	if !isDigest(reference) && c.ttl > 0 && distribution.IsManifestMediaType(manifest.ContentType) {
+		c.putTag(tagKey(name, reference, accept), manifest)
+	}
+
+	// 只有内容与摘要一致时才永久保存
+	if err := verifyDigest(manifest.Digest, manifest.Data); err != nil {
+		c.log.WithError(err).WithFields(logrus.Fields{
+			"name":      name,
+			"reference": reference,
+		}).Warn("Skip caching manifest")
+		return
+	}
+	if c.dir == "" {
+		c.putDigest(name+"@"+manifest.Digest, manifest)
+		return
+	}
+	if err := c.writeFile(name, manifest); err != nil {
+		c.log.WithError(err).WithField("digest", manifest.Digest).Warn("Failed to cache manifest")
+	}
+}
+
+// writeFile 原子写入摘要引用的 manifest，写入中的临时文件以 . 开头，不参与缓存淘汰
+func (c *ManifestCache) writeFile(name string, manifest *Manifest) error {
+	manifestPath, err := c.manifestPath(name, manifest.Digest)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(manifestPath); err == nil {
+		return nil
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(manifestPath, data, 0o644); err != nil {
+		return err
+	}
+	c.blobs.added(int64(len(data)))
+	return nil
+}
+
+// putTag 缓存标签引用的 manifest，清理过期条目，条目数超过 maxTagEntries 时淘汰最早写入的条目
+func (c *ManifestCache) putTag(key string, manifest *Manifest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	entry := &tagEntry{key: key, manifest: manifest, expires: now.Add(c.ttl)}
+	if element, ok := c.tags[key]; ok {
+		element.Value = entry
+		c.order.MoveToBack(element)
+	} else {
+		c.tags[key] = c.order.PushBack(entry)
+	}
+	for element := c.order.Front(); element != nil; element = c.order.Front() {
+		oldest := element.Value.(*tagEntry)
+		if len(c.tags) <= maxTagEntries && !now.After(oldest.expires) {
+			break
+		}
+		c.order.Remove(element)
+		delete(c.tags, oldest.key)
+	}
+}
+
+// putDigest 在内存中缓存摘要引用的 manifest，条目数超过 maxDigestEntries 时淘汰最早写入的条目
+func (c *ManifestCache) putDigest(key string, manifest *Manifest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.digests[key]; ok {
+		return
+	}
+	c.digests[key] = c.digestOrder.PushBack(&tagEntry{key: key, manifest: manifest})
+	for len(c.digests) > maxDigestEntries {
+		oldest := c.digestOrder.Remove(c.digestOrder.Front()).(*tagEntry)
+		delete(c.digests, oldest.key)
+	}
+}
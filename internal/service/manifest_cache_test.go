@@ -0,0 +1,99 @@
+package service
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/yunnysunny/docker-image-proxy/internal/config"
+	"github.com/yunnysunny/docker-image-proxy/internal/distribution"
+)
+
+func newTestManifestCache(t *testing.T, ttl time.Duration) *ManifestCache {
+	t.Helper()
+	cfg := &config.Config{CacheEnabled: true, CacheDir: t.TempDir(), ManifestCacheTTL: ttl}
+	cache := NewManifestCache(newTestLogger(), cfg, NewBlobCache(newTestLogger(), cfg))
+	if cache == nil {
+		t.Fatal("manifest cache disabled")
+	}
+	return cache
+}
+
+func TestManifestCacheTagLimit(t *testing.T) {
+	cache := newTestManifestCache(t, time.Minute)
+	manifest := &Manifest{Data: fakeManifest, ContentType: distribution.MediaTypeDockerManifest, Digest: digestOf(fakeManifest)}
+
+	// 未知的媒体类型不产生新的键
+	for i := 0; i < 3; i++ {
+		cache.Put("app", "latest", []string{"application/x-" + strconv.Itoa(i), distribution.MediaTypeDockerManifest}, manifest)
+	}
+	if len(cache.tags) != 1 {
+		t.Fatalf("tag entries = %d, want 1", len(cache.tags))
+	}
+
+	for i := 0; i < 3*maxTagEntries; i++ {
+		cache.Put("app", "v"+strconv.Itoa(i), nil, manifest)
+	}
+	if len(cache.tags) != maxTagEntries || cache.order.Len() != maxTagEntries {
+		t.Fatalf("tag entries = %d (order %d), want %d", len(cache.tags), cache.order.Len(), maxTagEntries)
+	}
+	// 淘汰最早写入的条目
+	if cache.Get("app", "v0", nil) != nil {
+		t.Fatal("oldest tag not evicted")
+	}
+	if cache.Get("app", "v"+strconv.Itoa(3*maxTagEntries-1), nil) == nil {
+		t.Fatal("newest tag evicted")
+	}
+}
+
+func TestManifestCacheTagExpires(t *testing.T) {
+	cache := newTestManifestCache(t, time.Millisecond)
+	manifest := &Manifest{Data: fakeManifest, ContentType: distribution.MediaTypeDockerManifest, Digest: digestOf(fakeManifest)}
+	cache.Put("app", "old", nil, manifest)
+	time.Sleep(5 * time.Millisecond)
+	if cache.Get("app", "old", nil) != nil {
+		t.Fatal("expired tag returned")
+	}
+	cache.Put("app", "new", nil, manifest)
+	if _, ok := cache.tags[tagKey("app", "old", nil)]; ok {
+		t.Fatal("expired tag not pruned")
+	}
+	// 按摘要缓存的 manifest 不过期
+	if cache.Get("app", manifest.Digest, nil) == nil {
+		t.Fatal("manifest not cached by digest")
+	}
+}
+
+func TestManifestCacheInMemory(t *testing.T) {
+	cfg := &config.Config{ManifestCacheTTL: time.Minute}
+	cache := NewManifestCache(newTestLogger(), cfg, NewBlobCache(newTestLogger(), cfg))
+	manifest := &Manifest{Data: fakeManifest, ContentType: distribution.MediaTypeDockerManifest, Digest: digestOf(fakeManifest)}
+	cache.Put("app", "latest", nil, manifest)
+	if cache.Get("app", "latest", nil) == nil {
+		t.Fatal("tag not cached without the disk cache")
+	}
+	if cache.Get("app", manifest.Digest, nil) == nil {
+		t.Fatal("manifest not cached by digest without the disk cache")
+	}
+	if cache.Get("other", manifest.Digest, nil) != nil {
+		t.Fatal("digest cached for another repository")
+	}
+
+	// 内容与摘要不一致时不按摘要缓存
+	forged := &Manifest{Data: []byte("forged"), ContentType: manifest.ContentType, Digest: digestOf([]byte("other"))}
+	cache.Put("app", forged.Digest, nil, forged)
+	if cache.Get("app", forged.Digest, nil) != nil {
+		t.Fatal("manifest with a mismatched digest cached")
+	}
+
+	for i := 0; i < maxDigestEntries; i++ {
+		data := []byte(strconv.Itoa(i))
+		cache.Put("app", "v", nil, &Manifest{Data: data, ContentType: manifest.ContentType, Digest: digestOf(data)})
+	}
+	if len(cache.digests) != maxDigestEntries || cache.digestOrder.Len() != maxDigestEntries {
+		t.Fatalf("digest entries = %d (order %d), want %d", len(cache.digests), cache.digestOrder.Len(), maxDigestEntries)
+	}
+	if cache.Get("app", manifest.Digest, nil) != nil {
+		t.Fatal("oldest digest not evicted")
+	}
+}
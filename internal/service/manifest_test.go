@@ -0,0 +1,70 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/yunnysunny/docker-image-proxy/internal/config"
+	"github.com/yunnysunny/docker-image-proxy/internal/distribution"
+)
+
+func TestManifestMediaType(t *testing.T) {
+	index := []byte(`{"schemaVersion":2,"manifests":[]}`)
+	var mu sync.Mutex
+	var contentType string
+	var received []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		received = r.Header.Values("Accept")
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		} else {
+			w.Header()["Content-Type"] = nil // 不自动检测类型
+		}
+		w.Write(index)
+	}))
+	t.Cleanup(upstream.Close)
+	s := NewRegistryService(newTestLogger(), &config.Config{UpstreamRegistry: upstream.URL, SelfAuthService: "docker-image-proxy"})
+
+	tests := []struct {
+		name        string
+		contentType string   // 上游返回的 Content-Type
+		accept      []string // 客户端的 Accept
+		want        string   // 返回给客户端的 Content-Type
+		forwarded   []string // 转发给上游的 Accept
+	}{
+		{"upstream type preserved", distribution.MediaTypeDockerManifestList, []string{distribution.MediaTypeDockerManifestList},
+			distribution.MediaTypeDockerManifestList, []string{distribution.MediaTypeDockerManifestList}},
+		{"missing type detected", "", []string{distribution.MediaTypeOCIIndex},
+			distribution.MediaTypeOCIIndex, []string{distribution.MediaTypeOCIIndex}},
+		{"plain text detected", "text/plain; charset=utf-8", []string{distribution.MediaTypeOCIIndex},
+			distribution.MediaTypeOCIIndex, []string{distribution.MediaTypeOCIIndex}},
+		{"generic json detected", "application/json", []string{"a", "b"},
+			distribution.MediaTypeOCIIndex, []string{"a", "b"}},
+		{"all types requested without accept", distribution.MediaTypeOCIIndex, nil,
+			distribution.MediaTypeOCIIndex, distribution.ManifestMediaTypes},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			contentType = tt.contentType
+			mu.Unlock()
+			manifest, err := s.GetManifest("library/nginx", "latest", newManifestContext("GET", "", false, tt.accept...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if manifest.ContentType != tt.want || manifest.Digest != digestOf(index) {
+				t.Fatalf("manifest type=%s digest=%s, want %s %s", manifest.ContentType, manifest.Digest, tt.want, digestOf(index))
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !reflect.DeepEqual(received, tt.forwarded) {
+				t.Fatalf("upstream Accept = %q, want %q", received, tt.forwarded)
+			}
+		})
+	}
+}
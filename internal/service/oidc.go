@@ -0,0 +1,250 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sirupsen/logrus"
+	"github.com/yunnysunny/docker-image-proxy/internal/config"
+)
+
+// OIDCIssuer 信任的 OIDC 身份提供方，例如 GitHub Actions、GitLab CI
+type OIDCIssuer struct {
+	Issuer   string `json:"issuer"`   // ID token 的 iss
+	JWKSURL  string `json:"jwksUrl"`  // JWKS 地址，为空时从 <issuer>/.well-known/openid-configuration 中获取
+	JWKSFile string `json:"jwksFile"` // 本地 JWKS 文件，用于无法访问身份提供方的环境
+	Audience string `json:"audience"` // ID token 的 aud，为空时使用 SELF_AUTH_SERVICE
+}
+
+// OIDCRule 将 ID token 的 claim 映射为权限策略中的用户
+type OIDCRule struct {
+	Issuer string `json:"issuer"` // 匹配的 iss，为空时匹配所有身份提供方
+	// claim 名称 -> 匹配模式，规则中的 claim 全部匹配时规则生效，
+	// 模式中 * 匹配单个路径段、** 匹配任意多级路径，同仓库名的通配符
+	Claims map[string]string `json:"claims"`
+	// 映射的用户，可以用 {claim} 引用 claim 的值，例如 github:{repository}
+	Subject string `json:"subject"`
+}
+
+// OIDCConfig OIDC 配置，从 OIDC_CONFIG_FILE 指定的 JSON 文件加载
+//
+// 文件内容举例：
+//
+//	{
+//	  "issuers": [
+//	    {"issuer": "https://token.actions.githubusercontent.com", "audience": "docker-image-proxy"}
+//	  ],
+//	  "rules": [
+//	    {
+//	      "issuer": "https://token.actions.githubusercontent.com",
+//	      "claims": {"repository_owner": "myorg", "ref": "refs/heads/main"},
+//	      "subject": "github:{repository}"
+//	    }
+//	  ]
+//	}
+//
+// 规则按顺序匹配，使用第一个匹配的规则，没有规则匹配时拒绝登录
+type OIDCConfig struct {
+	Issuers []OIDCIssuer `json:"issuers"`
+	Rules   []OIDCRule   `json:"rules"`
+}
+
+// oidcClaimRegexp 用户模板中引用的 claim
+var oidcClaimRegexp = regexp.MustCompile(`\{([A-Za-z0-9_.:-]+)\}`)
+
+// oidcIssuer 身份提供方及其公钥，未配置 JWKS 地址时在首次使用时通过发现文档获取
+type oidcIssuer struct {
+	OIDCIssuer
+	mu   sync.Mutex
+	keys *KeySet
+}
+
+// OIDCProvider 使用 CI 平台签发的 OIDC ID token 作为登录密码，校验签名、iss、aud 和有效期后，
+// 按规则将 claim 映射为用户，CI 任务不需要保存静态密码
+type OIDCProvider struct {
+	log     *logrus.Logger
+	client  *http.Client
+	issuers map[string]*oidcIssuer
+	rules   []OIDCRule
+}
+
+// NewOIDCProvider 加载 OIDC_CONFIG_FILE，未配置时返回不接受 ID token 的 OIDCProvider，配置错误时退出
+func NewOIDCProvider(log *logrus.Logger, config *config.Config) *OIDCProvider {
+	provider := &OIDCProvider{
+		log:     log,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		issuers: map[string]*oidcIssuer{},
+	}
+	if config.OIDCConfigFile == "" {
+		return provider
+	}
+	data, err := os.ReadFile(config.OIDCConfigFile)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to read oidc config file")
+	}
+	oidcConfig := OIDCConfig{}
+	if err := json.Unmarshal(data, &oidcConfig); err != nil {
+		log.WithError(err).Fatal("Failed to parse oidc config file")
+	}
+	for _, issuerConfig := range oidcConfig.Issuers {
+		if issuerConfig.Issuer == "" {
+			log.Fatal("OIDC issuer is required")
+		}
+		if issuerConfig.Audience == "" {
+			issuerConfig.Audience = config.SelfAuthService
+		}
+		issuer := &oidcIssuer{OIDCIssuer: issuerConfig}
+		if issuerConfig.JWKSFile != "" {
+			if issuer.keys, err = NewKeySet(log, issuerConfig.JWKSURL, issuerConfig.JWKSFile, provider.client); err != nil {
+				log.WithError(err).WithField("issuer", issuerConfig.Issuer).Fatal("Failed to load oidc jwks")
+			}
+		}
+		provider.issuers[issuerConfig.Issuer] = issuer
+		log.WithFields(logrus.Fields{
+			"issuer":   issuerConfig.Issuer,
+			"audience": issuerConfig.Audience,
+		}).Info("OIDC issuer configured")
+	}
+	for _, rule := range oidcConfig.Rules {
+		if rule.Subject == "" {
+			log.Fatal("OIDC rule subject is required")
+		}
+		if rule.Issuer != "" && provider.issuers[rule.Issuer] == nil {
+			log.WithField("issuer", rule.Issuer).Fatal("OIDC rule references unknown issuer")
+		}
+	}
+	provider.rules = oidcConfig.Rules
+	return provider
+}
+
+// Enabled 是否配置了 OIDC 身份提供方
+func (p *OIDCProvider) Enabled() bool {
+	return len(p.issuers) > 0
+}
+
+// Accepts 判断密码是否应作为 ID token 校验：配置了身份提供方且密码为 JWT 格式
+func (p *OIDCProvider) Accepts(password string) bool {
+	return p.Enabled() && strings.HasPrefix(password, "eyJ") && strings.Count(password, ".") == 2
+}
+
+// Identify 校验 ID token，返回映射的用户
+func (p *OIDCProvider) Identify(idToken string) (string, error) {
+	unverified := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(idToken, unverified); err != nil {
+		return "", err
+	}
+	iss, _ := unverified["iss"].(string)
+	issuer, ok := p.issuers[iss]
+	if !ok {
+		return "", fmt.Errorf("untrusted oidc issuer %q", iss)
+	}
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, issuer.keyFunc(p), jwt.WithValidMethods(publicKeyMethods),
+		jwt.WithIssuer(issuer.Issuer), jwt.WithAudience(issuer.Audience), jwt.WithExpirationRequired())
+	if err != nil {
+		return "", err
+	}
+	for _, rule := range p.rules {
+		if rule.Issuer != "" && rule.Issuer != issuer.Issuer {
+			continue
+		}
+		if subject, ok := rule.match(claims); ok {
+			return subject, nil
+		}
+	}
+	return "", fmt.Errorf("no oidc rule matches token of %s", issuer.Issuer)
+}
+
+// match 判断 claim 是否匹配规则，匹配时返回映射的用户，用户模板引用了不存在的 claim 时不匹配
+func (r OIDCRule) match(claims jwt.MapClaims) (string, bool) {
+	for name, pattern := range r.Claims {
+		value, ok := claimString(claims, name)
+		if !ok || !MatchRepository(pattern, value) {
+			return "", false
+		}
+	}
+	matched := true
+	subject := oidcClaimRegexp.ReplaceAllStringFunc(r.Subject, func(ref string) string {
+		value, ok := claimString(claims, ref[1:len(ref)-1])
+		if !ok || value == "" {
+			matched = false
+		}
+		return value
+	})
+	return subject, matched
+}
+
+// claimString 读取字符串、数字或布尔类型的 claim
+func claimString(claims jwt.MapClaims, name string) (string, bool) {
+	switch value := claims[name].(type) {
+	case string:
+		return value, true
+	case float64, bool:
+		return fmt.Sprint(value), true
+	}
+	return "", false
+}
+
+// keyFunc 按 kid 从身份提供方的 JWKS 中查找公钥
+func (i *oidcIssuer) keyFunc(p *OIDCProvider) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		keys, err := i.keySet(p)
+		if err != nil {
+			return nil, err
+		}
+		kid, _ := token.Header["kid"].(string)
+		return keys.Key(kid)
+	}
+}
+
+// keySet 获取身份提供方的公钥集合，未配置 JWKS 地址时通过发现文档获取，获取失败时下次重试
+func (i *oidcIssuer) keySet(p *OIDCProvider) (*KeySet, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.keys != nil {
+		return i.keys, nil
+	}
+	url := i.JWKSURL
+	if url == "" {
+		var err error
+		if url, err = p.discoverJWKS(i.Issuer); err != nil {
+			return nil, err
+		}
+	}
+	keys, err := NewKeySet(p.log, url, "", p.client)
+	if err != nil {
+		return nil, err
+	}
+	i.keys = keys
+	return keys, nil
+}
+
+// discoverJWKS 从身份提供方的发现文档中获取 jwks_uri
+func (p *OIDCProvider) discoverJWKS(issuer string) (string, error) {
+	resp, err := p.client.Get(strings.TrimRight(issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return "", fmt.Errorf("failed to get oidc discovery document: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get oidc discovery document: unexpected status code: %d", resp.StatusCode)
+	}
+	var document struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&document); err != nil {
+		return "", fmt.Errorf("failed to decode oidc discovery document: %v", err)
+	}
+	if document.JWKSURI == "" {
+		return "", errors.New("oidc discovery document has no jwks_uri")
+	}
+	return document.JWKSURI, nil
+}
@@ -0,0 +1,150 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/yunnysunny/docker-image-proxy/internal/config"
+)
+
+const testOIDCIssuer = "https://token.actions.githubusercontent.com"
+
+func TestOIDCRuleMatch(t *testing.T) {
+	rule := OIDCRule{
+		Claims:  map[string]string{"repository_owner": "myorg", "ref": "refs/heads/*"},
+		Subject: "github:{repository}",
+	}
+	tests := []struct {
+		name    string
+		claims  jwt.MapClaims
+		subject string
+		matched bool
+	}{
+		{"all claims match", jwt.MapClaims{"repository_owner": "myorg", "ref": "refs/heads/main", "repository": "myorg/app"}, "github:myorg/app", true},
+		{"pattern matches one segment", jwt.MapClaims{"repository_owner": "myorg", "ref": "refs/heads/feature/x", "repository": "myorg/app"}, "", false},
+		{"claim differs", jwt.MapClaims{"repository_owner": "other", "ref": "refs/heads/main", "repository": "other/app"}, "", false},
+		{"claim missing", jwt.MapClaims{"ref": "refs/heads/main", "repository": "myorg/app"}, "", false},
+		{"subject claim missing", jwt.MapClaims{"repository_owner": "myorg", "ref": "refs/heads/main"}, "", false},
+		{"subject claim empty", jwt.MapClaims{"repository_owner": "myorg", "ref": "refs/heads/main", "repository": ""}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subject, matched := rule.match(tt.claims)
+			if matched != tt.matched || (matched && subject != tt.subject) {
+				t.Fatalf("match() = %q, %v, want %q, %v", subject, matched, tt.subject, tt.matched)
+			}
+		})
+	}
+
+	// 数字和布尔类型的 claim 按字符串匹配
+	numeric := OIDCRule{Claims: map[string]string{"project_id": "42", "protected": "true"}, Subject: "gitlab:{project_id}"}
+	if subject, ok := numeric.match(jwt.MapClaims{"project_id": float64(42), "protected": true}); !ok || subject != "gitlab:42" {
+		t.Fatalf("match() = %q, %v, want gitlab:42", subject, ok)
+	}
+}
+
+// newTestOIDCProvider 创建信任测试身份提供方的 OIDCProvider，返回 provider 和签名函数
+func newTestOIDCProvider(t *testing.T) (*OIDCProvider, func(jwt.MapClaims) string) {
+	t.Helper()
+	key, jwks := writeTestJWKS(t)
+	file := filepath.Join(t.TempDir(), "oidc.json")
+	data := `{
+		"issuers": [{"issuer": "` + testOIDCIssuer + `", "jwksFile": "` + jwks + `"}],
+		"rules": [
+			{"issuer": "` + testOIDCIssuer + `", "claims": {"repository_owner": "myorg", "ref": "refs/heads/main"}, "subject": "github:{repository}"},
+			{"claims": {"repository_owner": "myorg"}, "subject": "github-branches"}
+		]
+	}`
+	if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	provider := NewOIDCProvider(newTestLogger(), &config.Config{
+		OIDCConfigFile:  file,
+		SelfAuthService: "docker-image-proxy",
+	})
+	return provider, func(claims jwt.MapClaims) string {
+		return signTestIDToken(t, key, claims)
+	}
+}
+
+func signTestIDToken(t *testing.T, key *ecdsa.PrivateKey, claims jwt.MapClaims) string {
+	t.Helper()
+	jwk, err := newJWK(&key.PublicKey, "ES256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = jwk.Kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestOIDCIdentify(t *testing.T) {
+	provider, sign := newTestOIDCProvider(t)
+	other, _ := writeTestJWKS(t)
+	exp := time.Now().Add(time.Hour).Unix()
+	claims := func(overrides jwt.MapClaims) jwt.MapClaims {
+		claims := jwt.MapClaims{
+			"iss":              testOIDCIssuer,
+			"aud":              "docker-image-proxy",
+			"exp":              exp,
+			"repository":       "myorg/app",
+			"repository_owner": "myorg",
+			"ref":              "refs/heads/main",
+		}
+		for name, value := range overrides {
+			if value == nil {
+				delete(claims, name)
+			} else {
+				claims[name] = value
+			}
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		subject string // 为空表示拒绝
+	}{
+		{"first matching rule", sign(claims(nil)), "github:myorg/app"},
+		{"fallback rule", sign(claims(jwt.MapClaims{"ref": "refs/heads/dev"})), "github-branches"},
+		{"no rule matches", sign(claims(jwt.MapClaims{"repository_owner": "other"})), ""},
+		{"wrong audience", sign(claims(jwt.MapClaims{"aud": "sigstore"})), ""},
+		{"expired", sign(claims(jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()})), ""},
+		{"no expiry", sign(claims(jwt.MapClaims{"exp": nil})), ""},
+		{"untrusted issuer", sign(claims(jwt.MapClaims{"iss": "https://gitlab.example.com"})), ""},
+		{"unknown key", signTestIDToken(t, other, claims(nil)), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !provider.Accepts(tt.token) {
+				t.Fatal("ID token not recognized as a JWT")
+			}
+			subject, err := provider.Identify(tt.token)
+			if tt.subject == "" {
+				if err == nil {
+					t.Fatalf("Identify() = %q, want error", subject)
+				}
+				return
+			}
+			if err != nil || subject != tt.subject {
+				t.Fatalf("Identify() = %q, %v, want %q", subject, err, tt.subject)
+			}
+		})
+	}
+
+	if provider.Accepts("plain-password") {
+		t.Fatal("plain password treated as an ID token")
+	}
+	if NewOIDCProvider(newTestLogger(), &config.Config{}).Accepts(sign(claims(nil))) {
+		t.Fatal("ID token accepted without configured issuers")
+	}
+}
@@ -0,0 +1,162 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/yunnysunny/docker-image-proxy/internal/config"
+)
+
+// 策略中可以使用的操作，ActionCatalog 对应 registry:catalog:*，* 表示全部操作
+const (
+	ActionPull    = "pull"
+	ActionPush    = "push"
+	ActionDelete  = "delete"
+	ActionCatalog = "catalog"
+	ActionAll     = "*"
+)
+
+// repositoryActions 仓库支持的全部操作
+var repositoryActions = []string{ActionPull, ActionPush, ActionDelete}
+
+// PolicyRule 权限规则，subjects 中的用户或用户组对匹配 repositories 的仓库拥有 actions 中的操作
+type PolicyRule struct {
+	// 用户名、group:<用户组> 或 *（所有用户，包括未配置账号时的匿名用户）
+	Subjects []string `json:"subjects"`
+	// 仓库名模式，例如 myorg/*、library/**，规则同 MatchRepository
+	Repositories []string `json:"repositories"`
+	Actions      []string `json:"actions"`
+}
+
+// PolicyConfig 权限策略文件
+type PolicyConfig struct {
+	// 没有规则匹配时拒绝访问，为 false 时仓库允许 pull，镜像列表允许访问
+	DefaultDeny bool `json:"defaultDeny"`
+	// 用户组及其成员
+	Groups map[string][]string `json:"groups"`
+	Rules  []PolicyRule        `json:"rules"`
+}
+
+// Policy 仓库权限策略，签发 token 和校验 token 时用于计算用户对资源允许的操作
+type Policy struct {
+	log    *logrus.Logger
+	config *PolicyConfig // 未配置策略文件时为 nil
+}
+
+// NewPolicy 加载 POLICY_FILE 中的权限策略，未配置时所有用户都可以 pull 所有仓库和访问镜像列表
+func NewPolicy(log *logrus.Logger, config *config.Config) *Policy {
+	policy := &Policy{log: log}
+	if config.PolicyFile == "" {
+		return policy
+	}
+	policyConfig, err := loadPolicyConfig(config.PolicyFile)
+	if err != nil {
+		log.WithError(err).WithField("file", config.PolicyFile).Fatal("Failed to load policy file")
+	}
+	policy.config = policyConfig
+	log.WithFields(logrus.Fields{
+		"file":        config.PolicyFile,
+		"rules":       len(policyConfig.Rules),
+		"defaultDeny": policyConfig.DefaultDeny,
+	}).Info("Policy loaded")
+	return policy
+}
+
+// loadPolicyConfig 读取并校验权限策略文件
+func loadPolicyConfig(file string) (*PolicyConfig, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	policyConfig := &PolicyConfig{}
+	if err := json.Unmarshal(data, policyConfig); err != nil {
+		return nil, fmt.Errorf("failed to parse policy file: %v", err)
+	}
+	for i, rule := range policyConfig.Rules {
+		if len(rule.Subjects) == 0 {
+			return nil, fmt.Errorf("rule %d: subjects is required", i)
+		}
+		for _, action := range rule.Actions {
+			switch action {
+			case ActionPull, ActionPush, ActionDelete, ActionCatalog, ActionAll:
+			default:
+				return nil, fmt.Errorf("rule %d: unknown action %q", i, action)
+			}
+		}
+		for _, subject := range rule.Subjects {
+			group, isGroup := strings.CutPrefix(subject, "group:")
+			if _, exists := policyConfig.Groups[group]; isGroup && !exists {
+				return nil, fmt.Errorf("rule %d: unknown group %q", i, group)
+			}
+		}
+	}
+	return policyConfig, nil
+}
+
+// defaultActions 没有配置策略或没有规则匹配时允许的操作，仓库只允许 pull，镜像列表允许全部操作
+func defaultActions(typ, name string) []string {
+	switch {
+	case typ == "repository":
+		return []string{ActionPull}
+	case typ == "registry" && name == "catalog":
+		return []string{ActionAll}
+	}
+	return nil
+}
+
+// matchSubject 判断规则中的主体是否包含指定用户
+func (p *Policy) matchSubject(rule PolicyRule, subject string) bool {
+	for _, item := range rule.Subjects {
+		if item == "*" || (subject != "" && item == subject) {
+			return true
+		}
+		if group, ok := strings.CutPrefix(item, "group:"); ok && subject != "" {
+			if containsString(p.config.Groups[group], subject) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Actions 计算用户对资源允许的操作，所有匹配规则的操作取并集，
+// 没有规则匹配时按 defaultDeny 决定拒绝访问还是使用默认权限；subject 为空表示匿名用户
+func (p *Policy) Actions(subject, typ, name string) []string {
+	if p.config == nil {
+		return defaultActions(typ, name)
+	}
+	actions := []string{}
+	matched := false
+	for _, rule := range p.config.Rules {
+		if !p.matchSubject(rule, subject) {
+			continue
+		}
+		switch {
+		case typ == "registry" && name == "catalog":
+			if containsString(rule.Actions, ActionCatalog) || containsString(rule.Actions, ActionAll) {
+				return []string{ActionAll}
+			}
+		case typ == "repository":
+			for _, pattern := range rule.Repositories {
+				if !MatchRepository(pattern, name) {
+					continue
+				}
+				matched = true
+				for _, action := range rule.Actions {
+					if action == ActionAll {
+						actions = mergeActions(actions, repositoryActions)
+					} else if action != ActionCatalog {
+						actions = mergeActions(actions, []string{action})
+					}
+				}
+			}
+		}
+	}
+	if !matched && !p.config.DefaultDeny {
+		return defaultActions(typ, name)
+	}
+	return actions
+}
@@ -0,0 +1,112 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func newTestPolicy(defaultDeny bool) *Policy {
+	return &Policy{config: &PolicyConfig{
+		DefaultDeny: defaultDeny,
+		Groups:      map[string][]string{"dev": {"alice", "bob"}},
+		Rules: []PolicyRule{
+			{Subjects: []string{"group:dev"}, Repositories: []string{"myorg/*"}, Actions: []string{"pull", "push"}},
+			{Subjects: []string{"*"}, Repositories: []string{"library/**"}, Actions: []string{"pull"}},
+			{Subjects: []string{"alice"}, Repositories: []string{"myorg/**"}, Actions: []string{"catalog", "delete"}},
+			{Subjects: []string{"admin"}, Repositories: []string{"**"}, Actions: []string{"*"}},
+		},
+	}}
+}
+
+func TestPolicyActions(t *testing.T) {
+	tests := []struct {
+		name        string
+		defaultDeny bool
+		subject     string
+		typ         string
+		resource    string
+		actions     []string
+	}{
+		{"group member", true, "bob", "repository", "myorg/app", []string{"pull", "push"}},
+		{"rules merged", true, "alice", "repository", "myorg/app", []string{"delete", "pull", "push"}},
+		{"nested path only matches **", true, "bob", "repository", "myorg/team/app", []string{}},
+		{"nested path for alice", true, "alice", "repository", "myorg/team/app", []string{"delete"}},
+		{"everyone", true, "carol", "repository", "library/nginx", []string{"pull"}},
+		{"anonymous matches *", true, "", "repository", "library/nginx", []string{"pull"}},
+		{"anonymous not in group", true, "", "repository", "myorg/app", []string{}},
+		{"all actions", true, "admin", "repository", "any/repo", []string{"delete", "pull", "push"}},
+		{"default deny", true, "carol", "repository", "other/app", []string{}},
+		{"default allow pull", false, "carol", "repository", "other/app", []string{"pull"}},
+		{"catalog action", true, "alice", "registry", "catalog", []string{"*"}},
+		{"catalog via *", true, "admin", "registry", "catalog", []string{"*"}},
+		{"catalog denied", true, "bob", "registry", "catalog", []string{}},
+		{"catalog default allow", false, "bob", "registry", "catalog", []string{"*"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actions := newTestPolicy(tt.defaultDeny).Actions(tt.subject, tt.typ, tt.resource)
+			sort.Strings(actions)
+			if !reflect.DeepEqual(actions, tt.actions) {
+				t.Fatalf("Actions(%q, %s:%s) = %v, want %v", tt.subject, tt.typ, tt.resource, actions, tt.actions)
+			}
+		})
+	}
+}
+
+func TestPolicyWithoutFile(t *testing.T) {
+	policy := &Policy{}
+	if actions := policy.Actions("", "repository", "any/repo"); !reflect.DeepEqual(actions, []string{"pull"}) {
+		t.Fatalf("repository actions = %v, want [pull]", actions)
+	}
+	if actions := policy.Actions("", "registry", "catalog"); !reflect.DeepEqual(actions, []string{"*"}) {
+		t.Fatalf("catalog actions = %v, want [*]", actions)
+	}
+}
+
+func TestLoadPolicyConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{"valid", `{"groups": {"dev": ["alice"]}, "rules": [{"subjects": ["group:dev"], "repositories": ["a/*"], "actions": ["pull"]}]}`, false},
+		{"invalid json", `{`, true},
+		{"missing subjects", `{"rules": [{"repositories": ["a/*"], "actions": ["pull"]}]}`, true},
+		{"unknown action", `{"rules": [{"subjects": ["*"], "repositories": ["a/*"], "actions": ["write"]}]}`, true},
+		{"unknown group", `{"rules": [{"subjects": ["group:ops"], "repositories": ["a/*"], "actions": ["pull"]}]}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "policy.json")
+			if err := os.WriteFile(file, []byte(tt.data), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := loadPolicyConfig(file); (err != nil) != tt.wantErr {
+				t.Fatalf("loadPolicyConfig() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGrantScopesUsesCanonicalName(t *testing.T) {
+	s := &TokenService{policy: newTestPolicy(true)}
+	scopes := []Scope{
+		// 客户端请求 nginx，按规范名称 library/nginx 计算权限，签发的 token 中保留请求的名称
+		{Type: "repository", Name: "nginx", Canonical: "library/nginx", Actions: []string{"pull", "push"}},
+		{Type: "repository", Name: "myorg/app", Actions: []string{"*"}},
+		{Type: "repository", Name: "secret/app", Actions: []string{"pull"}},
+	}
+	granted := s.GrantScopes("bob", scopes)
+	want := [][]string{{"pull"}, {"pull", "push"}, {}}
+	for i, scope := range granted {
+		if scope.Name != scopes[i].Name || !reflect.DeepEqual(scope.Actions, want[i]) {
+			t.Errorf("GrantScopes()[%d] = %s %v, want %s %v", i, scope.Name, scope.Actions, scopes[i].Name, want[i])
+		}
+	}
+	if !s.Permits("bob", "repository", "library/nginx", "pull") || s.Permits("bob", "repository", "library/nginx", "push") {
+		t.Fatal("Permits() does not follow the policy")
+	}
+}
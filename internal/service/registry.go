@@ -2,34 +2,73 @@ package service
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
-	"path"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
 	"github.com/yunnysunny/docker-image-proxy/internal/config"
+	"github.com/yunnysunny/docker-image-proxy/internal/distribution"
 )
 
 type RegistryService struct {
-	log    *logrus.Logger
-	config *config.Config
-	client *http.Client
+	log           *logrus.Logger
+	config        *config.Config
+	upstreams     *UpstreamRouter
+	blobCache     *BlobCache
+	manifestCache *ManifestCache
+	blobFetches   *blobFetchGroup
+	manifestCalls *flightGroup
+	tokenCache    *upstreamTokenCache
 }
 
 func NewRegistryService(log *logrus.Logger, config *config.Config) *RegistryService {
+	blobCache := NewBlobCache(log, config)
 	return &RegistryService{
-		log:    log,
-		config: config,
-		client: &http.Client{},
+		log:           log,
+		config:        config,
+		upstreams:     NewUpstreamRouter(log, config),
+		blobCache:     blobCache,
+		manifestCache: NewManifestCache(log, config, blobCache),
+		blobFetches:   newBlobFetchGroup(log, blobCache),
+		manifestCalls: &flightGroup{},
+		tokenCache:    newUpstreamTokenCache(),
 	}
 }
 
-func (s *RegistryService) doGet(url string, c *gin.Context) (*http.Response, error) {
-	req, err := http.NewRequest("GET", url, nil)
+// Upstreams 上游路由
+func (s *RegistryService) Upstreams() *UpstreamRouter {
+	return s.upstreams
+}
+
+// resolve 根据客户端请求的仓库名选择上游，返回上游、按上游规则规范化后的上游仓库名以及缓存中使用的仓库名，
+// 请求带有 containerd 镜像加速的 ns 参数时按 ns 选择上游，不去除仓库名前缀
+func (s *RegistryService) resolve(name string, ns string) (*Upstream, string, string, error) {
+	var upstream *Upstream
+	remote := name
+	var err error
+	if ns != "" {
+		upstream, err = s.upstreams.ResolveNamespace(ns)
+	} else {
+		upstream, remote, err = s.upstreams.Resolve(name)
+	}
+	if err != nil {
+		return nil, "", "", err
+	}
+	remote = upstream.NormalizeName(remote)
+	return upstream, remote, upstream.Name + "/" + remote, nil
+}
+
+// newUpstreamRequest 创建上游请求，并复制客户端请求头，scope 为请求需要的上游鉴权范围
+func (s *RegistryService) newUpstreamRequest(
+	upstream *Upstream, scope, method, url string, c *gin.Context,
+) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %v", err)
 	}
@@ -41,12 +80,84 @@ func (s *RegistryService) doGet(url string, c *gin.Context) (*http.Response, err
 		}
 		req.Header[key] = values
 	}
-	resp, err := s.client.Do(req)
+	return s.authorizeUpstream(req, upstream, scope)
+}
+
+// upstreamScopeKey 请求上下文中代理换取上游 token 使用的鉴权范围，上游拒绝该 token 时据此重新换取
+type upstreamScopeKey struct{}
+
+// authorizeUpstream 代理持有上游凭据或使用 Basic 认证模式，且客户端没有携带上游 token 时，
+// 由代理向上游鉴权服务换取 token，Basic 认证模式下没有上游凭据时匿名换取
+func (s *RegistryService) authorizeUpstream(req *http.Request, upstream *Upstream, scope string) (*http.Request, error) {
+	proxyAuth := upstream.ProxyAuth() || (s.config.AuthMode == config.AuthModeBasic && !upstream.NoAuth)
+	if !proxyAuth || req.Header.Get("Authorization") != "" {
+		return req, nil
+	}
+	token, err := s.fetchUpstreamToken(upstream, "", []string{scope}, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get upstream token: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token.Token)
+	return req.WithContext(context.WithValue(req.Context(), upstreamScopeKey{}, scope)), nil
+}
+
+// doUpstream 发送上游请求，代理换取的上游 token 被上游拒绝（返回 401）时，
+// 按上游的认证挑战重新换取 token 并重试一次，重新换取失败时返回原来的 401 响应
+func (s *RegistryService) doUpstream(upstream *Upstream, req *http.Request) (*http.Response, error) {
+	resp, err := upstream.client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	scope, ok := req.Context().Value(upstreamScopeKey{}).(string)
+	if !ok {
+		return resp, nil
+	}
+	scheme, params := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+	if !strings.EqualFold(scheme, "Bearer") {
+		return resp, nil
+	}
+	upstream.updateChallenge(params)
+	scopes := []string{scope}
+	if params["scope"] != "" {
+		scopes = strings.Fields(params["scope"])
+	}
+	credential := upstreamCredential(upstream, "")
+	s.tokenCache.Delete(upstreamTokenKey(upstream, []string{scope}, credential))
+	s.tokenCache.Delete(upstreamTokenKey(upstream, scopes, credential))
+	logger := s.log.WithFields(logrus.Fields{
+		"upstream": upstream.Name,
+		"scope":    strings.Join(scopes, " "),
+	})
+	token, err := s.fetchUpstreamToken(upstream, "", scopes, "")
+	if err != nil {
+		logger.WithError(err).Warn("Failed to renew upstream token")
+		return resp, nil
+	}
+	logger.Debug("Upstream token rejected, retrying with a new token")
+	resp.Body.Close()
+	retry := req.Clone(req.Context())
+	retry.Header.Set("Authorization", "Bearer "+token.Token)
+	return upstream.client.Do(retry)
+}
+
+// repositoryScope 拉取上游仓库需要的鉴权范围
+func repositoryScope(remote string) string {
+	return Scope{Type: "repository", Name: remote, Actions: []string{ActionPull}}.String()
+}
+
+func (s *RegistryService) doGet(upstream *Upstream, scope, url string, c *gin.Context) (*http.Response, error) {
+	req, err := s.newUpstreamRequest(upstream, scope, "GET", url, c)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.doUpstream(upstream, req)
 	return resp, err
 }
 
+// LoginUpstream 使用账号密码登录默认上游
 func (s *RegistryService) LoginUpstream(username, password string) (string, error) {
-	url := path.Join(s.config.UpstreamRegistry, "v2", "users", "login")
+	upstream := s.upstreams.Default()
+	url := upstream.URL("v2", "users", "login")
 	jsonBody, err := json.Marshal(map[string]string{
 		"username": username,
 		"password": password,
@@ -59,14 +170,14 @@ func (s *RegistryService) LoginUpstream(username, password string) (string, erro
 		return "", fmt.Errorf("failed to create request: %v", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
-	resp, err := s.client.Do(req)
+	resp, err := upstream.client.Do(req)
 	if err != nil {
 		return "", fmt.Errorf("failed to login: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return "", newUpstreamError(resp)
 	}
 
 	bodyBytes, err := io.ReadAll(resp.Body)
@@ -76,17 +187,19 @@ func (s *RegistryService) LoginUpstream(username, password string) (string, erro
 
 	return string(bodyBytes), nil
 }
-// GetCatalog 从上游仓库获取镜像列表
+
+// GetCatalog 从默认上游仓库获取镜像列表
 func (s *RegistryService) GetCatalog(c *gin.Context) ([]string, error) {
-	url := path.Join(s.config.UpstreamRegistry, "v2", "_catalog")
-	resp, err := s.doGet(url, c)
+	upstream := s.upstreams.Default()
+	url := upstream.URL("v2", "_catalog")
+	resp, err := s.doGet(upstream, "registry:catalog:*", url, c)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get catalog: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return nil, newUpstreamError(resp)
 	}
 
 	var result struct {
@@ -101,15 +214,19 @@ func (s *RegistryService) GetCatalog(c *gin.Context) ([]string, error) {
 
 // GetTags 从上游仓库获取镜像标签列表
 func (s *RegistryService) GetTags(name string, c *gin.Context) ([]string, error) {
-	url := path.Join(s.config.UpstreamRegistry, "v2", name, "tags", "list")
-	resp, err := s.doGet(url, c)
+	upstream, remote, _, err := s.resolve(name, c.Query("ns"))
+	if err != nil {
+		return nil, err
+	}
+	url := upstream.URL("v2", remote, "tags", "list")
+	resp, err := s.doGet(upstream, repositoryScope(remote), url, c)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get tags: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return nil, newUpstreamError(resp)
 	}
 
 	var result struct {
@@ -123,108 +240,524 @@ func (s *RegistryService) GetTags(name string, c *gin.Context) ([]string, error)
 	return result.Tags, nil
 }
 
-// GetManifest 从上游仓库获取镜像manifest
-func (s *RegistryService) GetManifest(name, reference string, c *gin.Context) ([]byte, error) {
-	url := path.Join(s.config.UpstreamRegistry, "v2", name, "manifests", reference)
-	// req, err := http.NewRequest("GET", url, nil)
-	// if err != nil {
-	// 	return nil, fmt.Errorf("failed to create request: %v", err)
-	// }
+// Descriptor 镜像内容的描述信息
+type Descriptor struct {
+	MediaType string
+	Digest    string
+	Size      int64
+}
+
+// cachedManifest 从缓存中获取客户端可接受的 manifest，标签引用需要按 Accept 协商。
+// 请求未由当前服务认证时，先使用客户端的认证头向上游发送 HEAD 请求确认客户端有权访问，
+// 上游拒绝时返回上游的错误，标签已指向其他 manifest 时视为未命中
+func (s *RegistryService) cachedManifest(
+	upstream *Upstream, remote, cacheName, reference string, accept []string, c *gin.Context,
+) (*Manifest, error) {
+	manifest := s.manifestCache.Get(cacheName, reference, accept)
+	if manifest == nil || (!isDigest(reference) && !distribution.Accepts(accept, manifest.ContentType)) {
+		return nil, nil
+	}
+	if !proxyAuthorized(c) {
+		descriptor, err := s.headManifest(upstream, remote, reference, accept, c)
+		if err != nil {
+			return nil, err
+		}
+		if descriptor.Digest != manifest.Digest {
+			return nil, nil
+		}
+	}
+	s.log.WithFields(logrus.Fields{
+		"name":      cacheName,
+		"reference": reference,
+	}).Debug("Manifest cache hit")
+	return manifest, nil
+}
+
+// setAcceptHeader 透传客户端的 Accept，客户端未指定时请求所有支持的 manifest 类型
+func setAcceptHeader(req *http.Request, accept []string) {
+	req.Header.Del("Accept")
+	if len(accept) == 0 {
+		accept = distribution.ManifestMediaTypes
+	}
+	for _, value := range accept {
+		req.Header.Add("Accept", value)
+	}
+}
+
+// GetManifest 获取镜像manifest，优先从缓存读取，未命中时从上游仓库获取并写入缓存，
+// 相同 manifest 的并发请求合并为一次上游请求
+func (s *RegistryService) GetManifest(name, reference string, c *gin.Context) (*Manifest, error) {
+	upstream, remote, cacheName, err := s.resolve(name, c.Query("ns"))
+	if err != nil {
+		return nil, err
+	}
+	accept := c.Request.Header.Values("Accept")
+	manifest, err := s.cachedManifest(upstream, remote, cacheName, reference, accept, c)
+	if err != nil || manifest != nil {
+		return manifest, err
+	}
+
+	key := cacheName + "@" + reference + "|" + strings.Join(accept, ",")
+	if !proxyAuthorized(c) {
+		// 上游 token 的权限只有上游能判断，认证头不同的请求不合并
+		key += "|" + c.GetHeader("Authorization")
+	}
+	fetched, err := s.manifestCalls.Do(key, func() (interface{}, error) {
+		return s.fetchManifest(upstream, remote, cacheName, reference, accept, c)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fetched.(*Manifest), nil
+}
+
+// HeadManifest 获取镜像manifest的描述信息，优先从缓存读取，未命中时向上游发送 HEAD 请求
+func (s *RegistryService) HeadManifest(name, reference string, c *gin.Context) (*Descriptor, error) {
+	upstream, remote, cacheName, err := s.resolve(name, c.Query("ns"))
+	if err != nil {
+		return nil, err
+	}
+	accept := c.Request.Header.Values("Accept")
+	if proxyAuthorized(c) {
+		manifest, err := s.cachedManifest(upstream, remote, cacheName, reference, accept, c)
+		if err != nil {
+			return nil, err
+		}
+		if manifest != nil {
+			return &Descriptor{
+				MediaType: manifest.ContentType,
+				Digest:    manifest.Digest,
+				Size:      int64(len(manifest.Data)),
+			}, nil
+		}
+	}
+	// 未由当前服务认证的请求需要上游确认权限，直接返回上游 HEAD 的结果
+	return s.headManifest(upstream, remote, reference, accept, c)
+}
+
+// headManifest 向上游发送 manifest 的 HEAD 请求
+func (s *RegistryService) headManifest(
+	upstream *Upstream, remote, reference string, accept []string, c *gin.Context,
+) (*Descriptor, error) {
+	url := upstream.URL("v2", remote, "manifests", reference)
+	req, err := s.newUpstreamRequest(upstream, repositoryScope(remote), "HEAD", url, c)
+	if err != nil {
+		return nil, err
+	}
+	setAcceptHeader(req, accept)
+	resp, err := s.doUpstream(upstream, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to head manifest: %v", err)
+	}
+	defer resp.Body.Close()
 
-	// // 设置必要的请求头
-	// req.Header.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json")
+	if resp.StatusCode != http.StatusOK {
+		return nil, newUpstreamError(resp)
+	}
+	descriptor := &Descriptor{
+		MediaType: resp.Header.Get("Content-Type"),
+		Digest:    resp.Header.Get("Docker-Content-Digest"),
+		Size:      resp.ContentLength,
+	}
+	if descriptor.Digest == "" && isDigest(reference) {
+		descriptor.Digest = reference
+	}
+	return descriptor, nil
+}
 
-	resp, err := s.doGet(url, c)
+// fetchManifest 从上游仓库获取镜像manifest，校验摘要后写入缓存
+func (s *RegistryService) fetchManifest(
+	upstream *Upstream, remote, cacheName, reference string, accept []string, c *gin.Context,
+) (*Manifest, error) {
+	url := upstream.URL("v2", remote, "manifests", reference)
+	req, err := s.newUpstreamRequest(upstream, repositoryScope(remote), "GET", url, c)
+	if err != nil {
+		return nil, err
+	}
+	setAcceptHeader(req, accept)
+	resp, err := s.doUpstream(upstream, req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get manifest: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return nil, newUpstreamError(resp)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %v", err)
+	}
+	manifest := &Manifest{
+		Data:        data,
+		ContentType: resp.Header.Get("Content-Type"),
+		Digest:      resp.Header.Get("Docker-Content-Digest"),
+	}
+	if distribution.IsGenericMediaType(manifest.ContentType) {
+		manifest.ContentType = distribution.DetectManifestMediaType(data)
+	}
+	if manifest.ContentType == "" {
+		manifest.ContentType = distribution.MediaTypeDockerManifest
+	}
+
+	// 校验返回内容与请求的摘要、上游声明的摘要一致
+	if isDigest(reference) {
+		if err := verifyDigest(reference, data); err != nil {
+			return nil, err
+		}
+	}
+	if manifest.Digest == "" {
+		if isDigest(reference) {
+			manifest.Digest = reference
+		} else {
+			manifest.Digest = digestOf(data)
+		}
+	} else if err := verifyDigest(manifest.Digest, data); err != nil {
+		return nil, err
+	}
+	s.manifestCache.Put(cacheName, reference, accept, manifest)
+	return manifest, nil
+}
+
+// proxyAuthorized 请求是否已由当前服务认证并检查过权限（本站签发的 token 或 Basic 认证模式），
+// 否则客户端携带的是上游 token，只有上游能判断客户端是否有权访问
+func proxyAuthorized(c *gin.Context) bool {
+	_, exists := c.Get("token")
+	return exists
+}
+
+// authorizeCachedBlob 从缓存返回镜像层之前确认客户端有权从请求的仓库拉取该镜像层：
+// 请求已由当前服务认证且已确认仓库中存在该镜像层时直接通过，否则向上游发送 HEAD 请求，
+// 客户端携带上游 token 时使用客户端的认证头，上游返回错误时拒绝
+func (s *RegistryService) authorizeCachedBlob(upstream *Upstream, remote, cacheName, digest string, c *gin.Context) error {
+	if proxyAuthorized(c) && s.blobCache.Linked(cacheName, digest) {
+		return nil
+	}
+	if _, err := s.headBlob(upstream, remote, digest, c); err != nil {
+		return err
 	}
+	s.blobCache.Link(cacheName, digest)
+	return nil
+}
 
-	return io.ReadAll(resp.Body)
+// GetBlob 获取镜像层及其大小（未知时为 -1），优先从本地缓存读取，未命中时从上游仓库获取并写入缓存，
+// 相同镜像层的并发请求合并为一次上游下载，未开启缓存时同样合并，下载完成后不保留
+func (s *RegistryService) GetBlob(name, digest string, c *gin.Context) (io.ReadCloser, int64, error) {
+	upstream, remote, cacheName, err := s.resolve(name, c.Query("ns"))
+	if err != nil {
+		return nil, 0, err
+	}
+	if blob, size, err := s.blobCache.Open(digest); err == nil {
+		if err := s.authorizeCachedBlob(upstream, remote, cacheName, digest, c); err != nil {
+			blob.Close()
+			return nil, 0, err
+		}
+		s.log.WithField("digest", digest).Debug("Blob cache hit")
+		return blob, size, nil
+	}
+
+	url := upstream.URL("v2", remote, "blobs", digest)
+	req, err := s.newUpstreamRequest(upstream, repositoryScope(remote), "GET", url, c)
+	if err != nil {
+		return nil, 0, err
+	}
+	key := cacheName + "@" + digest
+	if !proxyAuthorized(c) {
+		// 上游 token 的权限只有上游能判断，认证头不同的请求不合并，
+		// 避免发起下载的客户端被上游拒绝时加入的客户端共享该错误
+		key += "|" + c.GetHeader("Authorization")
+	}
+	return s.blobFetches.Fetch(key, digest, req, func(req *http.Request) (*http.Response, error) {
+		resp, err := s.doUpstream(upstream, req)
+		if err == nil && resp.StatusCode == http.StatusOK {
+			s.blobCache.Link(cacheName, digest)
+		}
+		return resp, err
+	}, func() error {
+		return s.authorizeCachedBlob(upstream, remote, cacheName, digest, c)
+	})
 }
 
-// GetBlob 从上游仓库获取镜像层
-func (s *RegistryService) GetBlob(name, digest string, c *gin.Context) (io.ReadCloser, error) {
-	url := path.Join(s.config.UpstreamRegistry, "v2", name, "blobs", digest)
-	resp, err := s.doGet(url, c)
+// HeadBlob 获取镜像层的描述信息，优先从本地缓存读取，未命中时向上游发送 HEAD 请求
+func (s *RegistryService) HeadBlob(name, digest string, c *gin.Context) (*Descriptor, error) {
+	upstream, remote, cacheName, err := s.resolve(name, c.Query("ns"))
 	if err != nil {
-		return nil, fmt.Errorf("failed to get blob: %v", err)
+		return nil, err
 	}
+	if blob, size, err := s.blobCache.Open(digest); err == nil {
+		blob.Close()
+		if err := s.authorizeCachedBlob(upstream, remote, cacheName, digest, c); err != nil {
+			return nil, err
+		}
+		return &Descriptor{
+			MediaType: "application/octet-stream",
+			Digest:    digest,
+			Size:      size,
+		}, nil
+	}
+	return s.headBlob(upstream, remote, digest, c)
+}
+
+// headBlob 向上游发送镜像层的 HEAD 请求
+func (s *RegistryService) headBlob(upstream *Upstream, remote, digest string, c *gin.Context) (*Descriptor, error) {
+	url := upstream.URL("v2", remote, "blobs", digest)
+	req, err := s.newUpstreamRequest(upstream, repositoryScope(remote), "HEAD", url, c)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.doUpstream(upstream, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to head blob: %v", err)
+	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		resp.Body.Close()
-		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		return nil, newUpstreamError(resp)
 	}
+	return &Descriptor{
+		MediaType: "application/octet-stream",
+		Digest:    digest,
+		Size:      resp.ContentLength,
+	}, nil
+}
 
-	return resp.Body, nil
+// VerifyUpstreamToken 按请求选择上游，上游配置了 token 校验时校验客户端携带的上游 token，
+// 以及 token 是否允许请求需要的操作，未配置校验的上游直接通过
+func (s *RegistryService) VerifyUpstreamToken(token string, c *gin.Context, typ, name, action string) error {
+	upstream := s.upstreams.Default()
+	if value, exists := c.Get(distribution.RouteContextKey); exists {
+		var err error
+		if upstream, name, _, err = s.resolve(value.(*distribution.Route).Name, c.Query("ns")); err != nil {
+			return err
+		}
+	}
+	if upstream.verifier == nil {
+		return nil
+	}
+	if err := upstream.verifier.Verify(token, typ, name, action); err != nil {
+		return fmt.Errorf("upstream %s: %w", upstream.Name, err)
+	}
+	return nil
 }
 
-// GetAuthChallenge 获取认证挑战信息
-func (s *RegistryService) GetAuthChallenge() (*http.Response, error) {
-	url := path.Join(s.config.UpstreamRegistry, "v2")
+// GetAuthChallenge 获取上游的认证挑战信息，ns 为空时使用默认上游
+func (s *RegistryService) GetAuthChallenge(ns string) (*http.Response, error) {
+	upstream := s.upstreams.Default()
+	if ns != "" {
+		var err error
+		if upstream, err = s.upstreams.ResolveNamespace(ns); err != nil {
+			return nil, err
+		}
+	}
+	url := upstream.URL("v2") + "/"
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %v", err)
 	}
 
-	resp, err := s.client.Do(req)
+	resp, err := upstream.client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get auth challenge: %v", err)
 	}
+	// 代理持有上游凭据时客户端向当前服务认证，不返回上游的认证挑战
+	if upstream.ProxyAuth() {
+		resp.Header.Del("WWW-Authenticate")
+	}
 
 	return resp, nil
 }
 
-// Authenticate 处理认证请求
+// CanonicalName 返回仓库在权限策略中使用的规范名称，同一仓库的不同写法得到相同的名称，
+// 例如 nginx 为 library/nginx，配置了 ghcr.io/、ghcr/ 前缀时 ghcr/org/app 为 ghcr.io/org/app
+func (s *RegistryService) CanonicalName(name, ns string) (string, error) {
+	upstream, remote, _, err := s.resolve(name, ns)
+	if err != nil {
+		return "", err
+	}
+	return s.upstreams.CanonicalName(upstream, remote), nil
+}
+
+// CanonicalScopes 为鉴权范围中的仓库填写规范名称，无法选择上游的仓库按原名计算权限
+func (s *RegistryService) CanonicalScopes(scopes []Scope, ns string) []Scope {
+	for i, scope := range scopes {
+		if scope.Type != "repository" {
+			continue
+		}
+		if canonical, err := s.CanonicalName(scope.Name, ns); err == nil {
+			scopes[i].Canonical = canonical
+		}
+	}
+	return scopes
+}
+
+// ScopeUpstream 根据鉴权范围中第一个仓库的仓库名选择上游，无法解析时使用默认上游
+func (s *RegistryService) ScopeUpstream(scopes []Scope, ns string) *Upstream {
+	if ns != "" {
+		if upstream, err := s.upstreams.ResolveNamespace(ns); err == nil {
+			return upstream
+		}
+	}
+	for _, scope := range scopes {
+		if scope.Type != "repository" {
+			continue
+		}
+		upstream, _, err := s.upstreams.Resolve(scope.Name)
+		if err != nil {
+			break
+		}
+		return upstream
+	}
+	return s.upstreams.Default()
+}
+
+// upstreamScopes 将鉴权范围中的仓库名改写为上游仓库名，返回上游和改写后的鉴权范围，
+// 上游按第一个仓库选择，ns 不为空时按 ns 选择，属于其他上游的仓库不会转发
+func (s *RegistryService) upstreamScopes(scopes []Scope, ns string) (*Upstream, []string, error) {
+	var upstream *Upstream
+	if ns != "" {
+		var err error
+		if upstream, err = s.upstreams.ResolveNamespace(ns); err != nil {
+			return nil, nil, err
+		}
+	}
+	values := []string{}
+	for _, scope := range scopes {
+		if scope.Type != "repository" {
+			values = append(values, scope.String())
+			continue
+		}
+		scopeUpstream, remote, _, err := s.resolve(scope.Name, ns)
+		if err != nil {
+			return nil, nil, err
+		}
+		if upstream == nil {
+			upstream = scopeUpstream
+		} else if scopeUpstream != upstream {
+			s.log.WithFields(logrus.Fields{
+				"scope":    scope.String(),
+				"upstream": scopeUpstream.Name,
+			}).Warn("Scope belongs to another upstream, skipped")
+			continue
+		}
+		scope.Name = remote
+		values = append(values, scope.String())
+	}
+	if upstream == nil {
+		upstream = s.upstreams.Default()
+	}
+	return upstream, values, nil
+}
+
+// Authenticate 处理认证请求，根据鉴权范围中的仓库名选择上游，
+// 将仓库名改写为上游仓库名后转发给该上游的鉴权服务，ns 不为空时按 ns 选择上游，
+// authHeader 为空时匿名申请 token
 func (s *RegistryService) Authenticate(
-	authHeader string, scope string, serviceName string,
-) (string, error) {
+	authHeader string, scopes []Scope, serviceName string, ns string,
+) (*TokenResponse, error) {
 	// 解析认证头
 	parts := strings.SplitN(authHeader, " ", 2)
-	if len(parts) != 2 || parts[0] != "Basic" {
-		return "", fmt.Errorf("invalid authorization header format")
+	if authHeader != "" && (len(parts) != 2 || parts[0] != "Basic") {
+		return nil, fmt.Errorf("invalid authorization header format")
+	}
+
+	upstream, upstreamScopes, err := s.upstreamScopes(scopes, ns)
+	if err != nil {
+		return nil, err
+	}
+	result, err := s.fetchUpstreamToken(upstream, serviceName, upstreamScopes, authHeader)
+	if err != nil {
+		return nil, err
+	}
+	// 上游的刷新 token 只能用于上游鉴权服务，不返回给客户端
+	result.RefreshToken = ""
+
+	return result, nil
+}
+
+// fetchUpstreamToken 获取上游 token，优先使用缓存，缓存中没有时向上游鉴权服务申请，
+// 上游配置了账号时使用配置的账号，否则使用 authHeader，两者均为空时匿名申请，serviceName 在上游未声明服务名称时使用
+func (s *RegistryService) fetchUpstreamToken(
+	upstream *Upstream, serviceName string, scopes []string, authHeader string,
+) (*TokenResponse, error) {
+	key := upstreamTokenKey(upstream, scopes, upstreamCredential(upstream, authHeader))
+	if token := s.tokenCache.Get(key); token != nil {
+		return token, nil
+	}
+	value, err := s.tokenCache.calls.Do(key, func() (interface{}, error) {
+		fetchedAt := time.Now()
+		token, err := s.requestUpstreamToken(upstream, serviceName, scopes, authHeader)
+		if err != nil {
+			return nil, err
+		}
+		s.tokenCache.Put(key, token, fetchedAt)
+		return token, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// 并发的调用共享同一个结果，返回副本以免调用方互相影响
+	token := *value.(*TokenResponse)
+	return &token, nil
+}
+
+// requestUpstreamToken 向上游鉴权服务申请 token
+func (s *RegistryService) requestUpstreamToken(
+	upstream *Upstream, serviceName string, scopes []string, authHeader string,
+) (*TokenResponse, error) {
+	realm, upstreamService, err := upstream.AuthChallenge()
+	if realm == "" {
+		return nil, fmt.Errorf("failed to get upstream auth realm: %v", err)
+	}
+	if upstreamService != "" {
+		serviceName = upstreamService
 	}
 
 	// 构建认证请求
-	authURL := fmt.Sprintf("%s/token", s.config.UpstreamAuthService)
-	req, err := http.NewRequest("GET", authURL, nil)
+	req, err := http.NewRequest("GET", realm, nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to create auth request: %v", err)
+		return nil, fmt.Errorf("failed to create auth request: %v", err)
 	}
 
 	// 设置查询参数
 	q := req.URL.Query()
 	q.Set("service", serviceName)
-	q.Set("scope", scope)
+	for _, scope := range scopes {
+		q.Add("scope", scope)
+	}
 	req.URL.RawQuery = q.Encode()
 
-	// 设置认证头
-	req.Header.Set("Authorization", authHeader)
+	// 设置认证头，上游配置了账号时使用配置的账号
+	if upstream.Username != "" {
+		req.SetBasicAuth(upstream.Username, upstream.Password)
+	} else if authHeader != "" {
+		req.Header.Set("Authorization", authHeader)
+	}
 
 	// 发送请求
-	resp, err := s.client.Do(req)
+	resp, err := upstream.client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("failed to authenticate: %v", err)
+		return nil, fmt.Errorf("failed to authenticate: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("authentication failed with status: %d", resp.StatusCode)
+		return nil, newUpstreamError(resp)
 	}
 
-	// 解析响应
-	var result struct {
-		Token string `json:"token"`
+	// 解析响应，token 和 access_token 可能只返回其中一个
+	result := &TokenResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return nil, fmt.Errorf("failed to decode auth response: %v", err)
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", fmt.Errorf("failed to decode auth response: %v", err)
+	if result.Token == "" {
+		result.Token = result.AccessToken
+	}
+	if result.AccessToken == "" {
+		result.AccessToken = result.Token
 	}
 
-	return result.Token, nil
+	return result, nil
 }
 
 // func (s *RegistryService) _changeAuthChallenge(
@@ -252,39 +785,13 @@ func (s *RegistryService) ModifyAuthChallenge(
 			newResp.Header[k] = v
 		}
 		newResp.Header.Set("WWW-Authenticate", "Bearer realm=\""+proxyURL+"\",service=\""+s.config.SelfAuthService+"\"")
+		// 返回 401 客户端才会向 realm 换取 token
+		newResp.StatusCode = http.StatusUnauthorized
 
-		return originalResp, nil
-	}
-
-	// 解析认证头
-	// WWW-Authenticate: Bearer realm="xxx",service="xxx",scope="xxx"
-	// 认证头格式举例：
-	// WWW-Authenticate: Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/ubuntu:pull"
-	wwwAuthParts := strings.SplitN(authHeader, " ", 2)
-	if len(wwwAuthParts) != 2 {
-		return originalResp, nil
-	}
-
-	// 解析参数
-	params := make(map[string]string)
-	for _, param := range strings.Split(wwwAuthParts[1], ",") {
-		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
-		if len(kv) == 2 {
-			key := strings.TrimSpace(kv[0])
-			value := strings.Trim(strings.TrimSpace(kv[1]), "\"")
-			params[key] = value
-		}
+		return newResp, nil
 	}
 
-	// 修改realm参数
-	params["realm"] = proxyURL
-
-	// 重建认证头
-	newParams := make([]string, 0, len(params))
-	for k, v := range params {
-		newParams = append(newParams, fmt.Sprintf("%s=\"%s\"", k, v))
-	}
-	newAuthHeader := fmt.Sprintf("%s %s", wwwAuthParts[0], strings.Join(newParams, ","))
+	newAuthHeader := s.RewriteAuthenticateHeader(authHeader, proxyURL, "")
 
 	// 创建新的响应
 	newResp := &http.Response{
@@ -0,0 +1,439 @@
+package service
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/yunnysunny/docker-image-proxy/internal/config"
+	"github.com/yunnysunny/docker-image-proxy/internal/distribution"
+)
+
+// fakeRegistry 只允许携带指定 token 的客户端访问 private/app，其中有一个镜像层，
+// latest 标签按 Accept 返回多架构索引或单架构 manifest
+type fakeRegistry struct {
+	*httptest.Server
+	blob   []byte
+	digest string
+	gets   atomic.Int32 // 镜像层 GET 请求次数
+	heads  atomic.Int32 // 镜像层 HEAD 请求次数
+	pulls  atomic.Int32 // manifest GET 请求次数
+}
+
+var (
+	fakeIndex    = []byte(`{"schemaVersion":2,"mediaType":"` + distribution.MediaTypeOCIIndex + `","manifests":[]}`)
+	fakeManifest = []byte(`{"schemaVersion":2,"mediaType":"` + distribution.MediaTypeDockerManifest + `"}`)
+)
+
+// serveManifest 按 Accept 协商 latest 标签，支持 OCI 索引的客户端得到索引
+func (r *fakeRegistry) serveManifest(w http.ResponseWriter, req *http.Request, reference string) {
+	data, mediaType := fakeManifest, distribution.MediaTypeDockerManifest
+	switch reference {
+	case "latest":
+		if distribution.Accepts(req.Header.Values("Accept"), distribution.MediaTypeOCIIndex) {
+			data, mediaType = fakeIndex, distribution.MediaTypeOCIIndex
+		}
+	case digestOf(fakeIndex):
+		data, mediaType = fakeIndex, distribution.MediaTypeOCIIndex
+	case digestOf(fakeManifest):
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if req.Method == http.MethodGet {
+		r.pulls.Add(1)
+	}
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Docker-Content-Digest", digestOf(data))
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	if req.Method == http.MethodGet {
+		w.Write(data)
+	}
+}
+
+func newFakeRegistry(t *testing.T) *fakeRegistry {
+	t.Helper()
+	registry := &fakeRegistry{blob: []byte("private layer")}
+	registry.digest = digestOf(registry.blob)
+	registry.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer good" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if reference, ok := strings.CutPrefix(r.URL.Path, "/v2/private/app/manifests/"); ok {
+			registry.serveManifest(w, r, reference)
+			return
+		}
+		if r.URL.Path != "/v2/private/app/blobs/"+registry.digest {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodHead {
+			registry.heads.Add(1)
+		} else {
+			registry.gets.Add(1)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(registry.blob)))
+		if r.Method == http.MethodGet {
+			w.Write(registry.blob)
+		}
+	}))
+	t.Cleanup(registry.Close)
+	return registry
+}
+
+func newTestLogger() *logrus.Logger {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	return log
+}
+
+func newTestRegistryService(t *testing.T, upstream string) *RegistryService {
+	t.Helper()
+	return NewRegistryService(newTestLogger(), &config.Config{
+		UpstreamRegistry: upstream,
+		SelfAuthService:  "docker-image-proxy",
+		CacheEnabled:     true,
+		CacheDir:         t.TempDir(),
+		ManifestCacheTTL: time.Minute,
+	})
+}
+
+// newTestContext 创建请求上下文，selfToken 为 true 表示请求已由当前服务认证
+func newTestContext(method, path, authorization string, selfToken bool) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(method, path, nil)
+	if authorization != "" {
+		c.Request.Header.Set("Authorization", authorization)
+	}
+	if selfToken {
+		c.Set("token", &Token{Sub: "alice"})
+	}
+	return c
+}
+
+func readBlob(t *testing.T, s *RegistryService, name, digest string, c *gin.Context) ([]byte, error) {
+	t.Helper()
+	blob, _, err := s.GetBlob(name, digest, c)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+	return io.ReadAll(blob)
+}
+
+func upstreamStatus(err error) int {
+	var upstreamErr *UpstreamError
+	if errors.As(err, &upstreamErr) {
+		return upstreamErr.StatusCode
+	}
+	return 0
+}
+
+func TestCachedBlobRequiresUpstreamAuthorization(t *testing.T) {
+	registry := newFakeRegistry(t)
+	s := newTestRegistryService(t, registry.URL)
+
+	// 有权限的客户端拉取后镜像层进入缓存
+	data, err := readBlob(t, s, "private/app", registry.digest, newTestContext("GET", "/", "Bearer good", false))
+	if err != nil || string(data) != string(registry.blob) {
+		t.Fatalf("authorized pull: data=%q err=%v", data, err)
+	}
+	if _, _, err := s.blobCache.Open(registry.digest); err != nil {
+		t.Fatalf("blob not cached: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		repository    string
+		authorization string
+		selfToken     bool
+		status        int // 期望的上游错误状态码，0 表示成功
+	}{
+		{"forged upstream token", "private/app", "Bearer forged", false, http.StatusUnauthorized},
+		{"anonymous", "private/app", "", false, http.StatusUnauthorized},
+		{"cross repository with upstream token", "public/app", "Bearer good", false, http.StatusNotFound},
+		{"cross repository with self token", "public/app", "", true, http.StatusUnauthorized},
+		{"authorized upstream token", "private/app", "Bearer good", false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readBlob(t, s, tt.repository, registry.digest,
+				newTestContext("GET", "/", tt.authorization, tt.selfToken))
+			if status := upstreamStatus(err); status != tt.status {
+				t.Fatalf("GetBlob: status=%d err=%v, want %d", status, err, tt.status)
+			}
+			_, err = s.HeadBlob(tt.repository, registry.digest, newTestContext("HEAD", "/", tt.authorization, tt.selfToken))
+			if status := upstreamStatus(err); status != tt.status {
+				t.Fatalf("HeadBlob: status=%d err=%v, want %d", status, err, tt.status)
+			}
+		})
+	}
+	if gets := registry.gets.Load(); gets != 1 {
+		t.Fatalf("upstream blob GETs = %d, want 1", gets)
+	}
+}
+
+func TestCachedBlobLinkedForSelfToken(t *testing.T) {
+	registry := newFakeRegistry(t)
+	s := newTestRegistryService(t, registry.URL)
+	if _, err := readBlob(t, s, "private/app", registry.digest, newTestContext("GET", "/", "Bearer good", false)); err != nil {
+		t.Fatal(err)
+	}
+	heads := registry.heads.Load()
+
+	// 已确认仓库中存在该镜像层，当前服务认证的请求直接命中缓存，不再访问上游
+	data, err := readBlob(t, s, "private/app", registry.digest, newTestContext("GET", "/", "", true))
+	if err != nil || string(data) != string(registry.blob) {
+		t.Fatalf("self token pull: data=%q err=%v", data, err)
+	}
+	if registry.heads.Load() != heads || registry.gets.Load() != 1 {
+		t.Fatalf("self token pull reached upstream: heads=%d gets=%d", registry.heads.Load(), registry.gets.Load())
+	}
+}
+
+// newManifestContext 创建指定 Accept 的 manifest 请求上下文
+func newManifestContext(method, authorization string, selfToken bool, accept ...string) *gin.Context {
+	c := newTestContext(method, "/", authorization, selfToken)
+	for _, item := range accept {
+		c.Request.Header.Add("Accept", item)
+	}
+	return c
+}
+
+func TestCachedManifestRequiresUpstreamAuthorization(t *testing.T) {
+	registry := newFakeRegistry(t)
+	s := newTestRegistryService(t, registry.URL)
+	manifest, err := s.GetManifest("private/app", "latest", newManifestContext("GET", "Bearer good", false))
+	if err != nil || manifest.ContentType != distribution.MediaTypeOCIIndex {
+		t.Fatalf("authorized pull: manifest=%v err=%v", manifest, err)
+	}
+
+	tests := []struct {
+		name          string
+		repository    string
+		reference     string
+		authorization string
+		selfToken     bool
+		status        int // 期望的上游错误状态码，0 表示成功
+	}{
+		{"forged upstream token by tag", "private/app", "latest", "Bearer forged", false, http.StatusUnauthorized},
+		{"forged upstream token by digest", "private/app", manifest.Digest, "Bearer forged", false, http.StatusUnauthorized},
+		{"anonymous by digest", "private/app", manifest.Digest, "", false, http.StatusUnauthorized},
+		{"cross repository with upstream token", "public/app", manifest.Digest, "Bearer good", false, http.StatusNotFound},
+		{"cross repository with self token", "public/app", manifest.Digest, "", true, http.StatusUnauthorized},
+		{"authorized upstream token", "private/app", manifest.Digest, "Bearer good", false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.GetManifest(tt.repository, tt.reference, newManifestContext("GET", tt.authorization, tt.selfToken))
+			if status := upstreamStatus(err); status != tt.status {
+				t.Fatalf("GetManifest: status=%d err=%v, want %d", status, err, tt.status)
+			}
+			_, err = s.HeadManifest(tt.repository, tt.reference, newManifestContext("HEAD", tt.authorization, tt.selfToken))
+			if status := upstreamStatus(err); status != tt.status {
+				t.Fatalf("HeadManifest: status=%d err=%v, want %d", status, err, tt.status)
+			}
+		})
+	}
+	if pulls := registry.pulls.Load(); pulls != 1 {
+		t.Fatalf("upstream manifest GETs = %d, want 1", pulls)
+	}
+}
+
+func TestCachedManifestTagKeyedByAccept(t *testing.T) {
+	registry := newFakeRegistry(t)
+	s := newTestRegistryService(t, registry.URL)
+	pull := func(accept ...string) string {
+		t.Helper()
+		manifest, err := s.GetManifest("private/app", "latest", newManifestContext("GET", "Bearer good", false, accept...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return manifest.ContentType
+	}
+
+	if mediaType := pull(); mediaType != distribution.MediaTypeOCIIndex {
+		t.Fatalf("multi-arch pull got %s", mediaType)
+	}
+	// 只支持 schema2 的客户端不能替换已缓存的多架构索引
+	if mediaType := pull(distribution.MediaTypeDockerManifest); mediaType != distribution.MediaTypeDockerManifest {
+		t.Fatalf("schema2 pull got %s", mediaType)
+	}
+	if mediaType := pull(); mediaType != distribution.MediaTypeOCIIndex {
+		t.Fatalf("multi-arch pull after schema2 pull got %s", mediaType)
+	}
+	if pulls := registry.pulls.Load(); pulls != 2 {
+		t.Fatalf("upstream manifest GETs = %d, want 2", pulls)
+	}
+}
+
+func TestBlobWithoutCache(t *testing.T) {
+	registry := newFakeRegistry(t)
+	s := NewRegistryService(newTestLogger(), &config.Config{
+		UpstreamRegistry: registry.URL,
+		SelfAuthService:  "docker-image-proxy",
+	})
+	blob, _, err := s.GetBlob("private/app", registry.digest, newTestContext("GET", "/", "Bearer good", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	data, err := io.ReadAll(blob)
+	if err != nil || string(data) != string(registry.blob) {
+		t.Fatalf("pull: data=%q err=%v", data, err)
+	}
+
+	_, err = readBlob(t, s, "private/app", registry.digest, newTestContext("GET", "/", "Bearer forged", false))
+	if status := upstreamStatus(err); status != http.StatusUnauthorized {
+		t.Fatalf("forged pull: status=%d err=%v", status, err)
+	}
+}
+
+func TestBlobFetchSeparatedByUpstreamToken(t *testing.T) {
+	data := []byte("private layer")
+	digest := digestOf(data)
+	forged := make(chan struct{})
+	good := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer good" {
+			// 被拒绝的请求等待持有有效 token 的请求到达上游后才返回
+			close(forged)
+			select {
+			case <-good:
+			case <-time.After(2 * time.Second):
+			}
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		close(good)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	}))
+	t.Cleanup(upstream.Close)
+	s := newTestRegistryService(t, upstream.URL)
+
+	denied := make(chan error, 1)
+	go func() {
+		_, err := readBlob(t, s, "private/app", digest, newTestContext("GET", "/", "Bearer forged", false))
+		denied <- err
+	}()
+	<-forged
+	// 认证头不同的请求不加入被拒绝的下载
+	got, err := readBlob(t, s, "private/app", digest, newTestContext("GET", "/", "Bearer good", false))
+	if err != nil || string(got) != string(data) {
+		t.Fatalf("good pull: data=%q err=%v", got, err)
+	}
+	if status := upstreamStatus(<-denied); status != http.StatusUnauthorized {
+		t.Fatalf("forged pull: status=%d", status)
+	}
+}
+
+// fakeTokenRegistry 带有鉴权服务的上游，只给 robot 账号签发 token，
+// private/app 的标签列表只允许最近签发的 token 访问
+type fakeTokenRegistry struct {
+	*httptest.Server
+	issued atomic.Int32 // 签发的 token 数量
+	token  atomic.Value // 当前有效的 token
+}
+
+func newFakeTokenRegistry(t *testing.T) *fakeTokenRegistry {
+	t.Helper()
+	registry := &fakeTokenRegistry{}
+	registry.token.Store("")
+	registry.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			username, password, ok := r.BasicAuth()
+			if !ok || username != "robot" || password != "robot-password" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if r.URL.Query().Get("scope") != "repository:private/app:pull" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			token := "token-" + strconv.Itoa(int(registry.issued.Add(1)))
+			registry.token.Store(token)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"token":"` + token + `","expires_in":300}`))
+		case "/v2/private/app/tags/list":
+			if r.Header.Get("Authorization") != "Bearer "+registry.token.Load().(string) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="`+registry.URL+`/token",service="registry.example.com",scope="repository:private/app:pull"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"name":"private/app","tags":["latest"]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(registry.Close)
+	return registry
+}
+
+// newProxyAuthService 创建持有上游 robot 账号的服务
+func newProxyAuthService(t *testing.T, registry string) *RegistryService {
+	t.Helper()
+	secrets := filepath.Join(t.TempDir(), "secrets.json")
+	if err := os.WriteFile(secrets, []byte(`{"default": {"username": "robot", "password": "robot-password"}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return NewRegistryService(newTestLogger(), &config.Config{
+		UpstreamRegistry:    registry,
+		UpstreamAuthService: registry,
+		UpstreamSecrets:     secrets,
+		SelfAuthService:     "docker-image-proxy",
+	})
+}
+
+func TestProxyHeldUpstreamCredentials(t *testing.T) {
+	registry := newFakeTokenRegistry(t)
+	s := newProxyAuthService(t, registry.URL)
+	if !s.Upstreams().Default().ProxyAuth() {
+		t.Fatal("upstream with credentials from the secrets file should use proxy authentication")
+	}
+
+	// 客户端只通过了当前服务的认证，没有上游凭据
+	tags, err := s.GetTags("private/app", newTestContext(http.MethodGet, "/v2/private/app/tags/list", "", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 1 || tags[0] != "latest" || registry.issued.Load() != 1 {
+		t.Fatalf("tags = %v, issued = %d, want [latest] with one upstream token", tags, registry.issued.Load())
+	}
+
+	// 客户端向当前服务认证，/v2/ 不返回上游的认证挑战
+	resp, err := s.GetAuthChallenge("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("WWW-Authenticate") != "" {
+		t.Fatalf("WWW-Authenticate = %q, want upstream challenge removed", resp.Header.Get("WWW-Authenticate"))
+	}
+
+	// 没有上游凭据时匿名换取的 token 无法访问私有仓库
+	anonymous := NewRegistryService(newTestLogger(), &config.Config{
+		UpstreamRegistry:    registry.URL,
+		UpstreamAuthService: registry.URL,
+		AuthMode:            config.AuthModeBasic,
+	})
+	if _, err := anonymous.GetTags("private/app", newTestContext(http.MethodGet, "/v2/private/app/tags/list", "", true)); err == nil {
+		t.Fatal("private repository readable with an anonymous upstream token")
+	}
+	if registry.issued.Load() != 1 {
+		t.Fatalf("issued = %d, want no token for anonymous requests", registry.issued.Load())
+	}
+}
@@ -0,0 +1,229 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/yunnysunny/docker-image-proxy/internal/config"
+)
+
+// Revocations 吊销列表的内容
+type Revocations struct {
+	// 按 jti 吊销的 token，值为 token 的过期时间（Unix 秒），过期后从列表中清除
+	Tokens map[string]int64 `json:"tokens"`
+	// 按用户吊销的 token，值为时间（Unix 秒），该用户在此时间及之前签发的 token 全部失效
+	Subjects map[string]int64 `json:"subjects"`
+}
+
+// clone 复制吊销列表
+func (r Revocations) clone() Revocations {
+	copied := Revocations{Tokens: make(map[string]int64, len(r.Tokens)), Subjects: make(map[string]int64, len(r.Subjects))}
+	for jti, exp := range r.Tokens {
+		copied.Tokens[jti] = exp
+	}
+	for subject, before := range r.Subjects {
+		copied.Subjects[subject] = before
+	}
+	return copied
+}
+
+// RevocationList 已吊销 token 的列表，保存在 REVOCATION_FILE 中，文件被其他进程修改后自动重新加载，
+// 修改时持有文件锁并在最新的文件内容上修改，同一主机上的多个代理副本可以共享同一个文件
+type RevocationList struct {
+	log    *logrus.Logger
+	path   string
+	maxTTL time.Duration // 未知过期时间的 token 在列表中保留的时长
+
+	mu      sync.RWMutex
+	modTime time.Time
+	data    Revocations
+}
+
+// NewRevocationList 加载吊销列表，文件不存在时视为空列表；REVOCATION_FILE 默认为 data/revocations.json，
+// 设置为空时只保存在内存中，重启后丢失
+func NewRevocationList(log *logrus.Logger, config *config.Config) *RevocationList {
+	list := &RevocationList{
+		log:    log,
+		path:   config.RevocationFile,
+		maxTTL: config.TokenTTL,
+		data:   Revocations{Tokens: map[string]int64{}, Subjects: map[string]int64{}},
+	}
+	if config.RefreshTokenTTL > list.maxTTL {
+		list.maxTTL = config.RefreshTokenTTL
+	}
+	if list.path == "" {
+		return list
+	}
+	if err := list.reloadIfChanged(); err != nil {
+		log.WithError(err).WithField("file", list.path).Fatal("Failed to load revocation file")
+	}
+	return list
+}
+
+// IsRevoked 判断 token 是否已被吊销
+func (l *RevocationList) IsRevoked(token *Token) bool {
+	if err := l.reloadIfChanged(); err != nil {
+		l.log.WithError(err).WithField("file", l.path).Error("Failed to reload revocation file, using previous list")
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if _, exists := l.data.Tokens[token.Jti]; exists && token.Jti != "" {
+		return true
+	}
+	before, exists := l.data.Subjects[token.Sub]
+	return exists && token.Iat <= before
+}
+
+// RevokeToken 按 jti 吊销 token，expiresAt 为零值时按最长的 token 有效期保留
+func (l *RevocationList) RevokeToken(jti string, expiresAt time.Time) error {
+	if jti == "" {
+		return errors.New("jti is required")
+	}
+	if expiresAt.IsZero() {
+		expiresAt = time.Now().Add(l.maxTTL)
+	}
+	return l.update(func(data *Revocations) {
+		data.Tokens[jti] = expiresAt.Unix()
+	})
+}
+
+// RevokeSubject 吊销用户在 before 及之前签发的全部 token，before 为零值时使用当前时间
+func (l *RevocationList) RevokeSubject(subject string, before time.Time) error {
+	if subject == "" {
+		return errors.New("subject is required")
+	}
+	if before.IsZero() {
+		before = time.Now()
+	}
+	return l.update(func(data *Revocations) {
+		if before.Unix() > data.Subjects[subject] {
+			data.Subjects[subject] = before.Unix()
+		}
+	})
+}
+
+// List 返回当前的吊销列表
+func (l *RevocationList) List() Revocations {
+	if err := l.reloadIfChanged(); err != nil {
+		l.log.WithError(err).WithField("file", l.path).Error("Failed to reload revocation file, using previous list")
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.data.clone()
+}
+
+// update 持有文件锁，在重新读取的最新列表的副本上执行修改，清除已过期的 jti 后写回文件，
+// 避免并发修改的进程互相覆盖；写入成功后才替换内存中的列表，写入失败时内存与文件保持一致
+func (l *RevocationList) update(fn func(data *Revocations)) error {
+	if l.path != "" {
+		unlock, err := lockFile(l.path)
+		if err != nil {
+			return fmt.Errorf("failed to lock revocation file: %v", err)
+		}
+		defer unlock()
+		// 修改时间的精度有限，持有锁后总是重新读取
+		if err := l.load(); err != nil {
+			return err
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	data := l.data.clone()
+	fn(&data)
+	now := time.Now().Unix()
+	for jti, exp := range data.Tokens {
+		if exp < now {
+			delete(data.Tokens, jti)
+		}
+	}
+	// 用户吊销时间早于最长有效期之前时，该用户被吊销的 token 均已过期
+	for subject, before := range data.Subjects {
+		if before < now-int64(l.maxTTL/time.Second) {
+			delete(data.Subjects, subject)
+		}
+	}
+	if err := l.saveLocked(data); err != nil {
+		return err
+	}
+	l.data = data
+	return nil
+}
+
+// saveLocked 写入吊销列表文件，调用方需持有锁
+func (l *RevocationList) saveLocked(revocations Revocations) error {
+	if l.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(revocations, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(l.path, data, 0o600); err != nil {
+		return fmt.Errorf("failed to save revocation file: %v", err)
+	}
+	if info, err := os.Stat(l.path); err == nil {
+		l.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// reloadIfChanged 文件修改时间变化时重新加载
+func (l *RevocationList) reloadIfChanged() error {
+	if l.path == "" {
+		return nil
+	}
+	info, err := os.Stat(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	l.mu.RLock()
+	changed := !info.ModTime().Equal(l.modTime)
+	l.mu.RUnlock()
+	if !changed {
+		return nil
+	}
+	return l.load()
+}
+
+// load 读取吊销列表文件，文件不存在时保持当前列表
+func (l *RevocationList) load() error {
+	info, err := os.Stat(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	raw, err := os.ReadFile(l.path)
+	if err != nil {
+		return err
+	}
+	data := Revocations{}
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return fmt.Errorf("failed to parse revocation file: %v", err)
+	}
+	if data.Tokens == nil {
+		data.Tokens = map[string]int64{}
+	}
+	if data.Subjects == nil {
+		data.Subjects = map[string]int64{}
+	}
+	l.mu.Lock()
+	l.data = data
+	l.modTime = info.ModTime()
+	l.mu.Unlock()
+	l.log.WithFields(logrus.Fields{
+		"file":     l.path,
+		"tokens":   len(data.Tokens),
+		"subjects": len(data.Subjects),
+	}).Info("Revocation file loaded")
+	return nil
+}
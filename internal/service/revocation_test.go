@@ -0,0 +1,68 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yunnysunny/docker-image-proxy/internal/config"
+)
+
+func TestRevocationListConcurrentWriters(t *testing.T) {
+	cfg := &config.Config{
+		RevocationFile: filepath.Join(t.TempDir(), "revocations.json"),
+		TokenTTL:       time.Hour,
+	}
+	// 两个实例模拟共享同一个文件的两个进程
+	lists := []*RevocationList{NewRevocationList(newTestLogger(), cfg), NewRevocationList(newTestLogger(), cfg)}
+
+	const perList = 20
+	var wg sync.WaitGroup
+	for i, list := range lists {
+		wg.Add(1)
+		go func(i int, list *RevocationList) {
+			defer wg.Done()
+			for j := 0; j < perList; j++ {
+				if err := list.RevokeToken(fmt.Sprintf("jti-%d-%d", i, j), time.Time{}); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i, list)
+	}
+	wg.Wait()
+
+	reloaded := NewRevocationList(newTestLogger(), cfg)
+	if tokens := reloaded.List().Tokens; len(tokens) != len(lists)*perList {
+		t.Fatalf("revoked tokens = %d, want %d", len(tokens), len(lists)*perList)
+	}
+}
+
+func TestRevocationListFailedWriteKeepsMemory(t *testing.T) {
+	cfg := &config.Config{
+		RevocationFile: filepath.Join(t.TempDir(), "revocations.json"),
+		TokenTTL:       time.Hour,
+	}
+	list := NewRevocationList(newTestLogger(), cfg)
+	if err := list.RevokeToken("kept", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	err := list.update(func(data *Revocations) {
+		data.Tokens["lost"] = time.Now().Add(time.Hour).Unix()
+		// 文件路径被目录占用，写入失败
+		os.Remove(cfg.RevocationFile)
+		os.Mkdir(cfg.RevocationFile, 0o755)
+	})
+	if err == nil {
+		t.Fatal("update succeeded, want write error")
+	}
+	tokens := list.List().Tokens
+	if _, ok := tokens["lost"]; ok {
+		t.Fatal("failed update applied in memory")
+	}
+	if _, ok := tokens["kept"]; !ok {
+		t.Fatal("previous revocation lost")
+	}
+}
@@ -0,0 +1,148 @@
+package service
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/yunnysunny/docker-image-proxy/internal/distribution"
+)
+
+// Scope 鉴权范围，格式为 <type>:<name>:<actions>，例如 repository:library/ubuntu:pull,push
+type Scope struct {
+	Type    string
+	Name    string
+	Actions []string
+	// 权限策略中使用的规范仓库名，见 RegistryService.CanonicalScopes，为空时使用 Name
+	Canonical string
+}
+
+// policyName 按权限策略和权限上限计算操作时使用的资源名称
+func (s Scope) policyName() string {
+	if s.Canonical != "" {
+		return s.Canonical
+	}
+	return s.Name
+}
+
+// hostRegexp 仓库名开头的镜像仓库地址，可以带端口号，例如 ghcr.io、host:5000
+var hostRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*(:[0-9]+)?$`)
+
+// validScopeName 判断鉴权范围中的仓库名是否合法，仓库名前可以带 host[:port]/ 前缀，
+// 不能包含 * 等通配符，否则签发的 token 可以访问权限上限之外的仓库
+func validScopeName(name string) bool {
+	if host, rest, ok := strings.Cut(name, "/"); ok && strings.Contains(host, ":") {
+		if !hostRegexp.MatchString(host) {
+			return false
+		}
+		name = rest
+	}
+	return distribution.ValidName(name)
+}
+
+// parseScope 解析鉴权范围，仓库名中可能包含端口号（例如 host:5000/app），
+// 因此类型取第一个冒号之前的部分，操作取最后一个冒号之后的部分，多个操作以逗号分隔
+func parseScope(scope string) (Scope, bool) {
+	first := strings.Index(scope, ":")
+	last := strings.LastIndex(scope, ":")
+	if first <= 0 || last == first || last == first+1 || last == len(scope)-1 {
+		return Scope{}, false
+	}
+	actions := []string{}
+	for _, action := range strings.Split(scope[last+1:], ",") {
+		if action != "" {
+			actions = append(actions, action)
+		}
+	}
+	if len(actions) == 0 {
+		return Scope{}, false
+	}
+	typ, name := scope[:first], scope[first+1:last]
+	if typ == "repository" && !validScopeName(name) {
+		return Scope{}, false
+	}
+	return Scope{
+		Type:    typ,
+		Name:    name,
+		Actions: actions,
+	}, true
+}
+
+// ParseScopes 解析请求中的全部鉴权范围，每个参数中也可以包含以空格分隔的多个范围，
+// 相同资源的操作合并为一项，任一范围格式错误时返回错误
+func ParseScopes(values []string) ([]Scope, error) {
+	scopes := []Scope{}
+	index := map[string]int{}
+	for _, value := range values {
+		for _, item := range strings.Fields(value) {
+			scope, ok := parseScope(item)
+			if !ok {
+				return nil, fmt.Errorf("invalid scope: %q", item)
+			}
+			key := scope.Type + ":" + scope.Name
+			if i, exists := index[key]; exists {
+				scopes[i].Actions = mergeActions(scopes[i].Actions, scope.Actions)
+				continue
+			}
+			index[key] = len(scopes)
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes, nil
+}
+
+// mergeActions 合并操作列表并去重，保持原有顺序
+func mergeActions(actions []string, more []string) []string {
+	for _, action := range more {
+		if !containsString(actions, action) {
+			actions = append(actions, action)
+		}
+	}
+	return actions
+}
+
+func containsString(items []string, value string) bool {
+	for _, item := range items {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (s Scope) String() string {
+	return s.Type + ":" + s.Name + ":" + strings.Join(s.Actions, ",")
+}
+
+// MatchRepository 判断仓库名是否匹配模式，按 / 分段匹配：
+//   - * 匹配单个路径段中的任意字符，例如 myorg/* 匹配 myorg/app，不匹配 myorg/team/app
+//   - ** 匹配任意多个路径段，例如 library/** 匹配 library/nginx、library/a/b
+//   - 单独的 * 或 ** 匹配所有仓库
+func MatchRepository(pattern, name string) bool {
+	if pattern == "*" || pattern == "**" {
+		return true
+	}
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(patterns, segments []string) bool {
+	for len(patterns) > 0 {
+		if patterns[0] == "**" {
+			for i := len(segments); i >= 0; i-- {
+				if matchSegments(patterns[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		if ok, err := path.Match(patterns[0], segments[0]); err != nil || !ok {
+			return false
+		}
+		patterns, segments = patterns[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
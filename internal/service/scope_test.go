@@ -0,0 +1,89 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseScopes(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  []string
+		scopes  []Scope
+		wantErr bool
+	}{
+		{"empty", nil, []Scope{}, false},
+		{"single", []string{"repository:library/ubuntu:pull"},
+			[]Scope{{Type: "repository", Name: "library/ubuntu", Actions: []string{"pull"}}}, false},
+		{"multiple actions", []string{"repository:myorg/app:pull,push"},
+			[]Scope{{Type: "repository", Name: "myorg/app", Actions: []string{"pull", "push"}}}, false},
+		{"registry port in name", []string{"repository:host:5000/app:pull"},
+			[]Scope{{Type: "repository", Name: "host:5000/app", Actions: []string{"pull"}}}, false},
+		{"registry host in name", []string{"repository:ghcr.io/org/app:pull"},
+			[]Scope{{Type: "repository", Name: "ghcr.io/org/app", Actions: []string{"pull"}}}, false},
+		{"space separated", []string{"repository:a:pull registry:catalog:*"},
+			[]Scope{
+				{Type: "repository", Name: "a", Actions: []string{"pull"}},
+				{Type: "registry", Name: "catalog", Actions: []string{"*"}},
+			}, false},
+		{"same resource merged", []string{"repository:a:pull", "repository:a:push,pull"},
+			[]Scope{{Type: "repository", Name: "a", Actions: []string{"pull", "push"}}}, false},
+		{"empty actions skipped", []string{"repository:a:pull,,push"},
+			[]Scope{{Type: "repository", Name: "a", Actions: []string{"pull", "push"}}}, false},
+		{"missing actions", []string{"repository:a"}, nil, true},
+		{"empty name", []string{"repository::pull"}, nil, true},
+		{"empty type", []string{":a:pull"}, nil, true},
+		{"trailing colon", []string{"repository:a:"}, nil, true},
+		{"only commas", []string{"repository:a:,"}, nil, true},
+		{"wildcard name", []string{"repository:*:pull"}, nil, true},
+		{"wildcard path", []string{"repository:myorg/*:pull"}, nil, true},
+		{"double wildcard", []string{"repository:**:pull"}, nil, true},
+		{"uppercase name", []string{"repository:MyOrg/App:pull"}, nil, true},
+		{"wildcard after port", []string{"repository:host:5000/*:pull"}, nil, true},
+		{"invalid port", []string{"repository:host:50a0/app:pull"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scopes, err := ParseScopes(tt.values)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseScopes(%q) err = %v, wantErr %v", tt.values, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(scopes, tt.scopes) {
+				t.Fatalf("ParseScopes(%q) = %+v, want %+v", tt.values, scopes, tt.scopes)
+			}
+		})
+	}
+}
+
+func TestMatchRepository(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"*", "library/nginx", true},
+		{"**", "a/b/c", true},
+		{"library/nginx", "library/nginx", true},
+		{"library/nginx", "library/nginx2", false},
+		{"myorg/*", "myorg/app", true},
+		{"myorg/*", "myorg/team/app", false},
+		{"myorg/*", "other/app", false},
+		{"myorg/app-*", "myorg/app-web", true},
+		{"library/**", "library/nginx", true},
+		{"library/**", "library/a/b", true},
+		{"library/**", "libraryx/nginx", false},
+		{"**/nginx", "library/nginx", true},
+		{"**/nginx", "a/b/nginx", true},
+		{"a/**/z", "a/z", true},
+		{"a/**/z", "a/b/c/z", true},
+		{"a/**/z", "a/b/c", false},
+		{"ghcr.io/org/*", "ghcr.io/org/app", true},
+		{"ghcr.io/org/*", "ghcr/org/app", false},
+		{"[", "[", false}, // 无效模式不匹配
+	}
+	for _, tt := range tests {
+		if got := MatchRepository(tt.pattern, tt.name); got != tt.match {
+			t.Errorf("MatchRepository(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.match)
+		}
+	}
+}
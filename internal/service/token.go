@@ -1,8 +1,8 @@
 package service
 
 import (
+	"encoding/json"
 	"errors"
-	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -14,6 +14,12 @@ import (
 type TokenService struct {
 	log    *logrus.Logger
 	config *config.Config
+	policy *Policy
+	keys   *tokenKeys
+	// 已吊销的 token
+	revocations *RevocationList
+	// 机器人账号和个人访问令牌
+	credentials *CredentialStore
 }
 type Access struct {
 	Type    string   `json:"type"`
@@ -21,7 +27,7 @@ type Access struct {
 	Name    string   `json:"name"`
 }
 type Token struct {
-	Aud    string   `json:"aud"`
+	Aud    Audience `json:"aud"`
 	Iss    string   `json:"iss"`
 	Sub    string   `json:"sub"`
 	Jti    string   `json:"jti"`
@@ -29,11 +35,50 @@ type Token struct {
 	Iat    int64    `json:"iat"`
 	Nbf    int64    `json:"nbf"`
 	Access []Access `json:"access"`
+	// token 类型，访问 token 为空，刷新 token 为 refresh
+	TokenType string `json:"token_type,omitempty"`
+	// 上游鉴权服务签发的 token，见 WrapUpstreamToken，校验通过后转发给上游
+	Upstream string `json:"upstream,omitempty"`
+}
+
+// ErrTokenRevoked token 已被吊销
+var ErrTokenRevoked = errors.New("token revoked")
+
+// TokenTypeRefresh 刷新 token 的类型
+const TokenTypeRefresh = "refresh"
+
+// TokenResponse 鉴权服务的响应，格式见 Docker 的 token 规范
+type TokenResponse struct {
+	Token        string `json:"token"`
+	AccessToken  string `json:"access_token"`
+	ExpiresIn    int64  `json:"expires_in,omitempty"`
+	IssuedAt     string `json:"issued_at,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+// Audience token 的 aud，只有一个值时序列化为字符串，解析时同时兼容字符串和数组两种格式，
+// 以便解析上游签发的 token
+type Audience []string
+
+func (a Audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var claims jwt.ClaimStrings
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return err
+	}
+	*a = Audience(claims)
+	return nil
 }
 
 // GetAudience implements jwt.Claims.
 func (t *Token) GetAudience() (jwt.ClaimStrings, error) {
-	return jwt.ClaimStrings{t.Aud}, nil
+	return jwt.ClaimStrings(t.Aud), nil
 }
 
 // GetExpirationTime implements jwt.Claims.
@@ -61,66 +106,225 @@ func (t *Token) GetSubject() (string, error) {
 	return t.Sub, nil
 }
 
+// Allows 判断 token 是否包含对指定资源执行指定操作的权限，资源名支持通配符，规则同 MatchRepository，操作 * 表示全部操作
+func (t *Token) Allows(typ, name, action string) bool {
+	for _, access := range t.Access {
+		if access.Type != typ || !MatchRepository(access.Name, name) {
+			continue
+		}
+		for _, granted := range access.Actions {
+			if granted == action || granted == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func NewTokenService(log *logrus.Logger, config *config.Config) *TokenService {
 	return &TokenService{
-		log:    log,
-		config: config,
+		log:         log,
+		config:      config,
+		policy:      NewPolicy(log, config),
+		keys:        newTokenKeys(log, config),
+		revocations: NewRevocationList(log, config),
+		credentials: NewCredentialStore(log, config),
 	}
 }
 
+// grantActions 计算请求的操作与允许的操作的交集，请求 * 时授予全部允许的操作
+func grantActions(requested []string, permitted []string) []string {
+	granted := []string{}
+	for _, action := range requested {
+		if containsString(permitted, "*") || containsString(permitted, action) {
+			granted = mergeActions(granted, []string{action})
+		} else if action == "*" {
+			granted = mergeActions(granted, permitted)
+		}
+	}
+	return granted
+}
+
+// GrantScopes 按权限策略计算用户对每个资源可以获得的操作，即请求的操作与允许的操作的交集，
+// 没有可授予的操作时该资源的 Actions 为空；subject 为空表示匿名用户
+func (s *TokenService) GrantScopes(subject string, scopes []Scope) []Scope {
+	granted := make([]Scope, 0, len(scopes))
+	for _, scope := range scopes {
+		scope.Actions = grantActions(scope.Actions, s.policy.Actions(subject, scope.Type, scope.policyName()))
+		granted = append(granted, scope)
+	}
+	return granted
+}
+
+// Permits 按当前的权限策略判断用户是否可以对资源执行指定操作，策略变更后已签发的 token 同样受限
+func (s *TokenService) Permits(subject, typ, name, action string) bool {
+	return len(grantActions([]string{action}, s.policy.Actions(subject, typ, name))) > 0
+}
+
 /*
+GetDockerRegistryToken 为用户签发当前服务的 token，每个资源对应一项 access，
+授予的操作见 GrantScopes，scopes 为空时签发不含任何权限的 token（例如 docker login）。
+
 scope 格式举例:
 - repository:library/ubuntu:pull
-- repository:library/ubuntu:push
-- repository:library/ubuntu:all
-- repository:library/ubuntu:read
+- repository:library/ubuntu:pull,push
+- repository:host:5000/app:pull
+- registry:catalog:*
 */
-func (s *TokenService) GetDockerRegistryToken(scope string) (string, error) {
-	parts := strings.Split(scope, ":")
-	typ := parts[0] // 修正变量名，避免与关键字冲突
-	name := parts[1]
-	action := parts[2]
-	token := &Token{
-		Aud: s.config.SelfRegistry,
-		Iss: s.config.SelfRegistry,
-		Sub: s.config.SelfRegistry,
+func (s *TokenService) GetDockerRegistryToken(subject string, scopes []Scope) (*TokenResponse, error) {
+	return s.GetDockerRegistryTokenUntil(subject, scopes, time.Time{})
+}
+
+// GetDockerRegistryTokenUntil 同 GetDockerRegistryToken，notAfter 不为零值时 token 的过期时间不晚于 notAfter，
+// 用于有过期时间的凭据
+func (s *TokenService) GetDockerRegistryTokenUntil(subject string, scopes []Scope, notAfter time.Time) (*TokenResponse, error) {
+	access := []Access{}
+	for _, scope := range s.GrantScopes(subject, scopes) {
+		access = append(access, Access{
+			Type:    scope.Type,
+			Actions: scope.Actions,
+			Name:    scope.Name,
+		})
+	}
+	now := time.Now()
+	ttl := s.config.TokenTTL
+	if !notAfter.IsZero() && notAfter.Sub(now) < ttl {
+		ttl = notAfter.Sub(now)
+	}
+	token := s.newToken(subject, now, ttl)
+	token.Access = access
+	tokenString, err := s.keys.sign(token)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenResponse{
+		Token:       tokenString,
+		AccessToken: tokenString,
+		ExpiresIn:   int64(ttl / time.Second),
+		IssuedAt:    now.UTC().Format(time.RFC3339),
+	}, nil
+}
+
+// WrapUpstreamToken 将上游鉴权服务为用户签发的 token 包装为当前服务的 token，
+// 校验时按 token 中的用户检查权限策略，然后将上游 token 转发给上游；
+// 有效期不超过 TOKEN_TTL 和上游 token 的有效期，上游未返回 expires_in 时按 60 秒计算
+func (s *TokenService) WrapUpstreamToken(subject string, scopes []Scope, upstream *TokenResponse) (*TokenResponse, error) {
+	access := []Access{}
+	for _, scope := range scopes {
+		access = append(access, Access{
+			Type:    scope.Type,
+			Actions: scope.Actions,
+			Name:    scope.Name,
+		})
+	}
+	upstreamToken := upstream.Token
+	if upstreamToken == "" {
+		upstreamToken = upstream.AccessToken
+	}
+	now := time.Now()
+	ttl := upstreamTokenDefaultTTL
+	if upstream.ExpiresIn > 0 {
+		ttl = time.Duration(upstream.ExpiresIn) * time.Second
+	}
+	if s.config.TokenTTL < ttl {
+		ttl = s.config.TokenTTL
+	}
+	token := s.newToken(subject, now, ttl)
+	token.Access = access
+	token.Upstream = upstreamToken
+	tokenString, err := s.keys.sign(token)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenResponse{
+		Token:       tokenString,
+		AccessToken: tokenString,
+		ExpiresIn:   int64(ttl / time.Second),
+		IssuedAt:    now.UTC().Format(time.RFC3339),
+	}, nil
+}
+
+// newToken 创建当前服务的 token，aud 和 iss 均为当前服务的鉴权服务名称
+func (s *TokenService) newToken(subject string, now time.Time, ttl time.Duration) *Token {
+	return &Token{
+		Aud: Audience{s.config.SelfAuthService},
+		Iss: s.config.SelfAuthService,
+		Sub: subject,
 		Jti: uuid.New().String(),
-		Exp: time.Now().Add(time.Hour * 24).Unix(),
-		Iat: time.Now().Unix(),
-		Nbf: time.Now().Unix(),
-		Access: []Access{
-			{
-				Type:    typ,
-				Actions: []string{action},
-				Name:    name,
-			},
-		},
-	}
-	tokenString, err := jwt.NewWithClaims(jwt.SigningMethodHS256, token).SignedString(
-		[]byte(s.config.ServerSecret),
-	)
+		Exp: now.Add(ttl).Unix(),
+		Iat: now.Unix(),
+		Nbf: now.Unix(),
+	}
+}
+
+// GetRefreshToken 为用户签发刷新 token，客户端可以使用刷新 token 换取访问 token 而不必再次提供密码
+func (s *TokenService) GetRefreshToken(subject string) (string, error) {
+	token := s.newToken(subject, time.Now(), s.config.RefreshTokenTTL)
+	token.TokenType = TokenTypeRefresh
+	return s.keys.sign(token)
+}
+
+// GetRefreshTokenClaims 校验刷新 token
+func (s *TokenService) GetRefreshTokenClaims(tokenString string) (*Token, error) {
+	claims, err := s.parseToken(tokenString)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if claims.TokenType != TokenTypeRefresh {
+		return nil, errors.New("not a refresh token")
 	}
-	return tokenString, nil
+	return claims, nil
+}
+
+// Revocations 已吊销 token 的列表
+func (s *TokenService) Revocations() *RevocationList {
+	return s.revocations
+}
+
+// Credentials 机器人账号和个人访问令牌
+func (s *TokenService) Credentials() *CredentialStore {
+	return s.credentials
+}
+
+// JWKS 校验当前服务 token 的公钥集合，使用 HS256 签名时为空
+func (s *TokenService) JWKS() JWKSet {
+	return s.keys.jwks
 }
 
+// GetToken 校验当前服务签发的访问 token，包括签名、有效期、iss、aud 以及是否已被吊销
 func (s *TokenService) GetToken(tokenString string) (*Token, error) {
+	claims, err := s.parseToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.TokenType != "" {
+		return nil, errors.New("not an access token")
+	}
+	return claims, nil
+}
 
-	token, err := jwt.ParseWithClaims(tokenString, &Token{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(s.config.ServerSecret), nil
-	})
+func (s *TokenService) parseToken(tokenString string) (*Token, error) {
+	token, err := jwt.ParseWithClaims(
+		tokenString, &Token{}, s.keys.keyFunc,
+		jwt.WithValidMethods(s.keys.methods),
+		jwt.WithIssuer(s.config.SelfAuthService),
+		jwt.WithAudience(s.config.SelfAuthService),
+	)
 	if err != nil {
 		return nil, err
 	}
-	if claims, ok := token.Claims.(*Token); ok && token.Valid {
-		return claims, nil
+	claims, ok := token.Claims.(*Token)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	if s.revocations.IsRevoked(claims) {
+		return nil, ErrTokenRevoked
 	}
-	return nil, errors.New("invalid token")
+	return claims, nil
 }
 
 func (s *TokenService) GetUnverifiedToken(tokenString string) (*Token, error) {
-	token, _,err := new (jwt.Parser).ParseUnverified(tokenString, &Token{})
+	token, _, err := new(jwt.Parser).ParseUnverified(tokenString, &Token{})
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,115 @@
+package service
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sirupsen/logrus"
+	"github.com/yunnysunny/docker-image-proxy/internal/config"
+)
+
+// tokenKeys 签发和校验当前服务 token 使用的密钥
+//
+// 配置了签名私钥时使用 RS256 或 ES256 签名，token 头中带有 kid；否则使用 SERVER_SECRET 进行 HS256 签名。
+// 校验时按 kid 查找公钥，签名公钥之外还可以配置多个校验公钥，用于密钥轮换期间校验旧密钥签发的 token。
+type tokenKeys struct {
+	secret  []byte
+	signer  crypto.Signer // 签名私钥，为 nil 时使用 HS256
+	method  jwt.SigningMethod
+	kid     string
+	methods []string                    // 允许的签名算法
+	public  map[string]crypto.PublicKey // kid -> 校验公钥
+	jwks    JWKSet
+}
+
+// newTokenKeys 加载 TOKEN_SIGNING_KEY_FILE 和 TOKEN_VERIFY_KEY_FILES 中的密钥，加载失败时退出
+func newTokenKeys(log *logrus.Logger, config *config.Config) *tokenKeys {
+	keys := &tokenKeys{
+		secret: []byte(config.ServerSecret),
+		method: jwt.SigningMethodHS256,
+		public: map[string]crypto.PublicKey{},
+		jwks:   JWKSet{Keys: []JWK{}},
+	}
+	if config.TokenSigningKeyFile != "" {
+		signer, err := loadPrivateKey(config.TokenSigningKeyFile)
+		if err != nil {
+			log.WithError(err).WithField("file", config.TokenSigningKeyFile).Fatal("Failed to load token signing key")
+		}
+		kid, method, err := keys.addPublicKey(signer.Public())
+		if err != nil {
+			log.WithError(err).WithField("file", config.TokenSigningKeyFile).Fatal("Failed to load token signing key")
+		}
+		keys.signer, keys.method, keys.kid = signer, method, kid
+		log.WithFields(logrus.Fields{
+			"kid": kid,
+			"alg": method.Alg(),
+		}).Info("Token signing key loaded")
+	} else {
+		keys.methods = append(keys.methods, jwt.SigningMethodHS256.Alg())
+	}
+	for _, file := range config.TokenVerifyKeyFiles {
+		publicKeys, err := loadPublicKeys(file)
+		if err != nil {
+			log.WithError(err).WithField("file", file).Fatal("Failed to load token verification key")
+		}
+		for _, public := range publicKeys {
+			kid, method, err := keys.addPublicKey(public)
+			if err != nil {
+				log.WithError(err).WithField("file", file).Fatal("Failed to load token verification key")
+			}
+			log.WithFields(logrus.Fields{
+				"kid": kid,
+				"alg": method.Alg(),
+			}).Info("Token verification key loaded")
+		}
+	}
+	return keys
+}
+
+// addPublicKey 添加校验公钥，返回公钥的 kid 和对应的签名算法
+func (k *tokenKeys) addPublicKey(public crypto.PublicKey) (string, jwt.SigningMethod, error) {
+	method, err := signingMethodFor(public)
+	if err != nil {
+		return "", nil, err
+	}
+	jwk, err := newJWK(public, method.Alg())
+	if err != nil {
+		return "", nil, err
+	}
+	if _, exists := k.public[jwk.Kid]; !exists {
+		k.public[jwk.Kid] = public
+		k.jwks.Keys = append(k.jwks.Keys, jwk)
+		if !containsString(k.methods, method.Alg()) {
+			k.methods = append(k.methods, method.Alg())
+		}
+	}
+	return jwk.Kid, method, nil
+}
+
+// sign 签发 token
+func (k *tokenKeys) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.method, claims)
+	if k.signer == nil {
+		return token.SignedString(k.secret)
+	}
+	token.Header["kid"] = k.kid
+	return token.SignedString(k.signer)
+}
+
+// keyFunc 根据 token 头选择校验密钥，HS256 只在未配置签名私钥时接受
+func (k *tokenKeys) keyFunc(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		if k.signer != nil {
+			return nil, errors.New("hmac signed token is not accepted")
+		}
+		return k.secret, nil
+	}
+	kid, _ := token.Header["kid"].(string)
+	public, exists := k.public[kid]
+	if !exists {
+		return nil, fmt.Errorf("unknown token key id %q", kid)
+	}
+	return public, nil
+}
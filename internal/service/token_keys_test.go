@@ -0,0 +1,152 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/yunnysunny/docker-image-proxy/internal/config"
+)
+
+// writePEM 将 PEM 块写入临时文件
+func writePEM(t *testing.T, name string, blocks ...*pem.Block) string {
+	t.Helper()
+	data := []byte{}
+	for _, block := range blocks {
+		data = append(data, pem.EncodeToMemory(block)...)
+	}
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func newTestTokenService(signingKey string, verifyKeys ...string) *TokenService {
+	return NewTokenService(newTestLogger(), &config.Config{
+		ServerSecret:        "secret",
+		SelfAuthService:     "docker-image-proxy",
+		TokenSigningKeyFile: signingKey,
+		TokenVerifyKeyFiles: verifyKeys,
+		TokenTTL:            time.Minute,
+		RefreshTokenTTL:     time.Hour,
+	})
+}
+
+func signTestToken(t *testing.T, s *TokenService) string {
+	t.Helper()
+	resp, err := s.GetDockerRegistryToken("alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.Token
+}
+
+func TestTokenSigningKeys(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		file string
+		alg  string
+	}{
+		{"pkcs1 rsa", writePEM(t, "rsa.pem", &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}), "RS256"},
+		{"sec1 ec", writePEM(t, "ec.pem", &pem.Block{Type: "EC PARAMETERS", Bytes: []byte{}}, &pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER}), "ES256"},
+		{"pkcs8 ec", writePEM(t, "pkcs8.pem", &pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), "ES256"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestTokenService(tt.file)
+			tokenString := signTestToken(t, s)
+			jwks := s.JWKS()
+			if len(jwks.Keys) != 1 || jwks.Keys[0].Alg != tt.alg || jwks.Keys[0].Use != "sig" {
+				t.Fatalf("JWKS = %+v, want one %s key", jwks, tt.alg)
+			}
+
+			token, _, err := new(jwt.Parser).ParseUnverified(tokenString, &Token{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token.Method.Alg() != tt.alg || token.Header["kid"] != jwks.Keys[0].Kid {
+				t.Fatalf("token header = %v, want alg %s kid %s", token.Header, tt.alg, jwks.Keys[0].Kid)
+			}
+			if _, err := s.GetToken(tokenString); err != nil {
+				t.Fatalf("GetToken: %v", err)
+			}
+
+			// 发布的 JWK 可以还原出校验公钥
+			public, err := jwks.Keys[0].PublicKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := jwt.Parse(tokenString, func(*jwt.Token) (interface{}, error) { return public, nil }); err != nil {
+				t.Fatalf("token does not verify with published JWK: %v", err)
+			}
+		})
+	}
+
+	// 配置签名私钥后不再接受 HS256 token
+	hmacToken := signTestToken(t, newTestTokenService(""))
+	if _, err := newTestTokenService(tests[0].file).GetToken(hmacToken); err == nil {
+		t.Fatal("HS256 token accepted after a signing key is configured")
+	}
+}
+
+func TestTokenVerifyKeyRotation(t *testing.T) {
+	oldKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldDER, _ := x509.MarshalECPrivateKey(oldKey)
+	newDER, _ := x509.MarshalECPrivateKey(newKey)
+	oldPublic, _ := x509.MarshalPKIXPublicKey(&oldKey.PublicKey)
+	oldFile := writePEM(t, "old.pem", &pem.Block{Type: "EC PRIVATE KEY", Bytes: oldDER})
+	newFile := writePEM(t, "new.pem", &pem.Block{Type: "EC PRIVATE KEY", Bytes: newDER})
+	oldPublicFile := writePEM(t, "old.pub", &pem.Block{Type: "PUBLIC KEY", Bytes: oldPublic})
+
+	oldToken := signTestToken(t, newTestTokenService(oldFile))
+	rotated := newTestTokenService(newFile, oldPublicFile)
+	if _, err := rotated.GetToken(oldToken); err != nil {
+		t.Fatalf("token signed by the previous key rejected during rotation: %v", err)
+	}
+	if _, err := rotated.GetToken(signTestToken(t, rotated)); err != nil {
+		t.Fatalf("token signed by the new key rejected: %v", err)
+	}
+	if len(rotated.JWKS().Keys) != 2 {
+		t.Fatalf("JWKS has %d keys, want signing and verification keys", len(rotated.JWKS().Keys))
+	}
+	// 签名公钥重复配置为校验公钥时只发布一次
+	if keys := newTestTokenService(newFile, newFile).JWKS().Keys; len(keys) != 1 {
+		t.Fatalf("JWKS has %d keys, want duplicates removed", len(keys))
+	}
+	if _, err := newTestTokenService(newFile).GetToken(oldToken); err == nil {
+		t.Fatal("token signed by a removed key accepted")
+	}
+}
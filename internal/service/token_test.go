@@ -0,0 +1,33 @@
+package service
+
+import "testing"
+
+func TestTokenAllows(t *testing.T) {
+	token := &Token{Access: []Access{
+		{Type: "repository", Name: "library/nginx", Actions: []string{"pull"}},
+		{Type: "repository", Name: "myorg/*", Actions: []string{"*"}},
+		{Type: "repository", Name: "mirror/**", Actions: []string{"pull"}},
+		{Type: "registry", Name: "catalog", Actions: []string{"*"}},
+	}}
+	tests := []struct {
+		typ    string
+		name   string
+		action string
+		allows bool
+	}{
+		{"repository", "library/nginx", "pull", true},
+		{"repository", "library/nginx", "push", false},
+		{"repository", "library/nginx2", "pull", false},
+		{"repository", "myorg/app", "push", true},
+		{"repository", "myorg/team/app", "pull", false},
+		{"repository", "mirror/a/b/c", "pull", true},
+		{"repository", "mirror/a/b/c", "push", false},
+		{"registry", "catalog", "*", true},
+		{"repository", "catalog", "pull", false},
+	}
+	for _, tt := range tests {
+		if allows := token.Allows(tt.typ, tt.name, tt.action); allows != tt.allows {
+			t.Errorf("Allows(%s, %s, %s) = %v, want %v", tt.typ, tt.name, tt.action, allows, tt.allows)
+		}
+	}
+}
@@ -0,0 +1,475 @@
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/yunnysunny/docker-image-proxy/internal/config"
+)
+
+// DefaultUpstreamName 由 UPSTREAM_REGISTRY 等环境变量配置的默认上游名称
+const DefaultUpstreamName = "default"
+
+const (
+	// upstreamDialTimeout 连接上游的超时时间
+	upstreamDialTimeout = 10 * time.Second
+	// upstreamResponseHeaderTimeout 等待上游响应头的超时时间，镜像层下载时间不固定，不限制读取响应体的时间
+	upstreamResponseHeaderTimeout = 30 * time.Second
+)
+
+// ErrUpstreamNotFound 仓库名没有匹配的上游
+var ErrUpstreamNotFound = errors.New("no upstream matches repository")
+
+// upstreamNameRegexp 上游名称格式，名称会作为缓存目录的一部分
+var upstreamNameRegexp = regexp.MustCompile(`^[a-z0-9]+([._-][a-z0-9]+)*$`)
+
+const (
+	// nsUpstreamPrefix ns 参数动态创建的上游名称前缀，配置的上游不能使用，
+	// 避免与配置的上游共用缓存目录、上游 token 缓存和上游凭据
+	nsUpstreamPrefix = "ns-"
+	// nsSecretPrefix 上游凭据文件中 ns 参数动态创建的上游的键前缀，键的其余部分为仓库地址
+	nsSecretPrefix = "ns:"
+)
+
+// UpstreamTLSConfig 上游仓库的 TLS 配置
+type UpstreamTLSConfig struct {
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"` // 跳过证书校验
+	CAFile             string `json:"caFile"`             // 自定义 CA 证书
+	CertFile           string `json:"certFile"`           // 客户端证书
+	KeyFile            string `json:"keyFile"`            // 客户端证书私钥
+}
+
+// UpstreamConfig 上游仓库配置，从 UPSTREAMS_FILE 指定的 JSON 文件加载
+//
+// 文件内容举例：
+//
+//	[
+//	  {"name": "ghcr", "prefixes": ["ghcr.io/", "ghcr/"], "registry": "https://ghcr.io"},
+//	  {"name": "quay", "prefixes": ["quay.io/", "quay/"], "registry": "https://quay.io"}
+//	]
+type UpstreamConfig struct {
+	Name        string            `json:"name"`        // 上游名称
+	Prefixes    []string          `json:"prefixes"`    // 仓库名前缀，为空表示默认上游
+	Registry    string            `json:"registry"`    // 上游仓库地址
+	AuthRealm   string            `json:"authRealm"`   // 上游鉴权服务 token 地址，为空时从上游 /v2/ 的认证挑战中获取
+	AuthService string            `json:"authService"` // 上游鉴权服务名称，为空时从上游 /v2/ 的认证挑战中获取
+	NoAuth      bool              `json:"noAuth"`      // 上游没有鉴权，由当前服务签发 token
+	Username    string            `json:"username"`    // 代理向上游鉴权服务换取 token 时使用的账号，为空时使用客户端的凭据
+	Password    string            `json:"password"`
+	TLS         UpstreamTLSConfig `json:"tls"`
+	// 校验上游签发的 token，未配置时不校验，直接转发给上游
+	TokenVerify *UpstreamTokenVerifyConfig `json:"tokenVerify"`
+}
+
+// UpstreamCredential 代理访问上游使用的账号，从 UPSTREAM_SECRETS_FILE 指定的 JSON 文件加载，
+// 与上游配置分开保存，便于作为密钥单独挂载
+//
+// 文件内容举例，键为上游名称，NS_ALLOWLIST 中的仓库为 ns:<仓库地址>：
+//
+//	{
+//	  "default": {"username": "robot", "password": "..."},
+//	  "ghcr": {"username": "robot", "password": "ghp_..."},
+//	  "ns:quay.io": {"username": "robot", "password": "..."}
+//	}
+type UpstreamCredential struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Upstream 上游仓库
+type Upstream struct {
+	UpstreamConfig
+	client   *http.Client
+	verifier *upstreamTokenVerifier // 未配置 TokenVerify 时为 nil
+
+	mu         sync.Mutex
+	realm      string
+	service    string
+	challenges flightGroup // 合并并发的认证挑战请求
+}
+
+// URL 拼接上游仓库地址，直接使用 path.Join 会把协议中的 // 合并成 /
+func (u *Upstream) URL(elem ...string) string {
+	return strings.TrimRight(u.Registry, "/") + path.Join(append([]string{"/"}, elem...)...)
+}
+
+// NormalizeName 按上游规则规范化仓库名，Docker Hub 的官方镜像只能通过 library/<name> 访问
+func (u *Upstream) NormalizeName(name string) string {
+	if u.Host() == "docker.io" && !strings.Contains(name, "/") {
+		return "library/" + name
+	}
+	return name
+}
+
+// ProxyAuth 代理持有上游凭据，由当前服务签发 token，代理访问上游时自行换取上游 token，
+// 客户端只需要通过当前服务的认证或匿名访问
+func (u *Upstream) ProxyAuth() bool {
+	return !u.NoAuth && u.Username != ""
+}
+
+// AuthChallenge 获取上游鉴权服务的 token 地址和服务名称，未配置时请求上游 /v2/ 解析认证挑战并缓存
+func (u *Upstream) AuthChallenge() (string, string, error) {
+	realm, service := u.challenge()
+	if realm != "" && service != "" {
+		return realm, service, nil
+	}
+
+	// 请求上游时不持有锁，同一上游并发的请求合并为一次
+	_, err := u.challenges.Do("", func() (interface{}, error) {
+		resp, err := u.client.Get(u.URL("v2") + "/")
+		if err != nil {
+			return nil, fmt.Errorf("failed to get auth challenge: %v", err)
+		}
+		resp.Body.Close()
+		scheme, params := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+		if !strings.EqualFold(scheme, "Bearer") {
+			return nil, fmt.Errorf("upstream %s has no bearer challenge", u.Name)
+		}
+		u.updateChallenge(params)
+		return nil, nil
+	})
+	realm, service = u.challenge()
+	return realm, service, err
+}
+
+// challenge 返回配置中指定的或已缓存的 token 地址和服务名称
+func (u *Upstream) challenge() (string, string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	realm, service := u.AuthRealm, u.AuthService
+	if realm == "" {
+		realm = u.realm
+	}
+	if service == "" {
+		service = u.service
+	}
+	return realm, service
+}
+
+// updateChallenge 上游返回新的认证挑战时更新缓存的 token 地址和服务名称，配置中指定的地址和名称不受影响
+func (u *Upstream) updateChallenge(params map[string]string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if params["realm"] != "" {
+		u.realm = params["realm"]
+	}
+	if params["service"] != "" {
+		u.service = params["service"]
+	}
+}
+
+type upstreamPrefix struct {
+	prefix   string
+	upstream *Upstream
+}
+
+// UpstreamRouter 根据仓库名前缀选择上游仓库
+type UpstreamRouter struct {
+	log      *logrus.Logger
+	prefixes []upstreamPrefix // 按前缀长度降序排列，优先匹配最长前缀
+	byName   map[string]*Upstream
+	ordered  []*Upstream                   // 按配置顺序排列的上游
+	fallback *Upstream                     // 没有前缀匹配时使用的默认上游
+	secrets  map[string]UpstreamCredential // 上游名称 -> 代理持有的上游凭据
+
+	// containerd 镜像加速的 ns 参数允许访问的仓库，以及为其动态创建的上游
+	nsAllowlist map[string]bool
+	nsMu        sync.Mutex
+	nsUpstreams map[string]*Upstream
+}
+
+// NewUpstreamRouter 创建上游路由，默认上游来自 UPSTREAM_REGISTRY 等环境变量，
+// 其余上游来自 UPSTREAMS_FILE，文件中没有配置前缀的上游会替代默认上游
+func NewUpstreamRouter(log *logrus.Logger, config *config.Config) *UpstreamRouter {
+	configs := []UpstreamConfig{}
+	if config.UpstreamsFile != "" {
+		data, err := os.ReadFile(config.UpstreamsFile)
+		if err != nil {
+			log.WithError(err).Fatal("Failed to read upstreams file")
+		}
+		if err := json.Unmarshal(data, &configs); err != nil {
+			log.WithError(err).Fatal("Failed to parse upstreams file")
+		}
+	}
+	router := &UpstreamRouter{
+		log:         log,
+		byName:      make(map[string]*Upstream),
+		secrets:     make(map[string]UpstreamCredential),
+		nsAllowlist: make(map[string]bool),
+		nsUpstreams: make(map[string]*Upstream),
+	}
+	if config.UpstreamSecrets != "" {
+		data, err := os.ReadFile(config.UpstreamSecrets)
+		if err != nil {
+			log.WithError(err).Fatal("Failed to read upstream secrets file")
+		}
+		if err := json.Unmarshal(data, &router.secrets); err != nil {
+			log.WithError(err).Fatal("Failed to parse upstream secrets file")
+		}
+	}
+	for _, ns := range config.NamespaceAllowlist {
+		router.nsAllowlist[canonicalRegistryHost(ns)] = true
+	}
+	for _, upstreamConfig := range configs {
+		upstream, err := router.add(upstreamConfig)
+		if err != nil {
+			log.WithError(err).WithField("upstream", upstreamConfig.Name).Fatal("Invalid upstream config")
+		}
+		if len(upstream.Prefixes) == 0 {
+			if router.fallback != nil {
+				log.WithField("upstream", upstream.Name).Fatal("Only one upstream can have no prefixes")
+			}
+			router.fallback = upstream
+		}
+	}
+	if router.fallback == nil {
+		authRealm := ""
+		if config.UpstreamAuthService != "" {
+			authRealm = strings.TrimRight(config.UpstreamAuthService, "/") + "/token"
+		}
+		var tokenVerify *UpstreamTokenVerifyConfig
+		if config.UpstreamJWKSURL != "" || config.UpstreamJWKSFile != "" || config.UpstreamRootCert != "" {
+			tokenVerify = &UpstreamTokenVerifyConfig{
+				JWKSURL:      config.UpstreamJWKSURL,
+				JWKSFile:     config.UpstreamJWKSFile,
+				RootCertFile: config.UpstreamRootCert,
+				Issuer:       config.UpstreamIssuer,
+			}
+		}
+		upstream, err := router.add(UpstreamConfig{
+			Name:        DefaultUpstreamName,
+			Registry:    config.UpstreamRegistry,
+			AuthRealm:   authRealm,
+			NoAuth:      config.UpstreamNoAuth,
+			TokenVerify: tokenVerify,
+		})
+		if err != nil {
+			log.WithError(err).Fatal("Invalid default upstream config")
+		}
+		router.fallback = upstream
+	}
+	sort.SliceStable(router.prefixes, func(i, j int) bool {
+		return len(router.prefixes[i].prefix) > len(router.prefixes[j].prefix)
+	})
+	for _, upstream := range router.ordered {
+		log.WithFields(logrus.Fields{
+			"upstream":  upstream.Name,
+			"registry":  upstream.Registry,
+			"prefixes":  upstream.Prefixes,
+			"verify":    upstream.verifier != nil,
+			"proxyAuth": upstream.ProxyAuth(),
+		}).Info("Upstream registry configured")
+	}
+	return router
+}
+
+// add 校验上游配置并加入路由
+func (r *UpstreamRouter) add(upstreamConfig UpstreamConfig) (*Upstream, error) {
+	if !upstreamNameRegexp.MatchString(upstreamConfig.Name) {
+		return nil, fmt.Errorf("invalid upstream name: %q", upstreamConfig.Name)
+	}
+	if strings.HasPrefix(upstreamConfig.Name, nsUpstreamPrefix) {
+		return nil, fmt.Errorf("upstream name %q uses the reserved prefix %q", upstreamConfig.Name, nsUpstreamPrefix)
+	}
+	if _, exists := r.byName[upstreamConfig.Name]; exists {
+		return nil, fmt.Errorf("duplicate upstream name: %s", upstreamConfig.Name)
+	}
+	if upstreamConfig.Registry == "" {
+		return nil, fmt.Errorf("registry is required")
+	}
+	client, err := newUpstreamClient(upstreamConfig.TLS)
+	if err != nil {
+		return nil, err
+	}
+	// 凭据文件中的账号优先于上游配置中的账号
+	if secret, ok := r.secrets[upstreamConfig.Name]; ok {
+		upstreamConfig.Username, upstreamConfig.Password = secret.Username, secret.Password
+	}
+	upstream := &Upstream{
+		UpstreamConfig: upstreamConfig,
+		client:         client,
+	}
+	if upstream.TokenVerify != nil {
+		if upstream.verifier, err = newUpstreamTokenVerifier(r.log, upstream); err != nil {
+			return nil, err
+		}
+	}
+	for i, prefix := range upstream.Prefixes {
+		prefix = strings.Trim(prefix, "/") + "/"
+		upstream.Prefixes[i] = prefix
+		r.prefixes = append(r.prefixes, upstreamPrefix{prefix: prefix, upstream: upstream})
+	}
+	r.byName[upstream.Name] = upstream
+	r.ordered = append(r.ordered, upstream)
+	return upstream, nil
+}
+
+// newUpstreamClient 根据 TLS 配置创建访问上游的 HTTP 客户端，限制连接和等待响应头的时间
+func newUpstreamClient(tlsConfig UpstreamTLSConfig) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   upstreamDialTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.ResponseHeaderTimeout = upstreamResponseHeaderTimeout
+	if !tlsConfig.InsecureSkipVerify && tlsConfig.CAFile == "" && tlsConfig.CertFile == "" {
+		return &http.Client{Transport: transport}, nil
+	}
+	clientTLS := &tls.Config{
+		InsecureSkipVerify: tlsConfig.InsecureSkipVerify,
+	}
+	if tlsConfig.CAFile != "" {
+		caData, err := os.ReadFile(tlsConfig.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca file: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("no certificates found in ca file: %s", tlsConfig.CAFile)
+		}
+		clientTLS.RootCAs = pool
+	}
+	if tlsConfig.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(tlsConfig.CertFile, tlsConfig.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		clientTLS.Certificates = []tls.Certificate{cert}
+	}
+	transport.TLSClientConfig = clientTLS
+	return &http.Client{Transport: transport}, nil
+}
+
+// Resolve 根据仓库名选择上游，返回上游和去掉前缀后的上游仓库名
+func (r *UpstreamRouter) Resolve(name string) (*Upstream, string, error) {
+	for _, p := range r.prefixes {
+		if strings.HasPrefix(name, p.prefix) && len(name) > len(p.prefix) {
+			return p.upstream, strings.TrimPrefix(name, p.prefix), nil
+		}
+	}
+	if r.fallback == nil {
+		return nil, "", ErrUpstreamNotFound
+	}
+	return r.fallback, name, nil
+}
+
+// CanonicalName 返回上游仓库名对应的规范名称：默认上游不加前缀，配置了前缀的上游加上第一个前缀，
+// ns 动态创建的上游加上仓库地址
+func (r *UpstreamRouter) CanonicalName(upstream *Upstream, remote string) string {
+	switch {
+	case upstream == r.fallback:
+		return remote
+	case len(upstream.Prefixes) > 0:
+		return upstream.Prefixes[0] + remote
+	default:
+		return upstream.Host() + "/" + remote
+	}
+}
+
+// Default 默认上游
+func (r *UpstreamRouter) Default() *Upstream {
+	return r.fallback
+}
+
+// Get 根据名称获取上游
+func (r *UpstreamRouter) Get(name string) *Upstream {
+	return r.byName[name]
+}
+
+// dockerHubHosts Docker Hub 的各种仓库地址
+var dockerHubHosts = map[string]bool{
+	"docker.io":            true,
+	"index.docker.io":      true,
+	"registry-1.docker.io": true,
+	"registry.docker.io":   true,
+}
+
+// canonicalRegistryHost 统一仓库地址的写法，Docker Hub 的各种地址都视为 docker.io
+func canonicalRegistryHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	host = strings.TrimRight(host, "/")
+	if dockerHubHosts[host] {
+		return "docker.io"
+	}
+	return host
+}
+
+// Host 上游仓库地址中的主机名
+func (u *Upstream) Host() string {
+	host := canonicalRegistryHost(u.Registry)
+	if i := strings.Index(host, "/"); i >= 0 {
+		host = host[:i]
+	}
+	return host
+}
+
+// ResolveNamespace 根据 containerd 镜像加速请求中的 ns 参数选择上游，
+// 优先使用仓库地址与 ns 相同的已配置上游（多个上游地址相同时优先默认上游，其次按配置顺序选择第一个），
+// 其次为 NS_ALLOWLIST 中的仓库动态创建上游，
+// 动态创建的上游继承默认上游的 TLS 配置；上游 token 由各自的鉴权服务签发，不能使用默认上游的校验配置，
+// 需要校验时在 UPSTREAMS_FILE 中为该仓库地址配置上游和 tokenVerify
+func (r *UpstreamRouter) ResolveNamespace(ns string) (*Upstream, error) {
+	host := canonicalRegistryHost(ns)
+	if r.fallback.Host() == host {
+		return r.fallback, nil
+	}
+	for _, upstream := range r.ordered {
+		if upstream.Host() == host {
+			return upstream, nil
+		}
+	}
+	if !r.nsAllowlist[host] {
+		return nil, fmt.Errorf("%w: ns %s is not allowed", ErrUpstreamNotFound, ns)
+	}
+
+	r.nsMu.Lock()
+	defer r.nsMu.Unlock()
+	if upstream, ok := r.nsUpstreams[host]; ok {
+		return upstream, nil
+	}
+	registry := "https://" + host
+	if host == "docker.io" {
+		registry = "https://registry-1.docker.io"
+	}
+	// 名称使用保留前缀，凭据按仓库地址查找，不会与配置的上游混用
+	name := nsUpstreamPrefix + strings.NewReplacer(":", "-", "/", "-").Replace(host)
+	secret := r.secrets[nsSecretPrefix+host]
+	upstream := &Upstream{
+		UpstreamConfig: UpstreamConfig{
+			Name:     name,
+			Registry: registry,
+			Username: secret.Username,
+			Password: secret.Password,
+			TLS:      r.fallback.TLS,
+		},
+	}
+	var err error
+	if upstream.client, err = newUpstreamClient(upstream.TLS); err != nil {
+		return nil, fmt.Errorf("upstream for ns %s: %v", ns, err)
+	}
+	r.nsUpstreams[host] = upstream
+	r.log.WithFields(logrus.Fields{
+		"ns":       ns,
+		"registry": registry,
+	}).Info("Upstream registry created for ns")
+	return upstream, nil
+}
@@ -0,0 +1,323 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yunnysunny/docker-image-proxy/internal/config"
+)
+
+func TestResolveNamespaceDuplicateHosts(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "upstreams.json")
+	data := `[
+		{"name": "ghcr", "prefixes": ["ghcr.io/"], "registry": "https://ghcr.io"},
+		{"name": "ghcr-mirror", "prefixes": ["ghcr/"], "registry": "https://ghcr.io"},
+		{"name": "quay-a", "prefixes": ["quay-a/"], "registry": "https://quay.io"},
+		{"name": "quay-b", "prefixes": ["quay-b/"], "registry": "https://quay.io"},
+		{"name": "hub", "registry": "https://registry-1.docker.io"},
+		{"name": "hub-mirror", "prefixes": ["hub/"], "registry": "https://index.docker.io"}
+	]`
+	if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	router := NewUpstreamRouter(newTestLogger(), &config.Config{UpstreamsFile: file})
+
+	tests := []struct {
+		ns       string
+		upstream string
+	}{
+		{"ghcr.io", "ghcr"},
+		{"quay.io", "quay-a"},
+		{"docker.io", "hub"}, // 默认上游优先于配置顺序
+	}
+	for _, tt := range tests {
+		t.Run(tt.ns, func(t *testing.T) {
+			// map 的遍历顺序是随机的，多次解析确认结果稳定
+			for i := 0; i < 20; i++ {
+				upstream, err := router.ResolveNamespace(tt.ns)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if upstream.Name != tt.upstream {
+					t.Fatalf("ResolveNamespace(%q) = %s, want %s", tt.ns, upstream.Name, tt.upstream)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveNamespaceSeparatedFromConfiguredUpstreams(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "upstreams.json")
+	data := `[{"name": "ghcr.io", "prefixes": ["private/"], "registry": "https://registry.internal.example.com"}]`
+	if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	secrets := filepath.Join(dir, "secrets.json")
+	data = `{
+		"ghcr.io": {"username": "private", "password": "private-password"},
+		"ns:ghcr.io": {"username": "public", "password": "public-password"}
+	}`
+	if err := os.WriteFile(secrets, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	router := NewUpstreamRouter(newTestLogger(), &config.Config{
+		UpstreamRegistry:   "https://registry-1.docker.io",
+		UpstreamsFile:      file,
+		UpstreamSecrets:    secrets,
+		NamespaceAllowlist: []string{"ghcr.io"},
+	})
+
+	upstream, err := router.ResolveNamespace("ghcr.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 同名的已配置上游的凭据和缓存不能用于 ns 创建的上游
+	if upstream.Name == "ghcr.io" || upstream.Username != "public" || upstream.Registry != "https://ghcr.io" {
+		t.Fatalf("ns upstream = %s %s %s, want a separate upstream with its own credentials", upstream.Name, upstream.Registry, upstream.Username)
+	}
+	if configured := router.Get("ghcr.io"); configured.Username != "private" {
+		t.Fatalf("configured upstream username = %s, want private", configured.Username)
+	}
+
+	if _, err := router.add(UpstreamConfig{Name: "ns-ghcr.io", Registry: "https://ghcr.io"}); err == nil {
+		t.Fatal("upstream with the reserved ns- prefix accepted")
+	}
+}
+
+func TestResolveNamespaceVerifier(t *testing.T) {
+	_, jwks := writeTestJWKS(t)
+	file := filepath.Join(t.TempDir(), "upstreams.json")
+	data := `[{"name": "ghcr", "prefixes": ["ghcr.io/"], "registry": "https://ghcr.io", "tokenVerify": {"jwksFile": "` + jwks + `"}}]`
+	if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	router := NewUpstreamRouter(newTestLogger(), &config.Config{
+		UpstreamRegistry:   "https://registry-1.docker.io",
+		UpstreamJWKSFile:   jwks,
+		UpstreamsFile:      file,
+		NamespaceAllowlist: []string{"quay.io"},
+	})
+
+	tests := []struct {
+		ns       string
+		verifier bool
+	}{
+		{"docker.io", true},
+		{"ghcr.io", true},  // 已配置的上游使用自己的校验配置
+		{"quay.io", false}, // 动态创建的上游不继承默认上游的校验配置
+	}
+	for _, tt := range tests {
+		upstream, err := router.ResolveNamespace(tt.ns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (upstream.verifier != nil) != tt.verifier {
+			t.Errorf("ResolveNamespace(%q) verifier = %v, want %v", tt.ns, upstream.verifier != nil, tt.verifier)
+		}
+	}
+}
+
+func TestNormalizeName(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "upstreams.json")
+	data := `[{"name": "ghcr", "prefixes": ["ghcr.io/", "ghcr/"], "registry": "https://ghcr.io"}]`
+	if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s := NewRegistryService(newTestLogger(), &config.Config{
+		UpstreamRegistry:   "https://registry-1.docker.io",
+		UpstreamsFile:      file,
+		NamespaceAllowlist: []string{"quay.io"},
+	})
+
+	tests := []struct {
+		name      string
+		ns        string
+		remote    string
+		cacheName string
+		canonical string
+	}{
+		{"nginx", "", "library/nginx", "default/library/nginx", "library/nginx"},
+		{"library/nginx", "", "library/nginx", "default/library/nginx", "library/nginx"},
+		{"bitnami/redis", "", "bitnami/redis", "default/bitnami/redis", "bitnami/redis"},
+		{"nginx", "docker.io", "library/nginx", "default/library/nginx", "library/nginx"},
+		// 只有 Docker Hub 需要补全 library/
+		{"ghcr/app", "", "app", "ghcr/app", "ghcr.io/app"},
+		{"ghcr/org/app", "", "org/app", "ghcr/org/app", "ghcr.io/org/app"},
+		{"app", "quay.io", "app", "ns-quay.io/app", "quay.io/app"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ns+"/"+tt.name, func(t *testing.T) {
+			_, remote, cacheName, err := s.resolve(tt.name, tt.ns)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if remote != tt.remote || cacheName != tt.cacheName {
+				t.Fatalf("resolve(%q) = %s %s, want %s %s", tt.name, remote, cacheName, tt.remote, tt.cacheName)
+			}
+			canonical, err := s.CanonicalName(tt.name, tt.ns)
+			if err != nil || canonical != tt.canonical {
+				t.Fatalf("CanonicalName(%q) = %s %v, want %s", tt.name, canonical, err, tt.canonical)
+			}
+		})
+	}
+
+	// 转发给上游鉴权服务的 scope 使用上游仓库名
+	_, scopes, err := s.upstreamScopes([]Scope{{Type: "repository", Name: "nginx", Actions: []string{"pull"}}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scopes) != 1 || scopes[0] != "repository:library/nginx:pull" {
+		t.Fatalf("upstreamScopes = %v, want [repository:library/nginx:pull]", scopes)
+	}
+}
+
+func TestUpstreamRouterResolve(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "upstreams.json")
+	data := `[
+		{"name": "ghcr", "prefixes": ["ghcr.io/", "ghcr/"], "registry": "https://ghcr.io"},
+		{"name": "ghcr-org", "prefixes": ["ghcr.io/org/"], "registry": "https://ghcr-org.example.com"},
+		{"name": "quay", "prefixes": ["quay/"], "registry": "https://quay.io"}
+	]`
+	if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	router := NewUpstreamRouter(newTestLogger(), &config.Config{
+		UpstreamRegistry: "https://registry-1.docker.io",
+		UpstreamsFile:    file,
+	})
+
+	tests := []struct {
+		name      string
+		upstream  string
+		remote    string
+		canonical string
+	}{
+		// 重叠的前缀优先匹配最长的前缀
+		{"ghcr.io/org/app", "ghcr-org", "app", "ghcr.io/org/app"},
+		{"ghcr.io/org/team/app", "ghcr-org", "team/app", "ghcr.io/org/team/app"},
+		{"ghcr.io/other/app", "ghcr", "other/app", "ghcr.io/other/app"},
+		{"ghcr.io/org", "ghcr", "org", "ghcr.io/org"},
+		// 别名前缀规范化为第一个前缀
+		{"ghcr/other/app", "ghcr", "other/app", "ghcr.io/other/app"},
+		{"quay/org/app", "quay", "org/app", "quay/org/app"},
+		// 前缀按路径段匹配，未知前缀使用默认上游
+		{"quayx/app", DefaultUpstreamName, "quayx/app", "quayx/app"},
+		{"unknown.io/app", DefaultUpstreamName, "unknown.io/app", "unknown.io/app"},
+		{"library/nginx", DefaultUpstreamName, "library/nginx", "library/nginx"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream, remote, err := router.Resolve(tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if upstream.Name != tt.upstream || remote != tt.remote {
+				t.Fatalf("Resolve(%q) = %s %s, want %s %s", tt.name, upstream.Name, remote, tt.upstream, tt.remote)
+			}
+			if canonical := router.CanonicalName(upstream, remote); canonical != tt.canonical {
+				t.Fatalf("CanonicalName(%s, %q) = %s, want %s", upstream.Name, remote, canonical, tt.canonical)
+			}
+		})
+	}
+}
+
+func TestUpstreamScopes(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "upstreams.json")
+	data := `[{"name": "ghcr", "prefixes": ["ghcr.io/", "ghcr/"], "registry": "https://ghcr.io"}]`
+	if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s := NewRegistryService(newTestLogger(), &config.Config{
+		UpstreamRegistry: "https://registry-1.docker.io",
+		UpstreamsFile:    file,
+	})
+
+	tests := []struct {
+		name     string
+		scopes   []Scope
+		upstream string
+		values   []string
+	}{
+		{"prefix stripped", []Scope{
+			{Type: "repository", Name: "ghcr.io/org/app", Actions: []string{"pull"}},
+		}, "ghcr", []string{"repository:org/app:pull"}},
+		{"aliases share an upstream", []Scope{
+			{Type: "repository", Name: "ghcr.io/org/app", Actions: []string{"pull"}},
+			{Type: "repository", Name: "ghcr/org/web", Actions: []string{"pull", "push"}},
+		}, "ghcr", []string{"repository:org/app:pull", "repository:org/web:pull,push"}},
+		// 一次只能向一个上游鉴权服务换取 token，属于其他上游的范围被跳过
+		{"other upstream skipped", []Scope{
+			{Type: "repository", Name: "ghcr.io/org/app", Actions: []string{"pull"}},
+			{Type: "repository", Name: "nginx", Actions: []string{"pull"}},
+		}, "ghcr", []string{"repository:org/app:pull"}},
+		{"default upstream", []Scope{
+			{Type: "repository", Name: "nginx", Actions: []string{"pull"}},
+			{Type: "registry", Name: "catalog", Actions: []string{"*"}},
+		}, DefaultUpstreamName, []string{"repository:library/nginx:pull", "registry:catalog:*"}},
+		{"no scopes", nil, DefaultUpstreamName, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream, values, err := s.upstreamScopes(tt.scopes, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if upstream.Name != tt.upstream || !reflect.DeepEqual(values, tt.values) {
+				t.Fatalf("upstreamScopes() = %s %v, want %s %v", upstream.Name, values, tt.upstream, tt.values)
+			}
+		})
+	}
+}
+
+func TestUpstreamAuthChallengeCoalesced(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+		w.Header().Set("WWW-Authenticate", `Bearer realm="https://auth.example.com/token",service="registry.example.com"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	t.Cleanup(registry.Close)
+	upstream := &Upstream{UpstreamConfig: UpstreamConfig{Name: "default", Registry: registry.URL}, client: registry.Client()}
+
+	const callers = 5
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			realm, service, err := upstream.AuthChallenge()
+			if err != nil || realm != "https://auth.example.com/token" || service != "registry.example.com" {
+				t.Errorf("AuthChallenge() = %q, %q, %v", realm, service, err)
+			}
+		}()
+	}
+	for requests.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// 等待上游响应时不持有锁
+	updated := make(chan struct{})
+	go func() {
+		upstream.updateChallenge(map[string]string{})
+		close(updated)
+	}()
+	select {
+	case <-updated:
+	case <-time.After(time.Second):
+		t.Fatal("updateChallenge blocked by pending challenge request")
+	}
+	close(release)
+	wg.Wait()
+	if n := requests.Load(); n != 1 {
+		t.Fatalf("challenge requests = %d, want 1", n)
+	}
+}
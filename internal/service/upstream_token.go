@@ -0,0 +1,141 @@
+package service
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sirupsen/logrus"
+)
+
+// UpstreamTokenVerifyConfig 校验上游鉴权服务签发的 token，公钥来源至少配置一个
+type UpstreamTokenVerifyConfig struct {
+	JWKSURL      string `json:"jwksUrl"`      // 上游鉴权服务公开的 JWKS 地址
+	JWKSFile     string `json:"jwksFile"`     // 本地 JWKS 文件，用于无法访问 JWKS 地址的环境
+	RootCertFile string `json:"rootCertFile"` // token 头中 x5c 证书链的根证书（PEM），同 distribution 的 rootcertbundle
+	Issuer       string `json:"issuer"`       // token 的 iss，为空时不校验
+	Audience     string `json:"audience"`     // token 的 aud，为空时使用上游鉴权服务名称
+}
+
+// upstreamTokenClaims 上游签发的 token 中需要校验的字段，access 格式同当前服务签发的 token
+type upstreamTokenClaims struct {
+	jwt.RegisteredClaims
+	Access []Access `json:"access"`
+}
+
+// publicKeyMethods 第三方签发的 token 允许的签名算法，不接受 HS256 和 none
+var publicKeyMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// upstreamTokenVerifier 校验上游鉴权服务签发的 token，拒绝伪造或过期的 token，避免无效请求消耗上游的限额
+type upstreamTokenVerifier struct {
+	upstream *Upstream
+	config   UpstreamTokenVerifyConfig
+	keys     *KeySet        // JWKS 公钥，未配置时为 nil
+	roots    *x509.CertPool // x5c 证书链的根证书，未配置时为 nil
+}
+
+// newUpstreamTokenVerifier 根据上游配置创建 token 校验器
+func newUpstreamTokenVerifier(log *logrus.Logger, upstream *Upstream) (*upstreamTokenVerifier, error) {
+	config := *upstream.TokenVerify
+	verifier := &upstreamTokenVerifier{upstream: upstream, config: config}
+	if config.JWKSURL != "" || config.JWKSFile != "" {
+		keys, err := NewKeySet(log, config.JWKSURL, config.JWKSFile, upstream.client)
+		if err != nil {
+			return nil, err
+		}
+		verifier.keys = keys
+	}
+	if config.RootCertFile != "" {
+		data, err := os.ReadFile(config.RootCertFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read root cert file: %v", err)
+		}
+		verifier.roots = x509.NewCertPool()
+		if !verifier.roots.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in root cert file: %s", config.RootCertFile)
+		}
+	}
+	if verifier.keys == nil && verifier.roots == nil {
+		return nil, errors.New("tokenVerify requires jwksUrl, jwksFile or rootCertFile")
+	}
+	return verifier, nil
+}
+
+// Verify 校验 token 的签名、有效期、iss 和 aud，以及 access 是否允许对资源执行指定操作，
+// name 为上游仓库名
+func (v *upstreamTokenVerifier) Verify(tokenString, typ, name, action string) error {
+	audience := v.config.Audience
+	if audience == "" {
+		_, service, err := v.upstream.AuthChallenge()
+		if service == "" {
+			return fmt.Errorf("failed to get upstream auth service: %v", err)
+		}
+		audience = service
+	}
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods(publicKeyMethods),
+		jwt.WithAudience(audience),
+		jwt.WithExpirationRequired(),
+	}
+	if v.config.Issuer != "" {
+		options = append(options, jwt.WithIssuer(v.config.Issuer))
+	}
+	claims := &upstreamTokenClaims{}
+	if _, err := jwt.ParseWithClaims(tokenString, claims, v.keyFunc, options...); err != nil {
+		return err
+	}
+	if !(&Token{Access: claims.Access}).Allows(typ, name, action) {
+		return fmt.Errorf("token does not grant %s:%s:%s", typ, name, action)
+	}
+	return nil
+}
+
+// keyFunc 选择校验公钥：token 头中带有 x5c 且配置了根证书时使用证书链中的公钥，否则按 kid 从 JWKS 中查找
+func (v *upstreamTokenVerifier) keyFunc(token *jwt.Token) (interface{}, error) {
+	if chain, ok := token.Header["x5c"].([]interface{}); ok && v.roots != nil {
+		return v.verifyChain(chain)
+	}
+	if v.keys == nil {
+		return nil, errors.New("token has no x5c certificate chain")
+	}
+	kid, _ := token.Header["kid"].(string)
+	return v.keys.Key(kid)
+}
+
+// verifyChain 校验 x5c 证书链，返回叶子证书的公钥
+func (v *upstreamTokenVerifier) verifyChain(chain []interface{}) (interface{}, error) {
+	certs := make([]*x509.Certificate, 0, len(chain))
+	for _, item := range chain {
+		encoded, ok := item.(string)
+		if !ok {
+			return nil, errors.New("invalid x5c certificate")
+		}
+		der, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x5c certificate: %v", err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x5c certificate: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("empty x5c certificate chain")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         v.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return nil, fmt.Errorf("failed to verify x5c certificate chain: %v", err)
+	}
+	return certs[0].PublicKey, nil
+}
@@ -0,0 +1,108 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// upstreamTokenDefaultTTL 上游未返回 expires_in 时 token 的有效期，同 Docker 的 token 规范
+	upstreamTokenDefaultTTL = 60 * time.Second
+	// upstreamTokenRefreshBefore 缓存的 token 在过期前多久失效，避免使用即将过期的 token 请求上游
+	upstreamTokenRefreshBefore = 30 * time.Second
+)
+
+// cachedUpstreamToken 缓存的上游 token
+type cachedUpstreamToken struct {
+	token     TokenResponse
+	expiresAt time.Time // token 的过期时间
+	staleAt   time.Time // 缓存失效时间，早于过期时间
+}
+
+// upstreamTokenCache 缓存向上游鉴权服务换取的 token，键为上游、鉴权范围和凭据，
+// 相同键的并发换取合并为一次请求
+type upstreamTokenCache struct {
+	mu     sync.Mutex
+	tokens map[string]*cachedUpstreamToken
+	calls  flightGroup
+}
+
+func newUpstreamTokenCache() *upstreamTokenCache {
+	return &upstreamTokenCache{
+		tokens: make(map[string]*cachedUpstreamToken),
+	}
+}
+
+// upstreamCredential 换取上游 token 使用的凭据，上游配置了账号时使用配置的账号，否则为客户端的认证头，匿名时为空
+func upstreamCredential(upstream *Upstream, authHeader string) string {
+	if upstream.Username != "" {
+		return "basic:" + upstream.Username + ":" + upstream.Password
+	}
+	return authHeader
+}
+
+// upstreamTokenKey 缓存键，鉴权范围排序后拼接，凭据只保存摘要
+func upstreamTokenKey(upstream *Upstream, scopes []string, credential string) string {
+	sorted := append([]string(nil), scopes...)
+	sort.Strings(sorted)
+	sum := sha256.Sum256([]byte(credential))
+	return upstream.Name + "|" + upstream.Registry + "|" + strings.Join(sorted, " ") + "|" + hex.EncodeToString(sum[:])
+}
+
+// Get 获取未失效的 token，返回副本，expires_in 为剩余有效期
+func (c *upstreamTokenCache) Get(key string) *TokenResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.tokens[key]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	if !now.Before(cached.staleAt) {
+		delete(c.tokens, key)
+		return nil
+	}
+	token := cached.token
+	token.ExpiresIn = int64(cached.expiresAt.Sub(now) / time.Second)
+	return &token
+}
+
+// Put 缓存 token，有效期太短的 token 不缓存，同时清除已失效的 token
+func (c *upstreamTokenCache) Put(key string, token *TokenResponse, fetchedAt time.Time) {
+	ttl := time.Duration(token.ExpiresIn) * time.Second
+	if ttl <= 0 {
+		ttl = upstreamTokenDefaultTTL
+	}
+	// 有效期较短时提前其五分之一失效
+	before := ttl / 5
+	if before > upstreamTokenRefreshBefore {
+		before = upstreamTokenRefreshBefore
+	}
+	cached := &cachedUpstreamToken{
+		token:     *token,
+		expiresAt: fetchedAt.Add(ttl),
+		staleAt:   fetchedAt.Add(ttl - before),
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, v := range c.tokens {
+		if !now.Before(v.staleAt) {
+			delete(c.tokens, k)
+		}
+	}
+	if now.Before(cached.staleAt) {
+		c.tokens[key] = cached
+	}
+}
+
+// Delete 删除 token，上游拒绝缓存的 token 时调用
+func (c *upstreamTokenCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.tokens, key)
+}
@@ -0,0 +1,94 @@
+package service
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestUpstreamTokenKey(t *testing.T) {
+	hub := &Upstream{UpstreamConfig: UpstreamConfig{Name: "default", Registry: "https://registry-1.docker.io"}}
+	ghcr := &Upstream{UpstreamConfig: UpstreamConfig{Name: "ghcr", Registry: "https://ghcr.io"}}
+	key := upstreamTokenKey(hub, []string{"repository:a:pull", "repository:b:pull"}, "Basic YWxpY2U6c2VjcmV0")
+
+	if upstreamTokenKey(hub, []string{"repository:b:pull", "repository:a:pull"}, "Basic YWxpY2U6c2VjcmV0") != key {
+		t.Fatal("key should not depend on scope order")
+	}
+	for name, other := range map[string]string{
+		"upstream":   upstreamTokenKey(ghcr, []string{"repository:a:pull", "repository:b:pull"}, "Basic YWxpY2U6c2VjcmV0"),
+		"scope":      upstreamTokenKey(hub, []string{"repository:a:pull"}, "Basic YWxpY2U6c2VjcmV0"),
+		"credential": upstreamTokenKey(hub, []string{"repository:a:pull", "repository:b:pull"}, ""),
+	} {
+		if other == key {
+			t.Errorf("key should depend on %s", name)
+		}
+	}
+}
+
+func TestUpstreamTokenCacheExpiry(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		expiresIn int64
+		fetchedAt time.Time
+		cached    bool
+	}{
+		{"long lived", 300, now, true},
+		{"default ttl", 0, now, true},
+		{"refreshed before expiry", 300, now.Add(-275 * time.Second), false},
+		{"short lived", 10, now.Add(-7 * time.Second), true},
+		{"short lived refreshed early", 10, now.Add(-9 * time.Second), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newUpstreamTokenCache()
+			c.Put("key", &TokenResponse{Token: "token", ExpiresIn: tt.expiresIn}, tt.fetchedAt)
+			token := c.Get("key")
+			if (token != nil) != tt.cached {
+				t.Fatalf("Get() = %+v, want cached %v", token, tt.cached)
+			}
+			if token != nil && token.ExpiresIn > tt.expiresIn && tt.expiresIn > 0 {
+				t.Fatalf("expires_in = %d, want remaining lifetime", token.ExpiresIn)
+			}
+		})
+	}
+
+	c := newUpstreamTokenCache()
+	c.Put("key", &TokenResponse{Token: "token", ExpiresIn: 300}, now)
+	c.Get("key").Token = "modified"
+	if c.Get("key").Token != "token" {
+		t.Fatal("Get should return a copy")
+	}
+	c.Delete("key")
+	if c.Get("key") != nil {
+		t.Fatal("token still cached after Delete")
+	}
+}
+
+func TestUpstreamTokenRenewedAfterRejection(t *testing.T) {
+	registry := newFakeTokenRegistry(t)
+	s := newProxyAuthService(t, registry.URL)
+	getTags := func() {
+		t.Helper()
+		if _, err := s.GetTags("private/app", newTestContext(http.MethodGet, "/v2/private/app/tags/list", "", true)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	getTags()
+	getTags()
+	if registry.issued.Load() != 1 {
+		t.Fatalf("issued = %d, want cached upstream token reused", registry.issued.Load())
+	}
+
+	// 上游吊销 token 后返回 401，代理重新换取 token 并重试一次
+	registry.token.Store("revoked")
+	getTags()
+	if registry.issued.Load() != 2 {
+		t.Fatalf("issued = %d, want a new token after the upstream rejected the cached one", registry.issued.Load())
+	}
+	getTags()
+	if registry.issued.Load() != 2 {
+		t.Fatalf("issued = %d, want the renewed token cached", registry.issued.Load())
+	}
+}
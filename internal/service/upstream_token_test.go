@@ -0,0 +1,90 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// writeTestJWKS 生成 ES256 私钥并把公钥写入本地 JWKS 文件，返回私钥和文件路径
+func writeTestJWKS(t *testing.T) (*ecdsa.PrivateKey, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk, err := newJWK(&key.PublicKey, "ES256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(JWKSet{Keys: []JWK{jwk}})
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return key, file
+}
+
+// newTestUpstreamVerifier 创建使用本地 JWKS 文件的上游 token 校验器，返回校验器和签名私钥
+func newTestUpstreamVerifier(t *testing.T) (*upstreamTokenVerifier, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, file := writeTestJWKS(t)
+	upstream := &Upstream{UpstreamConfig: UpstreamConfig{
+		Name:        "hub",
+		TokenVerify: &UpstreamTokenVerifyConfig{JWKSFile: file, Audience: "registry.docker.io"},
+	}}
+	verifier, err := newUpstreamTokenVerifier(newTestLogger(), upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return verifier, key
+}
+
+func TestUpstreamTokenVerifyAccess(t *testing.T) {
+	verifier, key := newTestUpstreamVerifier(t)
+	sign := func(access []Access) string {
+		claims := &upstreamTokenClaims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Audience:  jwt.ClaimStrings{"registry.docker.io"},
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+			},
+			Access: access,
+		}
+		token, err := jwt.NewWithClaims(jwt.SigningMethodES256, claims).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	pullApp := sign([]Access{{Type: "repository", Name: "org/app", Actions: []string{"pull"}}})
+
+	tests := []struct {
+		name   string
+		token  string
+		typ    string
+		repo   string
+		action string
+		ok     bool
+	}{
+		{"granted repository", pullApp, "repository", "org/app", "pull", true},
+		{"other repository", pullApp, "repository", "org/other", "pull", false},
+		{"other action", pullApp, "repository", "org/app", "push", false},
+		{"no access", sign(nil), "repository", "org/app", "pull", false},
+		{"catalog", sign([]Access{{Type: "registry", Name: "catalog", Actions: []string{"*"}}}), "registry", "catalog", "*", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifier.Verify(tt.token, tt.typ, tt.repo, tt.action)
+			if (err == nil) != tt.ok {
+				t.Fatalf("Verify() err = %v, want ok=%v", err, tt.ok)
+			}
+		})
+	}
+}